@@ -1,20 +1,52 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
 	"flag"
 	"fmt"
+	"io"
+	"net/http"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
-	"github.com/hpcloud/tail"
 	"github.com/ingyamilmolinar/doctorgpt/agent/internal/buffer"
+	"github.com/ingyamilmolinar/doctorgpt/agent/internal/clock"
 	"github.com/ingyamilmolinar/doctorgpt/agent/internal/config"
 	"github.com/ingyamilmolinar/doctorgpt/agent/internal/diagnose"
+	"github.com/ingyamilmolinar/doctorgpt/agent/internal/discovery"
+	"github.com/ingyamilmolinar/doctorgpt/agent/internal/fluent"
+	"github.com/ingyamilmolinar/doctorgpt/agent/internal/heartbeat"
+	"github.com/ingyamilmolinar/doctorgpt/agent/internal/ingest"
+	"github.com/ingyamilmolinar/doctorgpt/agent/internal/input"
+	"github.com/ingyamilmolinar/doctorgpt/agent/internal/journal"
+	"github.com/ingyamilmolinar/doctorgpt/agent/internal/journald"
+	"github.com/ingyamilmolinar/doctorgpt/agent/internal/kubernetes"
+	"github.com/ingyamilmolinar/doctorgpt/agent/internal/multiline"
+	"github.com/ingyamilmolinar/doctorgpt/agent/internal/otlp"
 	"github.com/ingyamilmolinar/doctorgpt/agent/internal/parser"
+	"github.com/ingyamilmolinar/doctorgpt/agent/internal/rate"
+	"github.com/ingyamilmolinar/doctorgpt/agent/internal/syslog"
+	"github.com/ingyamilmolinar/doctorgpt/agent/internal/tailer"
+	"github.com/ingyamilmolinar/doctorgpt/agent/internal/tokenizer"
 	"go.uber.org/zap"
 )
 
+// Max attempts per diagnosis in analyze mode when --maxattempts retries forever
+const analyzeMaxAttempts = 3
+
+// Backoff between attempts in analyze mode (daemons wait up to 10 minutes)
+const (
+	analyzeRetryInterval    = time.Second
+	analyzeMaxRetryInterval = 30 * time.Second
+)
+
 func main() {
 	_, err := fmt.Println("Beginning start-up sequence")
 	if err != nil {
@@ -22,9 +54,25 @@ func main() {
 	}
 
 	// Parse command-line arguments
-	// TODO: Monitor all logs in a directory
-	logFilePath := flag.String("logfile", "", "path to log file")
+	logFilePath := flag.String("logfile", "", "path to log file (glob patterns are supported) or \"-\" to read from stdin")
+	logDir := flag.String("logdir", "", "path to directory whose log files will all be monitored")
+	syslogUDP := flag.String("syslogudp", "", "address to receive syslog messages on over UDP (e.g. \":514\")")
+	syslogTCP := flag.String("syslogtcp", "", "address to receive syslog messages on over TCP (e.g. \":514\")")
+	syslogTLS := flag.String("syslogtls", "", "address to receive syslog messages on over TLS (e.g. \":6514\")")
+	syslogTLSCert := flag.String("syslogtlscert", "", "path to the PEM certificate of the syslog TLS listener")
+	syslogTLSKey := flag.String("syslogtlskey", "", "path to the PEM key of the syslog TLS listener")
+	fluentAddr := flag.String("fluentaddr", "", "address to receive Fluent Bit / Fluentd forward messages on over TCP (e.g. \":24224\")")
+	fluentTLSCert := flag.String("fluenttlscert", "", "path to the PEM certificate of the forward listener (enables TLS)")
+	fluentTLSKey := flag.String("fluenttlskey", "", "path to the PEM key of the forward listener")
+	fluentSharedKey := flag.String("fluentsharedkey", "", "shared key forward clients must authenticate with (no authentication if empty)")
+	httpAddr := flag.String("httpaddr", "", "address to receive log lines (and OTLP/HTTP logs) on over HTTP (e.g. \":4318\")")
+	httpToken := flag.String("httptoken", "", "bearer token HTTP clients must send (none if empty)")
+	maxSources := flag.Int("maxsources", input.DefaultMaxSources, "max log sources received over the network monitored at once (0 for no limit)")
+	sourceTTLInSecs := flag.Int("sourcettlseconds", int(input.DefaultSourceTTL/time.Second), "time in seconds after which network log sources without new lines stop being monitored (0 for never)")
+	sourceName := flag.String("sourcename", "stdin", "name of the logs read from stdin (used in diagnosis file names)")
+	discoveryIntervalInSecs := flag.Int("discoveryintervalseconds", 5, "interval in seconds to discover new or removed log files")
 	outputDir := flag.String("outdir", "", "path to output directory")
+	analyzeMode := flag.Bool("analyze", false, "analyze the log files (plain or compressed) up to EOF instead of tailing them, then exit (non-zero if errors were found)")
 	configFilePath := flag.String("configfile", "", "path to config file")
 	// String instead of bool due to: https://stackoverflow.com/questions/27411691/how-to-pass-boolean-arguments-to-go-flags
 	debugFlag := flag.String("debug", "true", "log debug flag")
@@ -32,6 +80,19 @@ func main() {
 	bufferSize := flag.Int("buffersize", 100, "max log entries per ring-buffer")
 	maxTokens := flag.Int("maxtokens", 8000, "max tokens for context per API request")
 	gptModel := flag.String("gptmodel", "gpt-4", "GPT model to use for diagnosis")
+	workers := flag.Int("workers", 2, "number of diagnoses to run concurrently")
+	maxAttempts := flag.Int("maxattempts", 10, "max attempts per diagnosis before giving up on it (0 retries forever)")
+	shutdownTimeoutInSecs := flag.Int("shutdowntimeoutseconds", 30, "time in seconds to wait for running diagnoses on shutdown")
+	analyzeTimeoutInSecs := flag.Int("analyzetimeoutseconds", 600, "time in seconds to wait for diagnoses in analyze mode once every log file is read (0 for no limit)")
+	providerName := flag.String("provider", "", "LLM provider to use for diagnosis: openai, azure or ollama (overrides config file)")
+	providerURL := flag.String("providerurl", "", "base URL of the LLM provider API (overrides config file)")
+	providerOrg := flag.String("providerorg", "", "OpenAI organization (overrides config file)")
+	providerProxy := flag.String("providerproxy", "", "HTTP(S) proxy URL used to reach the LLM provider (overrides config file)")
+	providerCABundle := flag.String("providercabundle", "", "path to a PEM file with extra CA certificates to trust (overrides config file)")
+	azureAPIVersion := flag.String("azureapiversion", "", "Azure OpenAI API version (overrides config file)")
+	azureDeployment := flag.String("azuredeployment", "", "Azure OpenAI deployment name (overrides config file)")
+	providerHeaders := headerFlags{}
+	flag.Var(&providerHeaders, "providerheader", "extra HTTP header sent to the LLM provider as \"Name: value\" (can be repeated)")
 	flag.Parse()
 
 	// Init logger
@@ -63,7 +124,6 @@ func main() {
 		fmt.Printf("Failed to init logger: %v", err)
 		os.Exit(1)
 	}
-	// TODO: Handle a kill event gracefully
 	defer logger.Sync()
 
 	go func(log *zap.Logger) {
@@ -81,9 +141,21 @@ func main() {
 	}(logger)
 	log := logger.Sugar()
 
-	if *logFilePath == "" {
-		log.Fatal("Log file path is required")
+	// Logs piped into the agent are read from stdin
+	listening := *syslogUDP != "" || *syslogTCP != "" || *syslogTLS != "" || *httpAddr != "" || *fluentAddr != ""
+	if *logFilePath == "" && *logDir == "" && !listening && stdinIsPipe() {
+		*logFilePath = tailer.Stdin
+	}
+	if *logFilePath == "" && *logDir == "" && !listening {
+		log.Fatal("Log file path, log directory or listen address (syslog, HTTP or forward) is required")
+	}
+	if *analyzeMode && *logFilePath == "" && *logDir == "" {
+		log.Fatal("Log file path or log directory is required to analyze logs")
+	}
+	if *logFilePath == tailer.Stdin && *logDir != "" {
+		log.Fatal("Log directory cannot be monitored while reading from stdin")
 	}
+	tailer.StdinName = *sourceName
 
 	if *outputDir == "" {
 		log.Fatal("Output directory path is required")
@@ -93,27 +165,328 @@ func main() {
 		log.Fatal("Config file path is required")
 	}
 
-	// Get ChatGPT API key from environment variable
-	apiKey := os.Getenv("OPENAI_KEY")
-	if apiKey == "" {
+	// Setup and build parsers
+	syslogListening := *syslogUDP != "" || *syslogTCP != "" || *syslogTLS != ""
+	sources := sourceVariables(*logFilePath != "" || *logDir != "", syslogListening, *httpAddr != "", *fluentAddr != "")
+	cfg, parsers, err := setup(log, *configFilePath, *outputDir, sources, config.FileConfigProvider)
+	if err != nil {
+		log.Fatalf("Setup failed: %v", err)
+	}
+
+	// Build LLM provider (flags take precedence over the config file)
+	providerConfig := diagnose.ProviderConfig{
+		Name:         cfg.Provider.Name,
+		URL:          cfg.Provider.URL,
+		Organization: cfg.Provider.Organization,
+		Headers:      map[string]string{},
+		Proxy:        cfg.Provider.Proxy,
+		CABundle:     cfg.Provider.CABundle,
+		APIVersion:   cfg.Provider.APIVersion,
+		Deployment:   cfg.Provider.Deployment,
+		// Get ChatGPT API key from environment variable
+		APIKey: os.Getenv("OPENAI_KEY"),
+	}
+	for name, value := range cfg.Provider.Headers {
+		providerConfig.Headers[name] = value
+	}
+	for name, value := range providerHeaders {
+		providerConfig.Headers[name] = value
+	}
+	overrideString(&providerConfig.Name, *providerName)
+	overrideString(&providerConfig.URL, *providerURL)
+	overrideString(&providerConfig.Organization, *providerOrg)
+	overrideString(&providerConfig.Proxy, *providerProxy)
+	overrideString(&providerConfig.CABundle, *providerCABundle)
+	overrideString(&providerConfig.APIVersion, *azureAPIVersion)
+	overrideString(&providerConfig.Deployment, *azureDeployment)
+	if providerConfig.RequiresAPIKey() && providerConfig.APIKey == "" {
 		log.Fatal("ChatGPT API key is required")
 	}
+	provider, err := diagnose.NewProvider(providerConfig)
+	if err != nil {
+		log.Fatalf("Invalid LLM provider: %v", err)
+	}
+	log.Infof("Using LLM provider (%s)", provider.Name())
 
-	// Setup and build parsers
-	parsers, err := setup(log, *configFilePath, *outputDir, config.FileConfigProvider)
+	// Diagnoses are journaled before calling the LLM and run in the background.
+	// Queued ones survive restarts and failed ones are retried with backoff.
+	// Analyze mode leaves the daemon journal alone (nothing is replayed) and always gives up eventually.
+	journalDir := filepath.Join(*outputDir, ".journal")
+	attempts := *maxAttempts
+	if *analyzeMode {
+		journalDir, err = os.MkdirTemp("", "doctorgpt-analyze-")
+		if err != nil {
+			log.Fatalf("Failed to create journal directory: %v", err)
+		}
+		if attempts <= 0 {
+			attempts = analyzeMaxAttempts
+		}
+	}
+	diagnosisJournal, err := journal.Open(log, journalDir)
 	if err != nil {
-		log.Fatalf("Setup failed: %v", err)
+		log.Fatalf("Failed to open journal: %v", err)
+	}
+	queue := diagnose.NewQueue(log, diagnosisJournal, diagnose.NewDiagnoser(provider), *workers, attempts)
+	if *analyzeMode {
+		queue.SetRetryIntervals(analyzeRetryInterval, analyzeMaxRetryInterval)
+	}
+	err = queue.Start()
+	if err != nil {
+		log.Fatalf("Failed to replay queued diagnoses: %v", err)
 	}
+	handler := queue.Handler()
+
+	// Stop tailing on SIGINT/SIGTERM
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
 
-	// This will effectively never end (it doesn't handle EOF)
 	timeoutDuration := time.Duration(*logBundlingTimeoutInSecs) * time.Second
-	MonitorLogLoop(log, *logFilePath, *outputDir, apiKey, *gptModel, *bufferSize, *maxTokens, parsers, diagnose.HandleTrigger, timeoutDuration, true)
+	shutdownTimeout := time.Duration(*shutdownTimeoutInSecs) * time.Second
+	patterns := discovery.Patterns(*logFilePath, *logDir)
+
+	// Analyze mode reads every file once and waits for all diagnoses
+	if *analyzeMode {
+		fileNames := []string{tailer.Stdin}
+		if *logFilePath != tailer.Stdin {
+			fileNames = discovery.Files(log, patterns)
+		}
+		summary := Analyze(ctx, log, fileNames, *outputDir, *gptModel, *bufferSize, *maxTokens, parsers, handler, timeoutDuration)
+		summary.FailedDiagnoses = WaitForDiagnoses(ctx, log, queue, time.Duration(*analyzeTimeoutInSecs)*time.Second, shutdownTimeout)
+		err = os.RemoveAll(journalDir)
+		if err != nil {
+			log.Errorf("Failed to remove journal directory: %v", err)
+		}
+		summary.Print(os.Stdout)
+		os.Exit(summary.ExitCode())
+	}
+
+	// Heartbeats are shared by every log source (files and network sources)
+	heartbeats, err := NewHeartbeats(log, parsers, *gptModel, *maxTokens)
+	if err != nil {
+		log.Fatalf("Failed to start heartbeats: %v", err)
+	}
+
+	// This will only end on a kill event (it doesn't handle EOF)
+	// Each discovered file gets its own monitor loop (with its own line numbers and buffers)
+	// Log bundles still waiting for the bundling timeout are flushed once a monitor loop is stopped
+	monitor := func(ctx context.Context, path string) {
+		err := MonitorLogLoop(ctx, log, path, *outputDir, filepath.Join(*outputDir, ".checkpoints"), *gptModel, *bufferSize, *maxTokens, parsers, handler, heartbeats, timeoutDuration, true)
+		if err != nil {
+			log.Errorf("Failed to monitor log file (%s): %v", path, err)
+		}
+	}
+	var wg sync.WaitGroup
+	if *logFilePath == tailer.Stdin {
+		// Stdin ends with its writer
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			monitor(ctx, tailer.Stdin)
+		}()
+	} else if len(patterns) > 0 {
+		discoveryInterval := time.Duration(*discoveryIntervalInSecs) * time.Second
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			discovery.Watch(ctx, log, patterns, discoveryInterval, monitor)
+		}()
+	}
+
+	// Each sending host (HTTP stream, OTLP service or forwarded tag) gets its own monitor loop (named after it)
+	if listening {
+		sourceTTL := time.Duration(*sourceTTLInSecs) * time.Second
+		demux := input.NewDemux(ctx, log, *maxSources, sourceTTL, func(ctx context.Context, name string, lines <-chan tailer.Line) {
+			err := MonitorLines(ctx, log, lines, *outputDir, *gptModel, *bufferSize, *maxTokens, parsers, handler, heartbeats, timeoutDuration, nil)
+			if err != nil {
+				log.Errorf("Failed to monitor log source (%s): %v", name, err)
+			}
+		})
+		err = listenSyslog(ctx, log, demux, *syslogUDP, *syslogTCP, *syslogTLS, *syslogTLSCert, *syslogTLSKey)
+		if err != nil {
+			log.Fatalf("Failed to start syslog receiver: %v", err)
+		}
+		if *fluentAddr != "" {
+			var tlsConfig *tls.Config
+			if *fluentTLSCert != "" || *fluentTLSKey != "" {
+				tlsConfig, err = syslog.LoadTLSConfig(*fluentTLSCert, *fluentTLSKey)
+				if err != nil {
+					log.Fatalf("Failed to load forward TLS certificate: %v", err)
+				}
+			}
+			_, err = fluent.Listen(ctx, log, *fluentAddr, tlsConfig, *fluentSharedKey, demux)
+			if err != nil {
+				log.Fatalf("Failed to start forward receiver: %v", err)
+			}
+		}
+		if *httpAddr != "" {
+			mux := http.NewServeMux()
+			mux.Handle(ingest.Path, ingest.Handler(log, demux, *httpToken))
+			mux.Handle(otlp.Path, otlp.Handler(log, demux, *httpToken))
+			_, err = ingest.Serve(ctx, log, *httpAddr, mux)
+			if err != nil {
+				log.Fatalf("Failed to start HTTP receiver: %v", err)
+			}
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-ctx.Done()
+			demux.Wait()
+		}()
+	}
+	wg.Wait()
+
+	log.Info("Shutting down: waiting for running diagnoses")
+	unfinished := queue.Drain(shutdownTimeout)
+	if unfinished > 0 {
+		log.Warnf("Left (%d) queued diagnoses to be replayed on next start-up", unfinished)
+	}
+}
+
+// Summary of the analysis of log files
+type Summary struct {
+	Files           int
+	FailedFiles     int
+	FailedDiagnoses int
+	// Locations (file:line) of the errors found
+	Errors []string
+}
+
+// Analyze reads the log files up to EOF (one after the other) handing every error found to the handler
+func Analyze(ctx context.Context, log *zap.SugaredLogger, fileNames []string, outputDir, model string, bufferSize, maxTokens int, parsers []parser.Parser, handler diagnose.Handler, timeout time.Duration) Summary {
+	var summary Summary
+	var mu sync.Mutex
+	recorder := func(log *zap.SugaredLogger, fileName, outputDir, model string, entryToDiagnose parser.LogEntry, logContext []parser.LogEntry) error {
+		location := fileName
+		if entryToDiagnose.LineNo > 0 {
+			location += ":" + strconv.Itoa(entryToDiagnose.LineNo)
+		}
+		mu.Lock()
+		summary.Errors = append(summary.Errors, location)
+		mu.Unlock()
+		return handler(log, fileName, outputDir, model, entryToDiagnose, logContext)
+	}
+	// Heartbeats are shared by every log file
+	heartbeats, err := NewHeartbeats(log, parsers, model, maxTokens)
+	if err != nil {
+		log.Errorf("Failed to start heartbeats: %v", err)
+	}
+	for _, fileName := range fileNames {
+		if ctx.Err() != nil {
+			break
+		}
+		log.Infof("Analyzing log file (%s)", fileName)
+		summary.Files++
+		err := MonitorLogLoop(ctx, log, fileName, outputDir, "", model, bufferSize, maxTokens, parsers, recorder, heartbeats, timeout, false)
+		if err != nil {
+			log.Errorf("Failed to analyze log file (%s): %v", fileName, err)
+			summary.FailedFiles++
+		}
+	}
+	return summary
+}
+
+// WaitForDiagnoses waits for every queued diagnosis up to the timeout (0 for no limit), then
+// stops the queue. It returns how many diagnoses were given up on (failed or unfinished).
+func WaitForDiagnoses(ctx context.Context, log *zap.SugaredLogger, queue *diagnose.Queue, timeout, shutdownTimeout time.Duration) int {
+	log.Info("Waiting for every diagnosis")
+	waitCtx := ctx
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		waitCtx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	if !queue.Wait(waitCtx) {
+		if ctx.Err() != nil {
+			log.Warn("Interrupted while waiting for diagnoses")
+		} else {
+			log.Warnf("Timed out after (%s) waiting for diagnoses", timeout)
+		}
+	}
+	unfinished := queue.Drain(shutdownTimeout)
+	if unfinished > 0 {
+		log.Warnf("Gave up on (%d) unfinished diagnoses", unfinished)
+	}
+	return queue.Failed() + unfinished
+}
+
+// Print writes a human readable summary
+func (s Summary) Print(w io.Writer) {
+	fmt.Fprintf(w, "Analyzed %d log files (%d failed): %d errors found, %d diagnoses failed\n", s.Files, s.FailedFiles, len(s.Errors), s.FailedDiagnoses)
+	for _, location := range s.Errors {
+		fmt.Fprintf(w, "  %s\n", location)
+	}
+}
+
+// ExitCode is 0 if no errors were found, 1 if errors were found and diagnosed and 2 if
+// the analysis itself failed (unreadable log files or diagnoses given up on)
+func (s Summary) ExitCode() int {
+	if s.FailedFiles > 0 || s.FailedDiagnoses > 0 {
+		return 2
+	}
+	if len(s.Errors) > 0 {
+		return 1
+	}
+	return 0
+}
+
+// listenSyslog starts a syslog listener for every address set
+func listenSyslog(ctx context.Context, log *zap.SugaredLogger, demux *input.Demux, udpAddr, tcpAddr, tlsAddr, certFile, keyFile string) error {
+	if udpAddr != "" {
+		_, err := syslog.ListenUDP(ctx, log, udpAddr, demux)
+		if err != nil {
+			return err
+		}
+	}
+	if tcpAddr != "" {
+		_, err := syslog.ListenTCP(ctx, log, tcpAddr, nil, demux)
+		if err != nil {
+			return err
+		}
+	}
+	if tlsAddr != "" {
+		tlsConfig, err := syslog.LoadTLSConfig(certFile, keyFile)
+		if err != nil {
+			return err
+		}
+		_, err = syslog.ListenTCP(ctx, log, tlsAddr, tlsConfig, demux)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// stdinIsPipe checks whether stdin is a pipe or a file (as opposed to a terminal)
+func stdinIsPipe() bool {
+	info, err := os.Stdin.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice == 0
 }
 
-func setup(log *zap.SugaredLogger, configFile, outputDir string, configProvider config.ConfigProvider) ([]parser.Parser, error) {
+// sourceVariables returns the variables set by the log sources in use (parsers can match on them)
+func sourceVariables(files, syslogListening, httpListening, fluentListening bool) parser.SourceVariables {
+	var sources parser.SourceVariables
+	if files {
+		// Container logs and journal exports are recognized among log files
+		sources = append(sources, kubernetes.Variables...)
+		sources = append(sources, journald.Variables...)
+	}
+	if syslogListening {
+		sources = append(sources, syslog.Variables...)
+	}
+	if httpListening {
+		sources = append(sources, otlp.Variables...)
+	}
+	if fluentListening {
+		sources = append(sources, fluent.Variables...)
+	}
+	return sources
+}
+
+func setup(log *zap.SugaredLogger, configFile, outputDir string, sources parser.SourceVariables, configProvider config.ConfigProvider) (config.Config, []parser.Parser, error) {
 	cfg, err := configProvider(log, configFile)
 	if err != nil {
-		return nil, fmt.Errorf("config provider failed: %w", err)
+		return cfg, nil, fmt.Errorf("config provider failed: %w", err)
 	}
 	if cfg.SystemPrompt != "" {
 		config.SystemPrompt = cfg.SystemPrompt
@@ -124,9 +497,9 @@ func setup(log *zap.SugaredLogger, configFile, outputDir string, configProvider
 
 	var parsers []parser.Parser
 	for _, p := range cfg.Parsers {
-		parser, err := parser.NewParser(log, p.Regex, p.Filters, p.Triggers, p.Excludes)
+		parser, err := parser.NewParserFromConfig(log, p, sources)
 		if err != nil {
-			return nil, fmt.Errorf("invalid config file: %w", err)
+			return cfg, nil, fmt.Errorf("invalid config file: %w", err)
 		}
 		log.Debugf("Appending parser (%s)", parser.Regex)
 		parsers = append(parsers, parser)
@@ -136,67 +509,240 @@ func setup(log *zap.SugaredLogger, configFile, outputDir string, configProvider
 	// Create dir if not exists
 	exists, err := exists(outputDir)
 	if err != nil {
-		return nil, fmt.Errorf("failed to open output directory: %w", err)
+		return cfg, nil, fmt.Errorf("failed to open output directory: %w", err)
 	}
 	// TODO: If exists, check permissions
 	if !exists {
 		err = os.Mkdir(outputDir, 0755)
 		if err != nil {
-			return nil, fmt.Errorf("failed to create output directory: %w", err)
+			return cfg, nil, fmt.Errorf("failed to create output directory: %w", err)
 		}
 	}
-	return parsers, nil
+	return cfg, parsers, nil
 }
 
-func MonitorLogLoop(log *zap.SugaredLogger, fileName, outputDir, apiKey, model string, bufferSize, maxTokens int, parsers []parser.Parser, handler diagnose.Handler, timeout time.Duration, follow bool) {
+// MonitorLogLoop tails a single log file until EOF (when not following) or until ctx is done.
+// The position reached is checkpointed under checkpointDir (if any) to resume from it on restart.
+func MonitorLogLoop(ctx context.Context, log *zap.SugaredLogger, fileName, outputDir, checkpointDir, model string, bufferSize, maxTokens int, parsers []parser.Parser, handler diagnose.Handler, heartbeats *heartbeat.Monitor, timeout time.Duration, follow bool) error {
+	var start tailer.Position
+	if checkpointDir != "" {
+		var err error
+		start, err = tailer.LoadCheckpoint(checkpointDir, fileName)
+		if err != nil {
+			log.Errorf("Ignoring checkpoint of (%s): %v", fileName, err)
+		}
+	}
+
 	// Set up tail object to read log file
-	tailConfig := tail.Config{
-		Follow: follow,
-		ReOpen: follow,
+	tailCtx, stopTail := context.WithCancel(ctx)
+	defer stopTail()
+	t, err := tailer.TailFile(tailCtx, log, fileName, start, follow)
+	if err != nil {
+		return fmt.Errorf("failed to tail log file: %w", err)
+	}
+	if !t.Resumable() {
+		checkpointDir = ""
 	}
-	t, err := tail.TailFile(fileName, tailConfig)
+	var lines <-chan tailer.Line = t.Lines
+	if container, ok := kubernetes.ParseFileName(fileName); ok {
+		// Kubernetes container log (named after its container)
+		lines = kubernetes.Decode(tailCtx, container, t.Lines)
+	} else {
+		// systemd journal entries (journalctl -o json or -o export), any other format is left as is
+		lines = journald.Decode(tailCtx, t.Lines)
+	}
+
+	// Only lines that are no longer part of a pending bundle are checkpointed
+	checkpointed := start
+	checkpoint := func(position tailer.Position) {
+		if checkpointDir == "" || position == checkpointed {
+			return
+		}
+		err := tailer.SaveCheckpoint(checkpointDir, fileName, position)
+		if err != nil {
+			log.Errorf("Failed to checkpoint (%s): %v", fileName, err)
+			return
+		}
+		checkpointed = position
+	}
+
+	err = MonitorLines(ctx, log, lines, outputDir, model, bufferSize, maxTokens, parsers, handler, heartbeats, timeout, checkpoint)
 	if err != nil {
-		log.Fatalf("Failed to tail log file: %v", err)
+		return err
+	}
+	if ctx.Err() != nil {
+		log.Infof("Stopped monitoring log file (%s)", fileName)
 	}
+	return t.Err()
+}
 
-	// Map of log buffers, keyed by thread ID or routine name
-	logBuffers := make(map[string]*buffer.LogBuffer)
+// NewHeartbeats returns the heartbeat monitor shared by the log sources (nil if no parser has heartbeats)
+func NewHeartbeats(log *zap.SugaredLogger, parsers []parser.Parser, model string, maxTokens int) (*heartbeat.Monitor, error) {
+	enabled := false
+	for _, p := range parsers {
+		enabled = enabled || len(p.Heartbeats) > 0
+	}
+	if !enabled {
+		return nil, nil
+	}
+	count, err := tokenizer.ForModel(model)
+	if err != nil {
+		return nil, err
+	}
+	budget := tokenizer.Budget(count, maxTokens, config.SystemPrompt, strings.Replace(config.UserPrompt, config.ErrorPlaceholder, "", 1))
+	return heartbeat.NewMonitor(log, parsers, budget, count), nil
+}
 
-	// Loop to read new lines from the log file
-	lineNum := 0
-	for line := range t.Lines {
-		lineNum++
-	top:
-		// Parse the log entry
-		entry, parserMatched, err := parser.ParseLogEntry(log, parsers, line.Text, lineNum)
+// MonitorLines runs the lines of a log source through the parsers, bundling and diagnosing errors,
+// until lines is closed or ctx is done. The position of the last line no longer part of a pending
+// bundle is regularly handed to checkpoint (if any).
+func MonitorLines(ctx context.Context, log *zap.SugaredLogger, lines <-chan tailer.Line, outputDir, model string, bufferSize, maxTokens int, parsers []parser.Parser, handler diagnose.Handler, heartbeats *heartbeat.Monitor, timeout time.Duration, checkpoint func(tailer.Position)) error {
+	var position tailer.Position
+	if checkpoint != nil {
+		defer func() {
+			checkpoint(position)
+		}()
+	}
+
+	// Multi-line log entries (stack traces...) are joined before being parsed
+	if multiline.Enabled(parsers) {
+		lines = multiline.Assemble(ctx, log, parsers, lines)
+	}
+
+	// Log buffers, keyed by partition (thread ID, request ID...)
+	// Their token budget is whatever is left once the prompts are accounted for
+	count, err := tokenizer.ForModel(model)
+	if err != nil {
+		return err
+	}
+	budget := tokenizer.Budget(count, maxTokens, config.SystemPrompt, strings.Replace(config.UserPrompt, config.ErrorPlaceholder, "", 1))
+	partitions := buffer.NewPartitions(log, bufferSize, budget, count)
+	// Time of the log source (partitions expire on the time of the log entries, when known)
+	logClock := clock.New()
+	// Heartbeats measure the silences of the log source in its time (from its start on)
+	heartbeats.Start(logClock)
+	defer heartbeats.Stop(logClock)
+	evictTicker := time.NewTicker(time.Second)
+	defer evictTicker.Stop()
+	defaultParser := len(parsers) - 1
+	lastKey := buffer.DefaultPartition
+
+	// Dump the log context buffer, clear it and hand it to the handler
+	// Handlers are expected to return quickly (see diagnose.Queue)
+	// TODO: Expose N prompts and N diagnosis per error configuration
+	dispatch := func(key, segment string, entryToDiagnose parser.LogEntry, burst *rate.Burst) {
+		buffer := partitions.Get(key, entryToDiagnose.Parser.PartitionTTL, logClock.Now())
+		dumpedBuffer := buffer.Dump()
+		buffer.Clear()
+		// Rate triggers add the entries of the burst (and its count) to the context
+		if burst != nil {
+			dumpedBuffer = burst.Context(log, dumpedBuffer, budget, count)
+		}
+		err := handler(log, segment, outputDir, model, entryToDiagnose, dumpedBuffer)
 		if err != nil {
-			log.Fatalf("Error parsing log entry (%s)", line)
+			log.Errorf("Handler failed: %v", err)
+		}
+	}
+
+	// Heartbeats diagnose when the log entries they expect stop arriving
+	// Silences are checked on every tick (and line, to catch them in the time of the log entries)
+	// They are shared by every log source (nil if none), so each silence is diagnosed once
+	checkHeartbeats := func() {
+		for _, silence := range heartbeats.Silent(logClock) {
+			err := handler(log, silence.Name(), outputDir, model, silence.Entry(), silence.Context(log, budget, count))
+			if err != nil {
+				log.Errorf("Handler failed: %v", err)
+			}
+		}
+	}
+
+	// Triggers of rate parsers only diagnose once they match enough log entries within their window
+	rates := rate.NewCounter(log)
+	type parsedLine struct {
+		entry   parser.LogEntry
+		matched int
+		// Burst of matching entries of rate parsers reaching their threshold (if any)
+		burst *rate.Burst
+	}
+	parse := func(l tailer.Line) (parsedLine, error) {
+		entry, matched, err := parser.ParseLogEntryWithVariables(log, parsers, l.Text, l.Number(), l.Variables, logClock)
+		if err != nil {
+			return parsedLine{}, fmt.Errorf("error parsing log entry (%s): %w", l.Text, err)
+		}
+		heartbeats.Observe(l.File, logClock, matched, entry)
+		checkHeartbeats()
+		parsed := parsedLine{entry: entry, matched: matched}
+		if entry.Parser.Rate == nil || entry.Excluded || entry.Filtered || !entry.Triggered {
+			return parsed, nil
+		}
+		burst, ok := rates.Count(matched, entry, logClock.Now())
+		parsed.entry.Triggered = ok
+		if ok {
+			parsed.burst = &burst
+		}
+		return parsed, nil
+	}
+	// Line parsed while bundling that ended the bundle (processed next)
+	var pending *parsedLine
+
+	// Loop to read new lines from the log source
+	for {
+		var line tailer.Line
+		select {
+		case <-ctx.Done():
+			log.Info("Stopped monitoring log source")
+			return nil
+		case <-evictTicker.C:
+			partitions.Evict(logClock.Now())
+			rates.Evict(logClock.Now())
+			checkHeartbeats()
+			if checkpoint != nil {
+				checkpoint(position)
+			}
+			continue
+		case l, ok := <-lines:
+			if !ok {
+				log.Debug("Log line channel closed")
+				return nil
+			}
+			line = l
+		}
+	top:
+		position = line.Position
+		// Parse the log entry (unless it was already parsed while bundling)
+		var parsed parsedLine
+		if pending != nil {
+			parsed = *pending
+			pending = nil
+		} else {
+			parsed, err = parse(line)
+			if err != nil {
+				return err
+			}
 		}
+		entry, parserMatched := parsed.entry, parsed.matched
 
 		// If entry is excluded, ignore it
 		if entry.Excluded {
 			continue
 		}
 
-		// TODO: Divide into buffers depending on granularity
-		key := "DEFAULT"
+		key := partitionKey(entry, parserMatched == defaultParser, lastKey)
+		lastKey = key
 		log.Debugf("Process key (%s)", key)
 
-		// Create a new buffer if necessary
-		if _, ok := logBuffers[key]; !ok {
-			logBuffers[key] = buffer.NewLogBuffer(log, bufferSize, maxTokens-len(config.SystemPrompt)-len(config.UserPrompt))
-		}
-
-		// Buffer the log entry
-		log.Debugf("Appending to buffer: (%s)", line)
-		buffer := logBuffers[key]
-		buffer.Append(entry)
+		// Buffer the log entry (creating a new buffer if necessary)
+		log.Debugf("Appending to buffer: (%s)", line.Text)
+		partitions.Get(key, entry.Parser.PartitionTTL, logClock.Now()).Append(entry)
 
 		// Check if the log entry indicates an error
 		log.Debugf("Should filter: %v", entry.Filtered)
 		log.Debugf("Should diagnose: %v", !entry.Filtered && entry.Triggered)
 		if !entry.Filtered && entry.Triggered {
 			entryToDiagnose := entry
+			burst := parsed.burst
+			// Rotated segment (or the log file itself) the entry was read from
+			segment := line.File
 			log.Infof("Entry to diagnose: %s", entryToDiagnose.Text)
 			// Append subsequent log entries to the buffer until a new log level is detected
 			// Wait for input or timeout in N seconds
@@ -207,72 +753,100 @@ func MonitorLogLoop(log *zap.SugaredLogger, fileName, outputDir, apiKey, model s
 				case <-timec:
 					log.Info("Timeout!")
 					break outer // timed out
+				case <-ctx.Done():
+					log.Debug("Monitoring stopped while bundling")
+					break outer
+				case <-evictTicker.C:
+					checkHeartbeats()
 				// Process previous entry if exist
-				case l, ok := <-t.Lines:
+				case l, ok := <-lines:
 					if !ok {
 						log.Debug("Log line channel closed or empty")
 						break outer
 					}
-					// increment line number
-					lineNum++
 					// Parse lines until we hit a known log line that's not the generic one
-					var matched int
-					entry, matched, err = parser.ParseLogEntry(log, parsers, l.Text, lineNum)
+					next, err := parse(l)
 					if err != nil {
-						log.Fatalf("Error parsing log entry (%s)", l.Text)
+						return err
 					}
+					entry = next.entry
+					matched := next.matched
 
 					// If entry is excluded, ignore it
 					if entry.Excluded {
 						continue
 					}
 
+					entryKey := partitionKey(entry, matched == defaultParser, lastKey)
+					triggered := !entry.Filtered && entry.Triggered
+
 					// TODO: Have an optional "bundle" line limit to avoid packing too much context after the error
 					// TODO: Do not rely on location for the default parser
-					if matched == len(parsers)-1 || (matched == parserMatched && !entry.Filtered && entry.Triggered) {
+					// Bursts of rate triggers always get their own diagnosis
+					if next.burst == nil && entryKey == key && (matched == defaultParser || (matched == parserMatched && triggered)) {
 						// Matched default parser OR
 						// Matched the same parser and it was triggered
-						log.Debugf("Default parser matched: (%v)", matched == len(parsers)-1)
+						log.Debugf("Default parser matched: (%v)", matched == defaultParser)
 						log.Debugf("Appending to buffer: (%v)", entry)
-						buffer := logBuffers[key]
-						buffer.Append(entry)
+						lastKey = entryKey
+						partitions.Get(key, entry.Parser.PartitionTTL, logClock.Now()).Append(entry)
+					} else if entryKey != key && !triggered {
+						// Entries from other partitions do not interrupt the bundling
+						log.Debugf("Appending to buffer (%s): (%v)", entryKey, entry)
+						lastKey = entryKey
+						partitions.Get(entryKey, entry.Parser.PartitionTTL, logClock.Now()).Append(entry)
 					} else {
 						// Spoof line and go back to top
 						log.Debugf("Spoofing: (%s)", l.Text)
 						line = l
+						pending = &next
 
-						// TODO: Deduplicate this logic
-						// dump log context buffer and clear
-						dumpedBuffer := logBuffers[key].Dump()
-						logBuffers[key].Clear()
-						go func() {
-							err := handler(log, fileName, outputDir, apiKey, model, entryToDiagnose, dumpedBuffer)
-							if err != nil {
-								log.Errorf("Handler failed: %v", err)
-							}
-						}()
+						dispatch(key, segment, entryToDiagnose, burst)
 						goto top
 					}
 				}
 			}
 
-			// dump log context buffer and clear
-			dumpedBuffer := logBuffers[key].Dump()
-			logBuffers[key].Clear()
-
-			// Async call the ChatGPT API
-			// TODO: We need persistance to make sure all errors are reported
-			// TODO: Expose N prompts and N diagnosis per error configuration
-			go func() {
-				err := handler(log, fileName, outputDir, apiKey, model, entryToDiagnose, dumpedBuffer)
-				if err != nil {
-					log.Errorf("Handler failed: %v", err)
-				}
-			}()
+			dispatch(key, segment, entryToDiagnose, burst)
 		}
 	}
 }
 
+// partitionKey returns the buffer key for an entry. Entries matched by the default
+// parser (e.g. stack trace lines) belong to the partition of the previous entry.
+func partitionKey(entry parser.LogEntry, defaultParser bool, lastKey string) string {
+	if key := entry.Partition(); key != "" {
+		return key
+	}
+	if defaultParser {
+		return lastKey
+	}
+	return buffer.DefaultPartition
+}
+
+// overrideString replaces a config value with its flag value (when set)
+func overrideString(value *string, flagValue string) {
+	if flagValue != "" {
+		*value = flagValue
+	}
+}
+
+// headerFlags collects repeated "Name: value" flags
+type headerFlags map[string]string
+
+func (h headerFlags) String() string {
+	return fmt.Sprintf("%v", map[string]string(h))
+}
+
+func (h headerFlags) Set(value string) error {
+	name, headerValue, ok := strings.Cut(value, ":")
+	if !ok || strings.TrimSpace(name) == "" {
+		return fmt.Errorf("header (%s) must be formatted as \"Name: value\"", value)
+	}
+	h[strings.TrimSpace(name)] = strings.TrimSpace(headerValue)
+	return nil
+}
+
 // exists returns whether the given file or directory exists
 func exists(path string) (bool, error) {
 	_, err := os.Stat(path)
@@ -1,17 +1,25 @@
 package main
 
 import (
-	"github.com/hpcloud/tail"
+	"bytes"
+	"compress/gzip"
+	"context"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"go.uber.org/zap"
+	"os"
+	"path/filepath"
+	"strings"
 	"sync"
 	"testing"
 	"time"
 
 	"github.com/ingyamilmolinar/doctorgpt/agent/internal/common"
 	"github.com/ingyamilmolinar/doctorgpt/agent/internal/config"
+	"github.com/ingyamilmolinar/doctorgpt/agent/internal/diagnose"
+	"github.com/ingyamilmolinar/doctorgpt/agent/internal/journal"
 	"github.com/ingyamilmolinar/doctorgpt/agent/internal/parser"
+	"github.com/ingyamilmolinar/doctorgpt/agent/internal/tailer"
 )
 
 var logger, _ = zap.NewDevelopment()
@@ -93,12 +101,7 @@ func TestParsers(t *testing.T) {
 		allLineParser,
 	}
 
-	tailConfig := tail.Config{
-		Follow:    false,
-		MustExist: true,
-	}
-
-	f, err := tail.TailFile("testlogs/prisma.log", tailConfig)
+	f, err := tailer.TailFile(context.Background(), logger.Sugar(), "testlogs/prisma.log", tailer.Position{}, false)
 	require.NoError(t, err)
 
 	i := 0
@@ -168,7 +171,7 @@ func TestDropboxLogExample(t *testing.T) {
 		},
 	}
 	// create validation function
-	handler := func(log *zap.SugaredLogger, fileName, outputDir, apiKey, model string, entryToDiagnose parser.LogEntry, logContext []parser.LogEntry) error {
+	handler := func(log *zap.SugaredLogger, fileName, outputDir, model string, entryToDiagnose parser.LogEntry, logContext []parser.LogEntry) error {
 		defer wg.Done()
 		require.Equal(t, expectedEntry, entryToDiagnose)
 		require.Equal(t, expectedContext, logContext)
@@ -177,10 +180,10 @@ func TestDropboxLogExample(t *testing.T) {
 	// Send process for a spin.
 	wg.Add(1)
 	go func(t *testing.T) {
-		MonitorLogLoop(logger.Sugar(), "testlogs/dropbox.log", "", "", "", 10, 8000, []parser.Parser{
+		MonitorLogLoop(context.Background(), logger.Sugar(), "testlogs/dropbox.log", "", "", "", 10, 8000, []parser.Parser{
 			dropboxParser,
 			allLineParser,
-		}, handler, 100*time.Millisecond, true)
+		}, handler, nil, 100*time.Millisecond, true)
 	}(t)
 	// Wait until handler executes
 	common.WaitWithTimeout(t, &wg, 1*time.Second)
@@ -253,7 +256,7 @@ func TestDropboxLogExampleWithFilters(t *testing.T) {
 		expectedEntry,
 	}
 	// create validation function
-	handler := func(log *zap.SugaredLogger, fileName, outputDir, apiKey, model string, entryToDiagnose parser.LogEntry, logContext []parser.LogEntry) error {
+	handler := func(log *zap.SugaredLogger, fileName, outputDir, model string, entryToDiagnose parser.LogEntry, logContext []parser.LogEntry) error {
 		defer wg.Done()
 		require.Equal(t, expectedEntry, entryToDiagnose)
 		require.Equal(t, expectedContext, logContext)
@@ -262,10 +265,10 @@ func TestDropboxLogExampleWithFilters(t *testing.T) {
 	// Send process for a spin.
 	wg.Add(1)
 	go func(t *testing.T) {
-		MonitorLogLoop(logger.Sugar(), "testlogs/dropbox.log", "", "", "", 10, 8000, []parser.Parser{
+		MonitorLogLoop(context.Background(), logger.Sugar(), "testlogs/dropbox.log", "", "", "", 10, 8000, []parser.Parser{
 			dropboxParserWithFilters,
 			allLineParser,
-		}, handler, 100*time.Millisecond, true)
+		}, handler, nil, 100*time.Millisecond, true)
 	}(t)
 	// Wait until handler executes
 	common.WaitWithTimeout(t, &wg, 1*time.Second)
@@ -325,7 +328,7 @@ func TestDropboxLogExampleWithExcludes(t *testing.T) {
 		},
 	}
 	// create validation function
-	handler := func(log *zap.SugaredLogger, fileName, outputDir, apiKey, model string, entryToDiagnose parser.LogEntry, logContext []parser.LogEntry) error {
+	handler := func(log *zap.SugaredLogger, fileName, outputDir, model string, entryToDiagnose parser.LogEntry, logContext []parser.LogEntry) error {
 		defer wg.Done()
 		require.Equal(t, expectedEntry, entryToDiagnose)
 		require.Equal(t, expectedContext, logContext)
@@ -334,10 +337,10 @@ func TestDropboxLogExampleWithExcludes(t *testing.T) {
 	// Send process for a spin.
 	wg.Add(1)
 	go func(t *testing.T) {
-		MonitorLogLoop(logger.Sugar(), "testlogs/dropbox.log", "", "", "", 10, 8000, []parser.Parser{
+		MonitorLogLoop(context.Background(), logger.Sugar(), "testlogs/dropbox.log", "", "", "", 10, 8000, []parser.Parser{
 			dropboxParserWithExcludes,
 			allLineParser,
-		}, handler, 100*time.Millisecond, true)
+		}, handler, nil, 100*time.Millisecond, true)
 	}(t)
 	// Wait until handler executes
 	common.WaitWithTimeout(t, &wg, 1*time.Second)
@@ -435,7 +438,7 @@ func TestPhotosLogExampleMultipleMatchers(t *testing.T) {
 	// create validation function
 	// we expect the logs to produce two rounds of error diagnosis
 	round := 1
-	handler := func(log *zap.SugaredLogger, fileName, outputDir, apiKey, model string, entryToDiagnose parser.LogEntry, logContext []parser.LogEntry) error {
+	handler := func(log *zap.SugaredLogger, fileName, outputDir, model string, entryToDiagnose parser.LogEntry, logContext []parser.LogEntry) error {
 		defer wg.Done()
 		if round == 1 {
 			require.Equal(t, expectedEntry, entryToDiagnose)
@@ -450,11 +453,418 @@ func TestPhotosLogExampleMultipleMatchers(t *testing.T) {
 	// Send process for a spin.
 	wg.Add(2)
 	go func(t *testing.T) {
-		MonitorLogLoop(logger.Sugar(), "testlogs/photos.log", "", "", "", 10, 8000, []parser.Parser{
+		MonitorLogLoop(context.Background(), logger.Sugar(), "testlogs/photos.log", "", "", "", 10, 8000, []parser.Parser{
 			photosParser,
 			allLineParser,
-		}, handler, 100*time.Millisecond, true)
+		}, handler, nil, 100*time.Millisecond, true)
 	}(t)
 	// Wait until handler executes
 	common.WaitWithTimeout(t, &wg, 1*time.Second)
 }
+
+var threadParser, _ = parser.NewParserFromConfig(logger.Sugar(), config.ParserConfig{
+	Regex: "^(?P<TIMESTAMP>\\d{4}-\\d{2}-\\d{2} \\d{2}:\\d{2}:\\d{2},\\d{3}) (?P<LEVEL>[A-Z]+) \\[(?P<THREAD>[^\\]]+)\\] (?P<MESSAGE>.*)$",
+	Triggers: []config.VariableMatcher{
+		{
+			Variable: "LEVEL",
+			Regex:    "ERROR",
+		},
+	},
+	PartitionBy: "THREAD",
+}, nil)
+
+func TestPartitionedLogExample(t *testing.T) {
+	var wg sync.WaitGroup
+	expectedLines := []int{3, 5, 6, 7, 8}
+	handler := func(log *zap.SugaredLogger, fileName, outputDir, model string, entryToDiagnose parser.LogEntry, logContext []parser.LogEntry) error {
+		defer wg.Done()
+		require.Equal(t, 6, entryToDiagnose.LineNo)
+		require.Equal(t, "worker-2", entryToDiagnose.Variables["THREAD"])
+		var lines []int
+		for _, entry := range logContext {
+			lines = append(lines, entry.LineNo)
+		}
+		// Only lines from the same thread (and its stack trace) are part of the context
+		require.Equal(t, expectedLines, lines)
+		return nil
+	}
+	wg.Add(1)
+	go func(t *testing.T) {
+		MonitorLogLoop(context.Background(), logger.Sugar(), "testlogs/threads.log", "", "", "", 10, 8000, []parser.Parser{
+			threadParser,
+			allLineParser,
+		}, handler, nil, 100*time.Millisecond, true)
+	}(t)
+	common.WaitWithTimeout(t, &wg, 1*time.Second)
+}
+
+func TestInvalidPartitionVariable(t *testing.T) {
+	_, err := parser.NewParserFromConfig(logger.Sugar(), config.ParserConfig{
+		Regex:       "^(?P<MESSAGE>.*)$",
+		PartitionBy: "THREAD",
+	}, nil)
+	require.Error(t, err)
+}
+
+func TestPendingBundleIsFlushedOnStop(t *testing.T) {
+	var wg sync.WaitGroup
+	handler := func(log *zap.SugaredLogger, fileName, outputDir, model string, entryToDiagnose parser.LogEntry, logContext []parser.LogEntry) error {
+		defer wg.Done()
+		require.Equal(t, 2, entryToDiagnose.LineNo)
+		return nil
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	wg.Add(1)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		// The bundling timeout is way longer than the test timeout
+		MonitorLogLoop(ctx, logger.Sugar(), "testlogs/dropbox.log", "", "", "", 10, 8000, []parser.Parser{
+			dropboxParser,
+			allLineParser,
+		}, handler, nil, time.Hour, true)
+	}()
+	time.Sleep(100 * time.Millisecond)
+	cancel()
+	common.WaitWithTimeout(t, &wg, 1*time.Second)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Error("Monitor loop did not stop")
+	}
+}
+
+func TestAnalyze(t *testing.T) {
+	content, err := os.ReadFile("testlogs/dropbox.log")
+	require.NoError(t, err)
+	compressed := filepath.Join(t.TempDir(), "dropbox.log.gz")
+	var gz bytes.Buffer
+	writer := gzip.NewWriter(&gz)
+	_, err = writer.Write(content)
+	require.NoError(t, err)
+	require.NoError(t, writer.Close())
+	require.NoError(t, os.WriteFile(compressed, gz.Bytes(), 0644))
+
+	var mu sync.Mutex
+	var diagnosed []string
+	handler := func(log *zap.SugaredLogger, fileName, outputDir, model string, entryToDiagnose parser.LogEntry, logContext []parser.LogEntry) error {
+		mu.Lock()
+		defer mu.Unlock()
+		diagnosed = append(diagnosed, fileName)
+		return nil
+	}
+	parsers := []parser.Parser{
+		dropboxParser,
+		allLineParser,
+	}
+
+	// Bundling does not wait for the timeout at EOF
+	start := time.Now()
+	plain := Analyze(context.Background(), logger.Sugar(), []string{"testlogs/dropbox.log"}, "", "", 10, 8000, parsers, handler, time.Hour)
+	require.Less(t, time.Since(start), time.Second)
+	require.NotEmpty(t, plain.Errors)
+	require.Equal(t, 1, plain.ExitCode())
+
+	// Compressed files are analyzed just the same
+	diagnosed = nil
+	summary := Analyze(context.Background(), logger.Sugar(), []string{"testlogs/dropbox.log", compressed}, "", "", 10, 8000, parsers, handler, time.Hour)
+	require.Equal(t, 2, summary.Files)
+	require.Len(t, summary.Errors, 2*len(plain.Errors))
+	for i, location := range plain.Errors {
+		require.Equal(t, location, summary.Errors[i])
+		require.Equal(t, strings.Replace(location, "testlogs/dropbox.log", compressed, 1), summary.Errors[len(plain.Errors)+i])
+	}
+	require.Equal(t, compressed, diagnosed[len(diagnosed)-1])
+	require.Equal(t, 1, summary.ExitCode())
+
+	// Missing files make the analysis fail
+	summary = Analyze(context.Background(), logger.Sugar(), []string{"testlogs/missing.log"}, "", "", 10, 8000, parsers, handler, time.Hour)
+	require.Equal(t, 1, summary.FailedFiles)
+	require.Equal(t, 2, summary.ExitCode())
+
+	var out bytes.Buffer
+	summary.Print(&out)
+	require.Contains(t, out.String(), "Analyzed 1 log files (1 failed)")
+}
+
+func TestWaitForDiagnoses(t *testing.T) {
+	j, err := journal.Open(logger.Sugar(), t.TempDir())
+	require.NoError(t, err)
+	failing := func(ctx context.Context, log *zap.SugaredLogger, fileName, outputDir, model string, entryToDiagnose parser.LogEntry, logContext []parser.LogEntry) error {
+		if fileName == "down.log" {
+			return context.DeadlineExceeded
+		}
+		return nil
+	}
+	// Retries far in the future are given up on once the analysis times out
+	queue := diagnose.NewQueue(logger.Sugar(), j, failing, 1, 10)
+	queue.SetRetryIntervals(time.Hour, time.Hour)
+	require.NoError(t, queue.Start())
+	handler := queue.Handler()
+	require.NoError(t, handler(logger.Sugar(), "up.log", "", "", parser.LogEntry{Text: "ERROR: boom", LineNo: 1}, nil))
+	require.NoError(t, handler(logger.Sugar(), "down.log", "", "", parser.LogEntry{Text: "ERROR: boom", LineNo: 1}, nil))
+
+	start := time.Now()
+	require.Equal(t, 1, WaitForDiagnoses(context.Background(), logger.Sugar(), queue, 100*time.Millisecond, time.Second))
+	require.Less(t, time.Since(start), 2*time.Second)
+}
+
+func TestSourceVariables(t *testing.T) {
+	// Syslog header fields can be matched by any parser (when receiving syslog messages)
+	cfg := config.ParserConfig{
+		Regex: "^(?P<MESSAGE>.*)$",
+		Triggers: []config.VariableMatcher{
+			{
+				Variable: "SEVERITY",
+				Regex:    "^(emerg|alert|crit|err)$",
+			},
+		},
+	}
+	messageParser, err := parser.NewParserFromConfig(logger.Sugar(), cfg, sourceVariables(false, true, false, false))
+	require.NoError(t, err)
+	// Variables of log sources not in use are not
+	_, err = parser.NewParserFromConfig(logger.Sugar(), cfg, sourceVariables(true, false, true, true))
+	require.Error(t, err)
+	_, err = parser.NewParserFromConfig(logger.Sugar(), config.ParserConfig{
+		Regex:    "^(?P<MESSAGE>.*)$",
+		Triggers: []config.VariableMatcher{{Expression: `RECORD.level == "error"`}},
+	}, sourceVariables(true, true, true, false))
+	require.Error(t, err)
+
+	lines := make(chan tailer.Line, 2)
+	lines <- tailer.Line{Text: "link up", File: "router1", Position: tailer.Position{Line: 1}, Variables: map[string]string{"SEVERITY": "info", "HOSTNAME": "router1"}}
+	lines <- tailer.Line{Text: "link down", File: "router1", Position: tailer.Position{Line: 2}, Variables: map[string]string{"SEVERITY": "err", "HOSTNAME": "router1"}}
+	close(lines)
+
+	var diagnosed []string
+	handler := func(log *zap.SugaredLogger, fileName, outputDir, model string, entryToDiagnose parser.LogEntry, logContext []parser.LogEntry) error {
+		diagnosed = append(diagnosed, fileName+":"+entryToDiagnose.Text)
+		require.Equal(t, "router1", entryToDiagnose.Variables["HOSTNAME"])
+		require.Len(t, logContext, 2)
+		return nil
+	}
+	err = MonitorLines(context.Background(), logger.Sugar(), lines, "", "", 10, 8000, []parser.Parser{messageParser}, handler, nil, time.Hour, nil)
+	require.NoError(t, err)
+	require.Equal(t, []string{"router1:link down"}, diagnosed)
+}
+
+func TestTracePartitions(t *testing.T) {
+	// OTLP log records are partitioned by trace so that errors get the log context of their trace
+	traceParser, err := parser.NewParserFromConfig(logger.Sugar(), config.ParserConfig{
+		Regex: "^(?P<MESSAGE>.*)$",
+		Triggers: []config.VariableMatcher{
+			{
+				Variable: "SEVERITY_TEXT",
+				Regex:    "^ERROR$",
+			},
+		},
+		PartitionBy: "TRACE_ID",
+	}, sourceVariables(false, false, true, false))
+	require.NoError(t, err)
+
+	records := []struct{ text, severity, trace string }{
+		{"charging card", "INFO", "aaaa"},
+		{"listing products", "INFO", "bbbb"},
+		{"card declined", "ERROR", "aaaa"},
+		{"products listed", "INFO", "bbbb"},
+	}
+	lines := make(chan tailer.Line, len(records))
+	for i, r := range records {
+		lines <- tailer.Line{Text: r.text, File: "checkout", Position: tailer.Position{Line: i + 1}, Variables: map[string]string{"SEVERITY_TEXT": r.severity, "TRACE_ID": r.trace}}
+	}
+	close(lines)
+
+	var diagnosed []string
+	handler := func(log *zap.SugaredLogger, fileName, outputDir, model string, entryToDiagnose parser.LogEntry, logContext []parser.LogEntry) error {
+		diagnosed = append(diagnosed, fileName+":"+entryToDiagnose.Text)
+		require.Equal(t, "charging card\ncard declined\n", parser.Stringify(logContext))
+		return nil
+	}
+	err = MonitorLines(context.Background(), logger.Sugar(), lines, "", "", 10, 8000, []parser.Parser{traceParser}, handler, nil, time.Hour, nil)
+	require.NoError(t, err)
+	require.Equal(t, []string{"checkout:card declined"}, diagnosed)
+}
+
+func TestMultilineEntries(t *testing.T) {
+	// Stack traces are a single log entry whose first line is matched by the triggers
+	javaParser, err := parser.NewParserFromConfig(logger.Sugar(), config.ParserConfig{
+		Regex: `^(?P<LEVEL>[A-Z]+) (?P<MESSAGE>.*)$`,
+		Triggers: []config.VariableMatcher{
+			{
+				Variable: "LEVEL",
+				Regex:    "^ERROR$",
+			},
+		},
+		Multiline: &config.MultilineConfig{Continuation: `^(\s+at |Caused by: )`},
+	}, nil)
+	require.NoError(t, err)
+	defaultParser, err := parser.NewParser(logger.Sugar(), "^(?P<TEXT>.*)$", []config.VariableMatcher{}, []config.VariableMatcher{}, []config.VariableMatcher{})
+	require.NoError(t, err)
+
+	texts := []string{
+		"INFO handling request",
+		"ERROR request failed",
+		"\tat com.example.App.handle(App.java:42)",
+		"Caused by: java.io.IOException: broken pipe",
+		"\tat com.example.Db.query(Db.java:7)",
+		"INFO next request",
+	}
+	lines := make(chan tailer.Line, len(texts))
+	for i, text := range texts {
+		lines <- tailer.Line{Text: text, File: "app.log", Position: tailer.Position{Line: i + 1}}
+	}
+	close(lines)
+
+	var diagnosed []parser.LogEntry
+	var diagnosedContext []parser.LogEntry
+	handler := func(log *zap.SugaredLogger, fileName, outputDir, model string, entryToDiagnose parser.LogEntry, logContext []parser.LogEntry) error {
+		diagnosed = append(diagnosed, entryToDiagnose)
+		diagnosedContext = logContext
+		return nil
+	}
+	err = MonitorLines(context.Background(), logger.Sugar(), lines, "", "", 10, 8000, []parser.Parser{javaParser, defaultParser}, handler, nil, time.Hour, nil)
+	require.NoError(t, err)
+	require.Len(t, diagnosed, 1)
+	require.Equal(t, strings.Join(texts[1:5], "\n"), diagnosed[0].Text)
+	// Located at its first line
+	require.Equal(t, 2, diagnosed[0].LineNo)
+	require.Equal(t, "request failed", diagnosed[0].Variables["MESSAGE"])
+	require.Len(t, diagnosedContext, 2)
+}
+
+func TestRateTriggers(t *testing.T) {
+	// Timeouts only diagnose once a service logs 3 of them within a minute (of log time)
+	rateParser, err := parser.NewParserFromConfig(logger.Sugar(), config.ParserConfig{
+		Regex: `^(?P<TIME>\S+) (?P<LEVEL>[A-Z]+) (?P<SERVICE>\S+) (?P<MESSAGE>.*)$`,
+		Types: map[string]config.TypeConfig{"TIME": {Type: "timestamp"}},
+		Triggers: []config.VariableMatcher{
+			{
+				Variable: "MESSAGE",
+				Regex:    "timeout",
+			},
+		},
+		Rate: &config.RateConfig{Threshold: 3, Window: time.Minute, GroupBy: "SERVICE"},
+	}, nil)
+	require.NoError(t, err)
+	defaultParser, err := parser.NewParser(logger.Sugar(), "^(?P<TEXT>.*)$", []config.VariableMatcher{}, []config.VariableMatcher{}, []config.VariableMatcher{})
+	require.NoError(t, err)
+
+	texts := []string{
+		"2023-07-22T10:00:00Z ERROR billing timeout",
+		"2023-07-22T10:00:10Z ERROR billing timeout",
+		"2023-07-22T10:00:20Z ERROR cart timeout",
+		"2023-07-22T10:00:30Z INFO billing retrying",
+		"2023-07-22T10:00:40Z ERROR billing timeout",
+		"2023-07-22T10:00:45Z ERROR billing timeout",
+		"2023-07-22T10:05:00Z ERROR billing timeout",
+		"2023-07-22T10:05:10Z ERROR cart timeout",
+	}
+	lines := make(chan tailer.Line, len(texts))
+	for i, text := range texts {
+		lines <- tailer.Line{Text: text, File: "app.log", Position: tailer.Position{Line: i + 1}}
+	}
+	close(lines)
+
+	var diagnosed []parser.LogEntry
+	var diagnosedContext []parser.LogEntry
+	handler := func(log *zap.SugaredLogger, fileName, outputDir, model string, entryToDiagnose parser.LogEntry, logContext []parser.LogEntry) error {
+		diagnosed = append(diagnosed, entryToDiagnose)
+		diagnosedContext = logContext
+		return nil
+	}
+	err = MonitorLines(context.Background(), logger.Sugar(), lines, "", "", 10, 8000, []parser.Parser{rateParser, defaultParser}, handler, nil, time.Hour, nil)
+	require.NoError(t, err)
+	// A single diagnosis when the threshold is crossed (not on the following matches)
+	require.Len(t, diagnosed, 1)
+	require.Equal(t, 5, diagnosed[0].LineNo)
+	require.Equal(t, "RATE TRIGGER: 3 matching log entries within 1m0s (threshold: 3) for SERVICE (billing)", diagnosedContext[0].Text)
+	require.Equal(t, "MATCHING LOG ENTRIES:", diagnosedContext[1].Text)
+	require.Equal(t, texts[0], diagnosedContext[2].Text)
+	require.Equal(t, texts[1], diagnosedContext[3].Text)
+	require.Equal(t, texts[4], diagnosedContext[4].Text)
+	require.Equal(t, "LOG CONTEXT:", diagnosedContext[5].Text)
+	// The rest of the log context (the matching entries are not repeated)
+	require.Equal(t, texts[2], diagnosedContext[6].Text)
+	require.Equal(t, texts[3], diagnosedContext[7].Text)
+	require.Len(t, diagnosedContext, 6+2)
+	// Invalid configurations
+	for _, cfg := range []config.ParserConfig{
+		{Regex: `^(?P<LEVEL>\S+)$`, Rate: &config.RateConfig{Threshold: 3, Window: time.Minute}},
+		{Regex: `^(?P<LEVEL>\S+)$`, Triggers: []config.VariableMatcher{{Variable: "LEVEL", Regex: "ERROR"}}, Rate: &config.RateConfig{Window: time.Minute}},
+		{Regex: `^(?P<LEVEL>\S+)$`, Triggers: []config.VariableMatcher{{Variable: "LEVEL", Regex: "ERROR"}}, Rate: &config.RateConfig{Threshold: 3}},
+		{Regex: `^(?P<LEVEL>\S+)$`, Triggers: []config.VariableMatcher{{Variable: "LEVEL", Regex: "ERROR"}}, Rate: &config.RateConfig{Threshold: 3, Window: time.Minute, GroupBy: "SERVICE"}},
+	} {
+		_, err := parser.NewParserFromConfig(logger.Sugar(), cfg, nil)
+		require.Error(t, err, "config: %+v", cfg)
+	}
+}
+
+func TestHeartbeats(t *testing.T) {
+	// The job is expected to log a processed batch at least every 2 minutes (of log time)
+	jobParser, err := parser.NewParserFromConfig(logger.Sugar(), config.ParserConfig{
+		Regex: `^(?P<TIME>\S+) (?P<LEVEL>[A-Z]+) (?P<MESSAGE>.*)$`,
+		Types: map[string]config.TypeConfig{"TIME": {Type: "timestamp"}},
+		Heartbeats: []config.HeartbeatConfig{
+			{
+				Matcher:  config.VariableMatcher{Variable: "MESSAGE", Regex: "processed batch"},
+				Interval: 2 * time.Minute,
+				Lines:    3,
+			},
+		},
+	}, nil)
+	require.NoError(t, err)
+	defaultParser, err := parser.NewParser(logger.Sugar(), "^(?P<TEXT>.*)$", []config.VariableMatcher{}, []config.VariableMatcher{}, []config.VariableMatcher{})
+	require.NoError(t, err)
+
+	texts := []string{
+		"2023-07-22T10:00:00Z INFO processed batch",
+		"2023-07-22T10:01:00Z INFO processed batch",
+		"2023-07-22T10:02:00Z INFO waiting for queue",
+		"2023-07-22T10:04:00Z INFO waiting for queue",
+		"2023-07-22T10:05:00Z INFO waiting for queue",
+		"2023-07-22T10:06:00Z INFO processed batch",
+		"2023-07-22T10:07:00Z INFO waiting for queue",
+	}
+	lines := make(chan tailer.Line, len(texts))
+	for i, text := range texts {
+		lines <- tailer.Line{Text: text, File: "job.log", Position: tailer.Position{Line: i + 1}}
+	}
+	close(lines)
+
+	var diagnosed []parser.LogEntry
+	var diagnosedContext []parser.LogEntry
+	var diagnosedFile string
+	handler := func(log *zap.SugaredLogger, fileName, outputDir, model string, entryToDiagnose parser.LogEntry, logContext []parser.LogEntry) error {
+		diagnosed = append(diagnosed, entryToDiagnose)
+		diagnosedContext = logContext
+		diagnosedFile = fileName
+		return nil
+	}
+	parsers := []parser.Parser{jobParser, defaultParser}
+	heartbeats, err := NewHeartbeats(logger.Sugar(), parsers, "", 8000)
+	require.NoError(t, err)
+	err = MonitorLines(context.Background(), logger.Sugar(), lines, "", "", 10, 8000, parsers, handler, heartbeats, time.Hour, nil)
+	require.NoError(t, err)
+	// A single diagnosis per silence, with its duration and the last lines
+	// It is named after the log source (not after a log line, it would collide with trigger diagnoses)
+	require.Len(t, diagnosed, 1)
+	require.Equal(t, "job.log:heartbeat-1-20230722T100400Z", diagnosedFile)
+	require.Equal(t, 0, diagnosed[0].LineNo)
+	require.Equal(t, `ABSENCE TRIGGER: no log entry matching (MESSAGE =~ "processed batch") for 3m0s (interval: 2m0s)`, diagnosed[0].Text)
+	require.Equal(t, diagnosed[0].Text, diagnosedContext[0].Text)
+	require.Equal(t, "LAST LOG ENTRIES (last match at 2023-07-22T10:01:00Z):", diagnosedContext[1].Text)
+	require.Len(t, diagnosedContext, 2+3)
+	require.Equal(t, texts[1], diagnosedContext[2].Text)
+	require.Equal(t, texts[3], diagnosedContext[4].Text)
+
+	// Invalid configurations
+	for _, cfg := range []config.ParserConfig{
+		{Regex: `^(?P<MESSAGE>.*)$`, Heartbeats: []config.HeartbeatConfig{{Matcher: config.VariableMatcher{Variable: "MESSAGE", Regex: "batch"}}}},
+		{Regex: `^(?P<MESSAGE>.*)$`, Heartbeats: []config.HeartbeatConfig{{Matcher: config.VariableMatcher{Variable: "TEXT", Regex: "batch"}, Interval: time.Minute}}},
+		{Regex: `^(?P<MESSAGE>.*)$`, Heartbeats: []config.HeartbeatConfig{{Matcher: config.VariableMatcher{Expression: "MESSAGE =~"}, Interval: time.Minute}}},
+		{Regex: `^(?P<MESSAGE>.*)$`, Heartbeats: []config.HeartbeatConfig{{Matcher: config.VariableMatcher{Variable: "MESSAGE", Regex: "batch"}, Interval: time.Minute, Lines: -1}}},
+	} {
+		_, err := parser.NewParserFromConfig(logger.Sugar(), cfg, nil)
+		require.Error(t, err, "config: %+v", cfg)
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"go.uber.org/zap"
 
 	"github.com/ingyamilmolinar/doctorgpt/agent/internal/parser"
+	"github.com/ingyamilmolinar/doctorgpt/agent/internal/tokenizer"
 )
 
 type LogBuffer struct {
@@ -13,10 +14,11 @@ type LogBuffer struct {
 	pointer   int
 	capacity  int
 	buffer    []parser.LogEntry
+	count     tokenizer.Counter
 	logger    *zap.SugaredLogger
 }
 
-func NewLogBuffer(log *zap.SugaredLogger, size, maxTokens int) *LogBuffer {
+func NewLogBuffer(log *zap.SugaredLogger, size, maxTokens int, count tokenizer.Counter) *LogBuffer {
 	log.Debugf("Initializing ring buffer of size %d and max tokens %d", size, maxTokens)
 	return &LogBuffer{
 		size:      size,
@@ -24,6 +26,7 @@ func NewLogBuffer(log *zap.SugaredLogger, size, maxTokens int) *LogBuffer {
 		pointer:   0,
 		capacity:  0,
 		buffer:    make([]parser.LogEntry, size, size),
+		count:     count,
 		logger:    log,
 	}
 }
@@ -46,18 +49,18 @@ func (lb LogBuffer) Dump() []parser.LogEntry {
 	if lb.capacity > lb.size {
 		// loop around entire slice from here
 		composeSlice := append(lb.buffer[lb.pointer:], lb.buffer[0:lb.pointer]...)
-		trimmedSlice := trimSlice(lb.logger, composeSlice, lb.maxTokens)
+		trimmedSlice := trimSlice(lb.logger, composeSlice, lb.maxTokens, lb.count)
 		lb.logger.Debugf("Dump (Max capacity): %s", parser.Stringify(trimmedSlice))
 		return trimmedSlice
 	}
 	// TODO: Avoid special case
 	if lb.pointer == 0 && lb.capacity > 0 {
 		// Buffer is full and pointer wrapped around
-		trimmedSlice := trimSlice(lb.logger, lb.buffer, lb.maxTokens)
+		trimmedSlice := trimSlice(lb.logger, lb.buffer, lb.maxTokens, lb.count)
 		lb.logger.Debugf("Dump: %s", parser.Stringify(trimmedSlice))
 		return trimmedSlice
 	}
-	trimmedSlice := trimSlice(lb.logger, lb.buffer[0:lb.pointer], lb.maxTokens)
+	trimmedSlice := trimSlice(lb.logger, lb.buffer[0:lb.pointer], lb.maxTokens, lb.count)
 	lb.logger.Debugf("Dump: %s", parser.Stringify(trimmedSlice))
 	return trimmedSlice
 }
@@ -72,13 +75,19 @@ func (lb LogBuffer) String() string {
 	return fmt.Sprintf("%v", lb.Dump())
 }
 
-func trimSlice(log *zap.SugaredLogger, entries []parser.LogEntry, maxTokens int) []parser.LogEntry {
+// Trim keeps the most recent entries fitting in maxTokens
+func Trim(log *zap.SugaredLogger, entries []parser.LogEntry, maxTokens int, count tokenizer.Counter) []parser.LogEntry {
+	return trimSlice(log, entries, maxTokens, count)
+}
+
+func trimSlice(log *zap.SugaredLogger, entries []parser.LogEntry, maxTokens int, count tokenizer.Counter) []parser.LogEntry {
 	tokens := 0
 	// Go from most recent logs into oldest logs
 	var i int
 	for i = len(entries) - 1; i >= 0; i-- {
 		logEntry := entries[i]
-		tokens += getTokens(logEntry.Text)
+		// Entries are sent separated by new lines (see parser.Stringify)
+		tokens += count(logEntry.Text + "\n")
 		if tokens > maxTokens {
 			// Ignore the rest of the older entries
 			log.Debugf("Skipping oldest lines including: (%s)", logEntry.Text)
@@ -89,8 +98,3 @@ func trimSlice(log *zap.SugaredLogger, entries []parser.LogEntry, maxTokens int)
 	}
 	return entries[i+1:]
 }
-
-// https://help.openai.com/en/articles/4936856-what-are-tokens-and-how-to-count-them
-func getTokens(s string) int {
-	return len(s) / 4
-}
@@ -3,8 +3,10 @@ package buffer
 import (
 	"github.com/stretchr/testify/require"
 	"testing"
+	"time"
 
 	"github.com/ingyamilmolinar/doctorgpt/agent/internal/parser"
+	"github.com/ingyamilmolinar/doctorgpt/agent/internal/tokenizer"
 	"go.uber.org/zap"
 )
 
@@ -12,7 +14,7 @@ var logger, _ = zap.NewDevelopment()
 
 func TestBuffer(t *testing.T) {
 	// Dump() will only return the latest 30 characters
-	buffer := NewLogBuffer(logger.Sugar(), 3, 30/4)
+	buffer := NewLogBuffer(logger.Sugar(), 3, 30/4, tokenizer.Approximate)
 	entry1 := parser.LogEntry{
 		Text:   "0123456789", // 10 chars
 		LineNo: 1,
@@ -71,3 +73,43 @@ func TestBuffer(t *testing.T) {
 	require.Equal(t, 0, buffer.pointer)
 	require.Equal(t, 0, buffer.capacity)
 }
+
+func TestPartitions(t *testing.T) {
+	partitions := NewPartitions(logger.Sugar(), 3, 100, tokenizer.Approximate)
+	now := time.Now()
+	entry1 := parser.LogEntry{
+		Text:   "thread 1",
+		LineNo: 1,
+	}
+	entry2 := parser.LogEntry{
+		Text:   "thread 2",
+		LineNo: 2,
+	}
+	partitions.Get("THREAD=1", time.Minute, now).Append(entry1)
+	partitions.Get("THREAD=2", 2*time.Minute, now).Append(entry2)
+	partitions.Get(DefaultPartition, 0, now)
+	require.Equal(t, 3, partitions.Len())
+	require.Equal(t, []parser.LogEntry{entry1}, partitions.Get("THREAD=1", time.Minute, now).Dump())
+	require.Equal(t, []parser.LogEntry{entry2}, partitions.Get("THREAD=2", 2*time.Minute, now).Dump())
+
+	// Only the first partition is idle for longer than its TTL
+	require.Equal(t, 1, partitions.Evict(now.Add(90*time.Second)))
+	require.Equal(t, 2, partitions.Len())
+
+	// Partitions without TTL are never evicted
+	require.Equal(t, 1, partitions.Evict(now.Add(time.Hour)))
+	require.Equal(t, 1, partitions.Len())
+	require.Empty(t, partitions.Get("THREAD=1", time.Minute, now).Dump())
+
+	// Continuation lines (default parser, no TTL) appended last do not keep the partition forever
+	continuation := parser.LogEntry{
+		Text:   "\tat Main.main(Main.java:1)",
+		LineNo: 3,
+	}
+	partitions.Get("THREAD=3", time.Minute, now).Append(entry1)
+	partitions.Get("THREAD=3", 0, now.Add(time.Minute)).Append(continuation)
+	require.Equal(t, 1, partitions.Evict(now.Add(90*time.Second)))
+	require.Equal(t, 2, partitions.Len())
+	require.Equal(t, 1, partitions.Evict(now.Add(3*time.Minute)))
+	require.Equal(t, 1, partitions.Len())
+}
@@ -0,0 +1,75 @@
+package buffer
+
+import (
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/ingyamilmolinar/doctorgpt/agent/internal/tokenizer"
+)
+
+// Key of the partition used when log entries are not partitioned
+const DefaultPartition = "DEFAULT"
+
+type partition struct {
+	buffer   *LogBuffer
+	lastSeen time.Time
+	ttl      time.Duration
+}
+
+// Partitions holds one LogBuffer per partition key (thread, request ID, ...)
+type Partitions struct {
+	size       int
+	maxTokens  int
+	count      tokenizer.Counter
+	partitions map[string]*partition
+	logger     *zap.SugaredLogger
+}
+
+func NewPartitions(log *zap.SugaredLogger, size, maxTokens int, count tokenizer.Counter) *Partitions {
+	return &Partitions{
+		size:       size,
+		maxTokens:  maxTokens,
+		count:      count,
+		partitions: make(map[string]*partition),
+		logger:     log,
+	}
+}
+
+// Get returns the buffer for the given key (creating it if necessary) and marks it as seen.
+// The partition keeps the largest ttl it was given (a zero ttl, e.g. from continuation lines
+// matched by the default parser, does not prevent it from being evicted). Partitions only
+// ever given a zero ttl are never evicted.
+func (p *Partitions) Get(key string, ttl time.Duration, now time.Time) *LogBuffer {
+	part, ok := p.partitions[key]
+	if !ok {
+		p.logger.Debugf("Creating buffer for partition (%s)", key)
+		part = &partition{
+			buffer: NewLogBuffer(p.logger, p.size, p.maxTokens, p.count),
+		}
+		p.partitions[key] = part
+	}
+	part.lastSeen = now
+	if ttl > part.ttl {
+		part.ttl = ttl
+	}
+	return part.buffer
+}
+
+// Evict drops every partition that has been idle for longer than its ttl
+func (p *Partitions) Evict(now time.Time) int {
+	evicted := 0
+	for key, part := range p.partitions {
+		if part.ttl == 0 || now.Sub(part.lastSeen) <= part.ttl {
+			continue
+		}
+		p.logger.Debugf("Evicting idle partition (%s)", key)
+		delete(p.partitions, key)
+		evicted++
+	}
+	return evicted
+}
+
+func (p *Partitions) Len() int {
+	return len(p.partitions)
+}
@@ -0,0 +1,50 @@
+package clock
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock tells the time of a log source: the time of its latest log entry (when log entries
+// have a timestamp) plus the time elapsed since it arrived, or the current time otherwise.
+// It lets archived logs be handled as if they were being written. It is safe for concurrent
+// use (e.g. heartbeats shared by every log source read the clock of each one).
+type Clock struct {
+	mu      sync.Mutex
+	logTime time.Time
+	arrival time.Time
+	now     func() time.Time
+}
+
+func New() *Clock {
+	return &Clock{now: time.Now}
+}
+
+// Observe moves the clock to the time of a log entry (zero if unknown).
+// Log entries older than the latest one do not move the clock back.
+func (c *Clock) Observe(t time.Time) {
+	if t.IsZero() {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.logTime.IsZero() && !t.After(c.current()) {
+		return
+	}
+	c.logTime = t
+	c.arrival = c.now()
+}
+
+// Now is the current time of the log source
+func (c *Clock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.current()
+}
+
+func (c *Clock) current() time.Time {
+	if c.logTime.IsZero() {
+		return c.now()
+	}
+	return c.logTime.Add(c.now().Sub(c.arrival))
+}
@@ -0,0 +1,31 @@
+package clock
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestClock(t *testing.T) {
+	wall := time.Date(2023, 7, 22, 12, 0, 0, 0, time.UTC)
+	c := &Clock{now: func() time.Time { return wall }}
+	require.Equal(t, wall, c.Now())
+
+	// Log entries without a timestamp keep the current time
+	c.Observe(time.Time{})
+	require.Equal(t, wall, c.Now())
+
+	// The log time moves on with the wall clock between log entries
+	logTime := time.Date(2020, 1, 1, 8, 0, 0, 0, time.UTC)
+	c.Observe(logTime)
+	require.Equal(t, logTime, c.Now())
+	wall = wall.Add(time.Minute)
+	require.Equal(t, logTime.Add(time.Minute), c.Now())
+
+	// Out of order log entries do not move it back
+	c.Observe(logTime.Add(30 * time.Second))
+	require.Equal(t, logTime.Add(time.Minute), c.Now())
+	c.Observe(logTime.Add(time.Hour))
+	require.Equal(t, logTime.Add(time.Hour), c.Now())
+}
@@ -5,6 +5,7 @@ import (
 	"go.uber.org/zap"
 	"gopkg.in/yaml.v3"
 	"os"
+	"time"
 )
 
 // TODO: Make error placeholder configurable
@@ -15,29 +16,122 @@ var SystemPrompt = "You are ErrorDebuggingGPT. Your sole purpose in this world i
 
 var UserPrompt = "The message following the first line containing \"ERROR:\" up until the end of the prompt is a computer error no more and no less. It is your job to try to diagnose and fix what went wrong. Ready?\nERROR:\n" + ErrorPlaceholder
 
-type config struct {
+type Config struct {
 	SystemPrompt string         `yaml:"systemPrompt,omitempty"`
 	Prompt       string         `yaml:"prompt,omitempty"`
-	Parsers      []parserConfig `yaml:"parsers"`
+	Provider     ProviderConfig `yaml:"provider,omitempty"`
+	Parsers      []ParserConfig `yaml:"parsers"`
 }
 
-type parserConfig struct {
-	Regex    string            `yaml:"regex"`
+// LLM provider used for diagnosis
+type ProviderConfig struct {
+	// Provider name: "openai" (default), "azure" or "ollama"
+	Name string `yaml:"name,omitempty"`
+	// Base URL of the provider API (e.g. "http://localhost:11434" for ollama or any OpenAI compatible server)
+	URL string `yaml:"url,omitempty"`
+	// OpenAI organization
+	Organization string `yaml:"organization,omitempty"`
+	// Extra HTTP headers sent on every request
+	Headers map[string]string `yaml:"headers,omitempty"`
+	// HTTP(S) proxy URL
+	Proxy string `yaml:"proxy,omitempty"`
+	// Path to a PEM file with extra CA certificates to trust
+	CABundle string `yaml:"caBundle,omitempty"`
+	// Azure OpenAI API version (e.g. "2023-05-15")
+	APIVersion string `yaml:"apiVersion,omitempty"`
+	// Azure OpenAI deployment name
+	Deployment string `yaml:"deployment,omitempty"`
+}
+
+type ParserConfig struct {
+	// Parser kind: "regex" (default), "json" or "logfmt"
+	Kind     string            `yaml:"kind,omitempty"`
+	Regex    string            `yaml:"regex,omitempty"`
 	Triggers []VariableMatcher `yaml:"triggers,omitempty"`
 	Filters  []VariableMatcher `yaml:"filters,omitempty"`
 	Excludes []VariableMatcher `yaml:"excludes,omitempty"`
+	// Variable whose values split the log context into separate buffers (e.g. THREAD)
+	PartitionBy string `yaml:"partitionBy,omitempty"`
+	// Idle time after which a partition buffer is dropped (e.g. "10m")
+	PartitionTTL time.Duration `yaml:"partitionTTL,omitempty"`
+	// Lines joined into a single log entry (e.g. stack traces)
+	Multiline *MultilineConfig `yaml:"multiline,omitempty"`
+	// Types of the variables compared by matchers (variables are strings unless declared here)
+	Types map[string]TypeConfig `yaml:"types,omitempty"`
+	// Triggers diagnose once they match many log entries within a time window (instead of on every match)
+	Rate *RateConfig `yaml:"rate,omitempty"`
+	// Diagnose when expected log entries stop arriving (e.g. a job no longer logging "processed batch")
+	Heartbeats []HeartbeatConfig `yaml:"heartbeats,omitempty"`
+}
+
+// Heartbeats fire once per silence of the log entries they match
+type HeartbeatConfig struct {
+	// Log entries (of this parser) expected regularly
+	Matcher VariableMatcher `yaml:"matcher"`
+	// Longest silence allowed (e.g. "5m")
+	Interval time.Duration `yaml:"interval"`
+	// Last log lines before the silence sent along with the diagnosis (default: 50)
+	Lines int `yaml:"lines,omitempty"`
+	// Glob of the log sources (file paths or network source names) expected to log the entries (default: any)
+	Source string `yaml:"source,omitempty"`
+}
+
+// Rate triggers fire once per burst of matching log entries
+type RateConfig struct {
+	// Matching log entries within the window needed to trigger a diagnosis (e.g. 50)
+	Threshold int `yaml:"threshold"`
+	// Sliding time window (e.g. "1m")
+	Window time.Duration `yaml:"window"`
+	// Variable whose values are counted separately (e.g. SERVICE)
+	GroupBy string `yaml:"groupBy,omitempty"`
+}
+
+type TypeConfig struct {
+	// "string" (default), "int", "float", "duration" (e.g. "1.5s") or "timestamp"
+	Type string `yaml:"type"`
+	// Timestamp layout in Go format (default: RFC 3339), "unix" (seconds) or "unixms" (milliseconds)
+	Layout string `yaml:"layout,omitempty"`
+}
+
+// Multi-line log entries start with a line matched by the parser and go on with the
+// lines that follow it (until one of them starts a new log entry)
+type MultilineConfig struct {
+	// Regex the first line must match (any line matched by the parser if empty)
+	Start string `yaml:"start,omitempty"`
+	// Regex the following lines must match (any line not matching the start if empty)
+	Continuation string `yaml:"continuation,omitempty"`
+	// Max lines per log entry (default: 500)
+	MaxLines int `yaml:"maxLines,omitempty"`
+	// Time to wait for the next line before the log entry is considered complete (default: "1s")
+	FlushTimeout time.Duration `yaml:"flushTimeout,omitempty"`
 }
 
 type VariableMatcher struct {
-	Variable string `yaml:"variable"`
-	Regex    string `yaml:"regex"`
+	Variable string `yaml:"variable,omitempty"`
+	Regex    string `yaml:"regex,omitempty"`
+	// Comparison with a typed variable instead of a regex (e.g. ">= 500", "!= 0.5",
+	// "> 2s" or, for timestamps, "older than 5m" and "newer than 1h")
+	Compare string `yaml:"compare,omitempty"`
+	// Boolean expression across variables instead of a single variable
+	// (e.g. `LEVEL =~ "ERROR" && !(MESSAGE =~ "HTTP 401")`)
+	Expression string `yaml:"expression,omitempty"`
+}
+
+// UnmarshalYAML accepts an expression as a plain string too
+func (m *VariableMatcher) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		m.Expression = node.Value
+		return nil
+	}
+	type plain VariableMatcher
+	return node.Decode((*plain)(m))
 }
 
-type ConfigProvider func(log *zap.SugaredLogger, configFile string) (config, error)
+type ConfigProvider func(log *zap.SugaredLogger, configFile string) (Config, error)
 
-func FileConfigProvider(log *zap.SugaredLogger, configFile string) (config, error) {
+func FileConfigProvider(log *zap.SugaredLogger, configFile string) (Config, error) {
 	// Read configuration
-	var config config
+	var config Config
 	bytes, err := readBytes(configFile)
 	if err != nil {
 		return config, fmt.Errorf("Failed to open config file: %w", err)
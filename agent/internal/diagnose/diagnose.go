@@ -3,109 +3,96 @@ package diagnose
 import (
 	"context"
 	"fmt"
-	"github.com/cenkalti/backoff/v4"
-	openai "github.com/sashabaranov/go-openai"
 	"go.uber.org/zap"
 	"os"
-	"path/filepath"
 	"strconv"
 	"strings"
-	"time"
 
 	"github.com/ingyamilmolinar/doctorgpt/agent/internal/config"
 	"github.com/ingyamilmolinar/doctorgpt/agent/internal/parser"
 )
 
-type Handler func(log *zap.SugaredLogger, fileName, outputDir, apiKey, model string, entryToDiagnose parser.LogEntry, logContext []parser.LogEntry) error
+type Handler func(log *zap.SugaredLogger, fileName, outputDir, model string, entryToDiagnose parser.LogEntry, logContext []parser.LogEntry) error
 
-func HandleTrigger(log *zap.SugaredLogger, fileName, outputDir, apiKey, model string, entryToDiagnose parser.LogEntry, logContext []parser.LogEntry) error {
-	err := backoff.Retry(func() error {
-		// create file and write to it
-		errorLocation := fileName + ":" + strconv.Itoa(entryToDiagnose.LineNo)
-		filename := outputDir + "/" + safeString(errorLocation) + ".diagnosing"
-		f, err := os.Create(filename)
-		if err != nil {
-			return fmt.Errorf("error creating diagnosis file: %w", err)
-		}
-		log.Infof("Log Line: %s", errorLocation)
-		_, err = f.WriteString(fmt.Sprintf("LOG LINE:\n%s\n\n", errorLocation))
-		if err != nil {
-			return fmt.Errorf("error writing to diagnosis file: %w", err)
-		}
-		// TODO: Add log line message in diagnosis file
-		log.Infof("System Prompt: %s", config.SystemPrompt)
-		log.Infof("Prompt: %s", config.UserPrompt)
-		_, err = f.WriteString(fmt.Sprintf("SYSTEM PROMPT:\n%s\n\nPROMPT:\n%s\n\n", config.SystemPrompt, config.UserPrompt))
-		if err != nil {
-			return fmt.Errorf("error writing to diagnosis file: %w", err)
-		}
+// Diagnoser diagnoses an error (calls are aborted once ctx is done)
+type Diagnoser func(ctx context.Context, log *zap.SugaredLogger, fileName, outputDir, model string, entryToDiagnose parser.LogEntry, logContext []parser.LogEntry) error
 
-		context := parser.Stringify(logContext)
-		log.Infof("Context: %s", context)
-		_, err = f.WriteString(fmt.Sprintf("CONTEXT:\n%s\n\n", context))
-		if err != nil {
-			return fmt.Errorf("error writing to diagnosis file: %w", err)
-		}
-		suggestion, err := suggestion(model, apiKey, config.SystemPrompt, config.UserPrompt, context)
-		if err != nil {
-			return fmt.Errorf("error diagnosing using the openai API: %w", err)
-		}
-		log.Infof("Diagnosis: %s", suggestion)
-		_, err = f.WriteString(fmt.Sprintf("DIAGNOSIS:\n%s\n", suggestion))
-		if err != nil {
-			return fmt.Errorf("error writing to diagnosis file: %w", err)
-		}
-		err = f.Close()
-		if err != nil {
-			return fmt.Errorf("error closing the diagnosis file: %w", err)
-		}
-		fullNameNoExt := strings.TrimRight(filename, ".diagnosing")
-		err = os.Rename(filename, fullNameNoExt+".diagnosed")
-		if err != nil {
-			return fmt.Errorf("error renaming the diagnosis file: %w", err)
-		}
-		return nil
-	}, backoff.WithMaxRetries(backoff.NewConstantBackOff(2*time.Second), 3))
-	if err != nil {
-		log.Errorf("Failed to diagnose after retries: %v", err)
+// NewDiagnoser returns a Diagnoser using the given LLM provider
+func NewDiagnoser(provider Provider) Diagnoser {
+	return func(ctx context.Context, log *zap.SugaredLogger, fileName, outputDir, model string, entryToDiagnose parser.LogEntry, logContext []parser.LogEntry) error {
+		return HandleTrigger(ctx, log, provider, fileName, outputDir, model, entryToDiagnose, logContext)
 	}
-	return err
 }
 
-func suggestion(model, key, systemPrompt, userPrompt, errorMsg string) (string, error) {
-	prompt := strings.Replace(userPrompt, config.ErrorPlaceholder, errorMsg, 1)
-	client := openai.NewClient(key)
-	resp, err := client.CreateChatCompletion(
-		context.Background(),
-		openai.ChatCompletionRequest{
-			Model: model,
-			Messages: []openai.ChatCompletionMessage{
-				{
-					Role:    openai.ChatMessageRoleSystem,
-					Content: config.SystemPrompt,
-				},
-				{
-					Role:    openai.ChatMessageRoleUser,
-					Content: prompt,
-				},
-			},
-		},
-	)
+// HandleTrigger diagnoses the error once (retries are up to the Queue)
+func HandleTrigger(ctx context.Context, log *zap.SugaredLogger, provider Provider, fileName, outputDir, model string, entryToDiagnose parser.LogEntry, logContext []parser.LogEntry) error {
+	// create file and write to it
+	// Entries not located at a log line (e.g. heartbeat silences) are named after fileName alone
+	errorLocation := fileName
+	if entryToDiagnose.LineNo > 0 {
+		errorLocation += ":" + strconv.Itoa(entryToDiagnose.LineNo)
+	}
+	filename := outputDir + "/" + safeString(errorLocation) + ".diagnosing"
+	f, err := os.Create(filename)
+	if err != nil {
+		return fmt.Errorf("error creating diagnosis file: %w", err)
+	}
+	defer f.Close()
+	log.Infof("Log Line: %s", errorLocation)
+	_, err = f.WriteString(fmt.Sprintf("LOG LINE:\n%s\n\n", errorLocation))
+	if err != nil {
+		return fmt.Errorf("error writing to diagnosis file: %w", err)
+	}
+	// TODO: Add log line message in diagnosis file
+	log.Infof("System Prompt: %s", config.SystemPrompt)
+	log.Infof("Prompt: %s", config.UserPrompt)
+	_, err = f.WriteString(fmt.Sprintf("SYSTEM PROMPT:\n%s\n\nPROMPT:\n%s\n\n", config.SystemPrompt, config.UserPrompt))
+	if err != nil {
+		return fmt.Errorf("error writing to diagnosis file: %w", err)
+	}
+
+	logContextText := parser.Stringify(logContext)
+	log.Infof("Context: %s", logContextText)
+	_, err = f.WriteString(fmt.Sprintf("CONTEXT:\n%s\n\n", logContextText))
 	if err != nil {
-		return "", fmt.Errorf("error generating text from API: %v", err)
+		return fmt.Errorf("error writing to diagnosis file: %w", err)
 	}
-	if len(resp.Choices) == 0 {
-		return "", fmt.Errorf("chatGPT returned no choices")
+	suggestion, err := suggestion(ctx, provider, model, config.SystemPrompt, config.UserPrompt, logContextText)
+	if err != nil {
+		return fmt.Errorf("error diagnosing using the %s API: %w", provider.Name(), err)
+	}
+	log.Infof("Diagnosis: %s", suggestion)
+	_, err = f.WriteString(fmt.Sprintf("DIAGNOSIS:\n%s\n", suggestion))
+	if err != nil {
+		return fmt.Errorf("error writing to diagnosis file: %w", err)
+	}
+	err = f.Close()
+	if err != nil {
+		return fmt.Errorf("error closing the diagnosis file: %w", err)
 	}
-	return resp.Choices[0].Message.Content, nil
+	fullNameNoExt := strings.TrimSuffix(filename, ".diagnosing")
+	err = os.Rename(filename, fullNameNoExt+".diagnosed")
+	if err != nil {
+		return fmt.Errorf("error renaming the diagnosis file: %w", err)
+	}
+	return nil
+}
+
+func suggestion(ctx context.Context, provider Provider, model, systemPrompt, userPrompt, errorMsg string) (string, error) {
+	prompt := strings.Replace(userPrompt, config.ErrorPlaceholder, errorMsg, 1)
+	return provider.Suggestion(ctx, model, systemPrompt, prompt)
 }
 
+// safeString turns a log location (whose source name may come from the network) into a
+// file name: path separators are replaced so that it can not point outside the output directory
 // TODO: Make file separator configurable
 func safeString(s string) string {
 	result := strings.ReplaceAll(s, " ", "-")
 	result = strings.ReplaceAll(result, "/", "::")
-	if len(s) > 200 {
-		result = s[0:200]
+	result = strings.ReplaceAll(result, `\`, "::")
+	result = strings.ReplaceAll(result, "\x00", "")
+	if len(result) > 200 {
+		result = result[0:200]
 	}
-	return filepath.Clean(result)
+	return result
 }
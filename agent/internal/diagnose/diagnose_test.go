@@ -0,0 +1,19 @@
+package diagnose
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSafeString(t *testing.T) {
+	require.Equal(t, "::var::log::app.log:12", safeString("/var/log/app.log:12"))
+	require.Equal(t, "my-host:3", safeString("my host:3"))
+	require.Equal(t, "..::..::x", safeString(`../..\x`))
+
+	// Long names sent over the network do not escape the output directory
+	name := safeString(strings.Repeat("../", 100) + "tmp/x:1")
+	require.Len(t, name, 200)
+	require.NotContains(t, name, "/")
+}
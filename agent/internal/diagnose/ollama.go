@@ -0,0 +1,97 @@
+package diagnose
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+const defaultOllamaURL = "http://localhost:11434"
+
+// ollamaProvider talks to a local Ollama compatible server (/api/chat)
+type ollamaProvider struct {
+	url    string
+	client *http.Client
+}
+
+type ollamaMessage struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
+type ollamaChatRequest struct {
+	Model    string          `json:"model"`
+	Messages []ollamaMessage `json:"messages"`
+	Stream   bool            `json:"stream"`
+}
+
+type ollamaChatResponse struct {
+	Message ollamaMessage `json:"message"`
+	Error   string        `json:"error,omitempty"`
+}
+
+func newOllamaProvider(cfg ProviderConfig, client *http.Client) *ollamaProvider {
+	url := cfg.URL
+	if url == "" {
+		url = defaultOllamaURL
+	}
+	return &ollamaProvider{
+		url:    strings.TrimRight(url, "/"),
+		client: client,
+	}
+}
+
+func (p *ollamaProvider) Name() string {
+	return ProviderOllama
+}
+
+func (p *ollamaProvider) Suggestion(ctx context.Context, model, systemPrompt, prompt string) (string, error) {
+	body, err := json.Marshal(ollamaChatRequest{
+		Model: model,
+		Messages: []ollamaMessage{
+			{
+				Role:    "system",
+				Content: systemPrompt,
+			},
+			{
+				Role:    "user",
+				Content: prompt,
+			},
+		},
+		Stream: false,
+	})
+	if err != nil {
+		return "", fmt.Errorf("error encoding request: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.url+"/api/chat", bytes.NewReader(body))
+	if err != nil {
+		return "", fmt.Errorf("error creating request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("error generating text from API: %w", err)
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", fmt.Errorf("error reading response: %w", err)
+	}
+	var chatResp ollamaChatResponse
+	err = json.Unmarshal(respBody, &chatResp)
+	if err != nil {
+		return "", fmt.Errorf("error decoding response (status %d): %w", resp.StatusCode, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("error generating text from API (status %d): %s", resp.StatusCode, chatResp.Error)
+	}
+	if chatResp.Message.Content == "" {
+		return "", fmt.Errorf("ollama returned an empty message")
+	}
+	return chatResp.Message.Content, nil
+}
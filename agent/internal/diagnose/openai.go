@@ -0,0 +1,81 @@
+package diagnose
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	openai "github.com/sashabaranov/go-openai"
+)
+
+// Azure OpenAI API version used when not configured
+const defaultAzureAPIVersion = "2023-05-15"
+
+type openAIProvider struct {
+	name   string
+	client *openai.Client
+}
+
+func newOpenAIProvider(cfg ProviderConfig, httpClient *http.Client) *openAIProvider {
+	clientConfig := openai.DefaultConfig(cfg.APIKey)
+	if cfg.URL != "" {
+		clientConfig.BaseURL = strings.TrimRight(cfg.URL, "/")
+	}
+	clientConfig.OrgID = cfg.Organization
+	clientConfig.HTTPClient = httpClient
+	return &openAIProvider{
+		name:   ProviderOpenAI,
+		client: openai.NewClientWithConfig(clientConfig),
+	}
+}
+
+// newAzureProvider maps the Azure endpoint, API version and deployment onto the OpenAI client
+// (requests are sent to {endpoint}/openai/deployments/{deployment}/chat/completions with an api-key header)
+func newAzureProvider(cfg ProviderConfig, httpClient *http.Client) *openAIProvider {
+	clientConfig := openai.DefaultAzureConfig(cfg.APIKey, strings.TrimRight(cfg.URL, "/"))
+	clientConfig.APIVersion = cfg.APIVersion
+	if clientConfig.APIVersion == "" {
+		clientConfig.APIVersion = defaultAzureAPIVersion
+	}
+	if cfg.Deployment != "" {
+		clientConfig.AzureModelMapperFunc = func(model string) string {
+			return cfg.Deployment
+		}
+	}
+	clientConfig.HTTPClient = httpClient
+	return &openAIProvider{
+		name:   ProviderAzure,
+		client: openai.NewClientWithConfig(clientConfig),
+	}
+}
+
+func (p *openAIProvider) Name() string {
+	return p.name
+}
+
+func (p *openAIProvider) Suggestion(ctx context.Context, model, systemPrompt, prompt string) (string, error) {
+	resp, err := p.client.CreateChatCompletion(
+		ctx,
+		openai.ChatCompletionRequest{
+			Model: model,
+			Messages: []openai.ChatCompletionMessage{
+				{
+					Role:    openai.ChatMessageRoleSystem,
+					Content: systemPrompt,
+				},
+				{
+					Role:    openai.ChatMessageRoleUser,
+					Content: prompt,
+				},
+			},
+		},
+	)
+	if err != nil {
+		return "", fmt.Errorf("error generating text from API: %v", err)
+	}
+	if len(resp.Choices) == 0 {
+		return "", fmt.Errorf("chatGPT returned no choices")
+	}
+	return resp.Choices[0].Message.Content, nil
+}
@@ -0,0 +1,69 @@
+package diagnose
+
+import (
+	"context"
+	"fmt"
+)
+
+// Supported LLM providers
+const (
+	ProviderOpenAI = "openai"
+	ProviderAzure  = "azure"
+	ProviderOllama = "ollama"
+)
+
+// Provider is an LLM backend able to diagnose errors
+type Provider interface {
+	Name() string
+	Suggestion(ctx context.Context, model, systemPrompt, prompt string) (string, error)
+}
+
+type ProviderConfig struct {
+	// Provider name: "openai" (default), "azure" or "ollama"
+	Name string
+	// API key (only used by providers that require one)
+	APIKey string
+	// Base URL of the provider API (any OpenAI compatible server for openai, resource endpoint for azure)
+	URL string
+	// OpenAI organization
+	Organization string
+	// Extra HTTP headers sent on every request
+	Headers map[string]string
+	// HTTP(S) proxy URL (defaults to the environment proxy settings)
+	Proxy string
+	// Path to a PEM file with extra CA certificates to trust
+	CABundle string
+	// Azure OpenAI API version
+	APIVersion string
+	// Azure OpenAI deployment name (defaults to the model name)
+	Deployment string
+}
+
+// RequiresAPIKey returns whether the configured provider can not work without an API key.
+// OpenAI compatible servers other than the official API may authenticate through headers.
+func (c ProviderConfig) RequiresAPIKey() bool {
+	return c.Name == ProviderAzure || ((c.Name == "" || c.Name == ProviderOpenAI) && c.URL == "")
+}
+
+func NewProvider(cfg ProviderConfig) (Provider, error) {
+	if cfg.RequiresAPIKey() && cfg.APIKey == "" {
+		return nil, fmt.Errorf("provider (%s) requires an API key", cfg.Name)
+	}
+	client, err := newHTTPClient(cfg)
+	if err != nil {
+		return nil, err
+	}
+	switch cfg.Name {
+	case "", ProviderOpenAI:
+		return newOpenAIProvider(cfg, client), nil
+	case ProviderAzure:
+		if cfg.URL == "" {
+			return nil, fmt.Errorf("provider (%s) requires an endpoint URL", ProviderAzure)
+		}
+		return newAzureProvider(cfg, client), nil
+	case ProviderOllama:
+		return newOllamaProvider(cfg, client), nil
+	default:
+		return nil, fmt.Errorf("unknown provider (%s)", cfg.Name)
+	}
+}
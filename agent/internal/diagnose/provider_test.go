@@ -0,0 +1,131 @@
+package diagnose
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewProvider(t *testing.T) {
+	_, err := NewProvider(ProviderConfig{})
+	require.Error(t, err, "openai provider requires an API key")
+	require.True(t, ProviderConfig{}.RequiresAPIKey())
+
+	provider, err := NewProvider(ProviderConfig{Name: ProviderOpenAI, APIKey: "key"})
+	require.NoError(t, err)
+	require.Equal(t, ProviderOpenAI, provider.Name())
+
+	// OpenAI compatible servers may not need an API key
+	require.False(t, ProviderConfig{URL: "http://localhost:8000/v1"}.RequiresAPIKey())
+	_, err = NewProvider(ProviderConfig{URL: "http://localhost:8000/v1"})
+	require.NoError(t, err)
+
+	require.False(t, ProviderConfig{Name: ProviderOllama}.RequiresAPIKey())
+	provider, err = NewProvider(ProviderConfig{Name: ProviderOllama})
+	require.NoError(t, err)
+	require.Equal(t, ProviderOllama, provider.Name())
+
+	_, err = NewProvider(ProviderConfig{Name: "unknown"})
+	require.Error(t, err)
+}
+
+func TestOllamaProvider(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "/api/chat", r.URL.Path)
+		var req ollamaChatRequest
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+		require.Equal(t, "llama3", req.Model)
+		require.False(t, req.Stream)
+		require.Equal(t, []ollamaMessage{
+			{Role: "system", Content: "system prompt"},
+			{Role: "user", Content: "prompt"},
+		}, req.Messages)
+		json.NewEncoder(w).Encode(ollamaChatResponse{
+			Message: ollamaMessage{Role: "assistant", Content: "diagnosis"},
+		})
+	}))
+	defer server.Close()
+
+	provider, err := NewProvider(ProviderConfig{Name: ProviderOllama, URL: server.URL + "/"})
+	require.NoError(t, err)
+	suggestion, err := provider.Suggestion(context.Background(), "llama3", "system prompt", "prompt")
+	require.NoError(t, err)
+	require.Equal(t, "diagnosis", suggestion)
+}
+
+func TestOpenAICompatibleProvider(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "/v1/chat/completions", r.URL.Path)
+		require.Equal(t, "Bearer key", r.Header.Get("Authorization"))
+		require.Equal(t, "org", r.Header.Get("OpenAI-Organization"))
+		require.Equal(t, "secret", r.Header.Get("X-Gateway-Token"))
+		var req map[string]interface{}
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+		require.Equal(t, "mistral-7b-instruct", req["model"])
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"choices":[{"index":0,"message":{"role":"assistant","content":"diagnosis"}}]}`))
+	}))
+	defer server.Close()
+
+	// Trust the test server certificate through a CA bundle
+	caBundle := filepath.Join(t.TempDir(), "ca.pem")
+	certificate := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	require.NoError(t, os.WriteFile(caBundle, certificate, 0644))
+
+	provider, err := NewProvider(ProviderConfig{
+		Name:         ProviderOpenAI,
+		APIKey:       "key",
+		URL:          server.URL + "/v1/",
+		Organization: "org",
+		Headers: map[string]string{
+			"X-Gateway-Token": "secret",
+		},
+		CABundle: caBundle,
+	})
+	require.NoError(t, err)
+	suggestion, err := provider.Suggestion(context.Background(), "mistral-7b-instruct", "system prompt", "prompt")
+	require.NoError(t, err)
+	require.Equal(t, "diagnosis", suggestion)
+
+	// Without the CA bundle the certificate is not trusted
+	provider, err = NewProvider(ProviderConfig{APIKey: "key", URL: server.URL + "/v1"})
+	require.NoError(t, err)
+	_, err = provider.Suggestion(context.Background(), "mistral-7b-instruct", "system prompt", "prompt")
+	require.Error(t, err)
+}
+
+func TestAzureProvider(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "/openai/deployments/prod-gpt4/chat/completions", r.URL.Path)
+		require.Equal(t, "2023-07-01-preview", r.URL.Query().Get("api-version"))
+		require.Equal(t, "key", r.Header.Get("api-key"))
+		require.Empty(t, r.Header.Get("Authorization"))
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"choices":[{"index":0,"message":{"role":"assistant","content":"diagnosis"}}]}`))
+	}))
+	defer server.Close()
+
+	require.True(t, ProviderConfig{Name: ProviderAzure, URL: server.URL}.RequiresAPIKey())
+	_, err := NewProvider(ProviderConfig{Name: ProviderAzure, APIKey: "key"})
+	require.Error(t, err, "azure provider requires an endpoint")
+
+	provider, err := NewProvider(ProviderConfig{
+		Name:       ProviderAzure,
+		APIKey:     "key",
+		URL:        server.URL + "/",
+		APIVersion: "2023-07-01-preview",
+		Deployment: "prod-gpt4",
+	})
+	require.NoError(t, err)
+	require.Equal(t, ProviderAzure, provider.Name())
+	suggestion, err := provider.Suggestion(context.Background(), "gpt-4", "system prompt", "prompt")
+	require.NoError(t, err)
+	require.Equal(t, "diagnosis", suggestion)
+}
@@ -0,0 +1,216 @@
+package diagnose
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cenkalti/backoff/v4"
+	"go.uber.org/zap"
+
+	"github.com/ingyamilmolinar/doctorgpt/agent/internal/journal"
+	"github.com/ingyamilmolinar/doctorgpt/agent/internal/parser"
+)
+
+// Queue is a durable work queue of diagnoses. Every trigger is recorded in the journal
+// before calling the LLM and only removed once diagnosed, so queued diagnoses survive
+// crashes, restarts and API outages. A pool of workers drains it with retries, running
+// the diagnoses through a Tracker.
+type Queue struct {
+	diagnose    Diagnoser
+	journal     *journal.Journal
+	tracker     *Tracker
+	workers     int
+	maxAttempts int
+	backoff     func() backoff.BackOff
+
+	mu      sync.Mutex
+	pending []journal.Record
+	notify  chan struct{}
+	// Queued diagnoses not yet diagnosed nor given up on
+	queued sync.WaitGroup
+	failed int64
+	logger *zap.SugaredLogger
+}
+
+// NewQueue returns a queue running diagnose with the given number of workers.
+// Records failing maxAttempts times (0 means forever) are moved to the journal failed directory.
+func NewQueue(log *zap.SugaredLogger, j *journal.Journal, diagnose Diagnoser, workers, maxAttempts int) *Queue {
+	q := &Queue{
+		diagnose:    diagnose,
+		journal:     j,
+		tracker:     NewTracker(log, j),
+		workers:     workers,
+		maxAttempts: maxAttempts,
+		notify:      make(chan struct{}, 1),
+		logger:      log,
+	}
+	q.SetRetryIntervals(10*time.Second, 10*time.Minute)
+	return q
+}
+
+// SetRetryIntervals changes the backoff between attempts (10s growing up to 10m by default)
+func (q *Queue) SetRetryIntervals(initial, max time.Duration) {
+	q.backoff = func() backoff.BackOff {
+		b := backoff.NewExponentialBackOff()
+		b.InitialInterval = initial
+		b.MaxInterval = max
+		return b
+	}
+}
+
+// Start replays the records left in the journal by a previous run and starts the workers
+func (q *Queue) Start() error {
+	records, err := q.tracker.Resume()
+	if err != nil {
+		return err
+	}
+	for _, record := range records {
+		q.queued.Add(1)
+		q.push(record)
+	}
+	for i := 0; i < q.workers; i++ {
+		q.tracker.Go(q.work)
+	}
+	return nil
+}
+
+// Handler returns a Handler that persists the diagnosis and queues it (it returns right away)
+func (q *Queue) Handler() Handler {
+	return func(log *zap.SugaredLogger, fileName, outputDir, model string, entryToDiagnose parser.LogEntry, logContext []parser.LogEntry) error {
+		record := journal.Record{
+			FileName:  fileName,
+			OutputDir: outputDir,
+			Model:     model,
+			Entry:     entryToDiagnose,
+			Context:   logContext,
+		}
+		err := q.journal.Save(&record)
+		// Diagnose anyway, it just won't survive a restart
+		q.queued.Add(1)
+		q.push(record)
+		return err
+	}
+}
+
+// Wait blocks until every queued diagnosis is done (diagnosed or given up on) or ctx is done
+func (q *Queue) Wait(ctx context.Context) bool {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		q.queued.Wait()
+	}()
+	select {
+	case <-done:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// Failed returns how many diagnoses were given up on
+func (q *Queue) Failed() int {
+	return int(atomic.LoadInt64(&q.failed))
+}
+
+// Drain stops the workers, waiting for running diagnoses up to the timeout (they are
+// cancelled afterwards). It returns how many diagnoses are left in the journal for the next run.
+func (q *Queue) Drain(timeout time.Duration) int {
+	return q.tracker.Drain(timeout)
+}
+func (q *Queue) push(record journal.Record) {
+	q.mu.Lock()
+	q.pending = append(q.pending, record)
+	q.mu.Unlock()
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+}
+
+func (q *Queue) pop() (journal.Record, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.pending) == 0 {
+		return journal.Record{}, false
+	}
+	record := q.pending[0]
+	q.pending = q.pending[1:]
+	// Wake up another worker if there is more work
+	if len(q.pending) > 0 {
+		select {
+		case q.notify <- struct{}{}:
+		default:
+		}
+	}
+	return record, true
+}
+
+func (q *Queue) work(ctx context.Context) {
+	for {
+		record, ok := q.pop()
+		if !ok {
+			select {
+			case <-ctx.Done():
+				return
+			case <-q.notify:
+				continue
+			}
+		}
+		// Do not start new diagnoses once stopped (they are kept in the journal)
+		if ctx.Err() != nil {
+			return
+		}
+		q.process(record)
+	}
+}
+
+func (q *Queue) process(record journal.Record) {
+	err := q.tracker.Run(q.diagnose, record)
+	// Cancelled diagnoses are not an attempt (they are resumed by the next run)
+	if err != nil && q.tracker.Cancelled() {
+		q.logger.Warnf("Diagnosis of (%s:%d) cancelled", record.FileName, record.Entry.LineNo)
+		return
+	}
+	if err == nil {
+		err = q.journal.Remove(record.ID)
+		if err != nil {
+			q.logger.Errorf("Failed to remove journal record: %v", err)
+		}
+		q.queued.Done()
+		return
+	}
+
+	record.Attempts++
+	q.logger.Errorf("Diagnosis of (%s:%d) failed (attempt %d): %v", record.FileName, record.Entry.LineNo, record.Attempts, err)
+	if q.maxAttempts > 0 && record.Attempts >= q.maxAttempts {
+		q.logger.Errorf("Giving up on diagnosis of (%s:%d)", record.FileName, record.Entry.LineNo)
+		err = q.journal.Fail(record)
+		if err != nil {
+			q.logger.Errorf("Failed to move journal record: %v", err)
+		}
+		atomic.AddInt64(&q.failed, 1)
+		q.queued.Done()
+		return
+	}
+	err = q.journal.Save(&record)
+	if err != nil {
+		q.logger.Errorf("Failed to update journal record: %v", err)
+	}
+
+	// Retry later on (exponential backoff based on the number of attempts)
+	b := q.backoff()
+	delay := b.NextBackOff()
+	for i := 1; i < record.Attempts; i++ {
+		delay = b.NextBackOff()
+	}
+	q.logger.Infof("Retrying diagnosis of (%s:%d) in %s", record.FileName, record.Entry.LineNo, delay)
+	q.tracker.Go(func(ctx context.Context) {
+		select {
+		case <-ctx.Done():
+		case <-time.After(delay):
+			q.push(record)
+		}
+	})
+}
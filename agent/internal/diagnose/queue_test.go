@@ -0,0 +1,121 @@
+package diagnose
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cenkalti/backoff/v4"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/ingyamilmolinar/doctorgpt/agent/internal/journal"
+	"github.com/ingyamilmolinar/doctorgpt/agent/internal/parser"
+)
+
+var logger, _ = zap.NewDevelopment()
+
+func newTestQueue(t *testing.T, dir string, diagnose Diagnoser, maxAttempts int) (*Queue, *journal.Journal) {
+	j, err := journal.Open(logger.Sugar(), dir)
+	require.NoError(t, err)
+	q := NewQueue(logger.Sugar(), j, diagnose, 2, maxAttempts)
+	q.backoff = func() backoff.BackOff {
+		return backoff.NewConstantBackOff(time.Millisecond)
+	}
+	return q, j
+}
+
+func TestQueueRetriesAndReplays(t *testing.T) {
+	dir := t.TempDir()
+	entry := parser.LogEntry{Text: "ERROR: boom", LineNo: 3}
+
+	// A diagnosis that fails is retried until it succeeds
+	var calls int32
+	flaky := func(ctx context.Context, log *zap.SugaredLogger, fileName, outputDir, model string, entryToDiagnose parser.LogEntry, logContext []parser.LogEntry) error {
+		if atomic.AddInt32(&calls, 1) < 3 {
+			return errors.New("API outage")
+		}
+		return nil
+	}
+	q, j := newTestQueue(t, dir, flaky, 0)
+	require.NoError(t, q.Start())
+	require.NoError(t, q.Handler()(logger.Sugar(), "app.log", "out", "gpt-4", entry, nil))
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	require.True(t, q.Wait(ctx))
+	records, err := j.Load()
+	require.NoError(t, err)
+	require.Empty(t, records)
+	require.Equal(t, 0, q.Failed())
+	require.Equal(t, int32(3), atomic.LoadInt32(&calls))
+	require.Equal(t, 0, q.Drain(time.Second))
+
+	// Queued diagnoses are kept in the journal when stopped
+	release := make(chan struct{})
+	defer close(release)
+	// Running diagnoses are cancelled once the drain times out (without counting as an attempt)
+	started, cancelled := make(chan struct{}), make(chan struct{})
+	blocked := func(ctx context.Context, log *zap.SugaredLogger, fileName, outputDir, model string, entryToDiagnose parser.LogEntry, logContext []parser.LogEntry) error {
+		close(started)
+		select {
+		case <-release:
+			return nil
+		case <-ctx.Done():
+			close(cancelled)
+			return ctx.Err()
+		}
+	}
+	q, j = newTestQueue(t, dir, blocked, 0)
+	require.NoError(t, q.Start())
+	require.NoError(t, q.Handler()(logger.Sugar(), "app.log", "out", "gpt-4", entry, []parser.LogEntry{entry}))
+	<-started
+	require.Equal(t, 1, q.Drain(10*time.Millisecond))
+	<-cancelled
+	records, err = j.Load()
+	require.NoError(t, err)
+	require.Equal(t, 0, records[0].Attempts)
+
+	// And replayed on the next start-up
+	replayed := make(chan journal.Record, 1)
+	recorder := func(ctx context.Context, log *zap.SugaredLogger, fileName, outputDir, model string, entryToDiagnose parser.LogEntry, logContext []parser.LogEntry) error {
+		replayed <- journal.Record{FileName: fileName, OutputDir: outputDir, Model: model, Entry: entryToDiagnose, Context: logContext}
+		return nil
+	}
+	q, j = newTestQueue(t, dir, recorder, 0)
+	require.NoError(t, q.Start())
+	select {
+	case record := <-replayed:
+		require.Equal(t, "app.log", record.FileName)
+		require.Equal(t, "gpt-4", record.Model)
+		require.Equal(t, entry.Text, record.Entry.Text)
+		require.Len(t, record.Context, 1)
+	case <-time.After(time.Second):
+		t.Fatal("queued diagnosis was not replayed")
+	}
+	require.Equal(t, 0, q.Drain(time.Second))
+}
+
+func TestQueueGivesUp(t *testing.T) {
+	dir := t.TempDir()
+	var calls int32
+	failing := func(ctx context.Context, log *zap.SugaredLogger, fileName, outputDir, model string, entryToDiagnose parser.LogEntry, logContext []parser.LogEntry) error {
+		atomic.AddInt32(&calls, 1)
+		return errors.New("bad request")
+	}
+	q, _ := newTestQueue(t, dir, failing, 2)
+	require.NoError(t, q.Start())
+	require.NoError(t, q.Handler()(logger.Sugar(), "app.log", "out", "gpt-4", parser.LogEntry{Text: "ERROR"}, nil))
+
+	// Failed diagnoses are moved aside instead of being dropped
+	require.Eventually(t, func() bool {
+		files, err := os.ReadDir(filepath.Join(dir, "failed"))
+		return err == nil && len(files) == 1
+	}, time.Second, 5*time.Millisecond)
+	require.Equal(t, 0, q.Drain(time.Second))
+	require.Equal(t, 1, q.Failed())
+	require.Equal(t, int32(2), atomic.LoadInt32(&calls))
+}
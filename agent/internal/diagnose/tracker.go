@@ -0,0 +1,111 @@
+package diagnose
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/ingyamilmolinar/doctorgpt/agent/internal/journal"
+)
+
+// Tracker keeps track of the diagnoses running in the background so that they can be
+// drained on shutdown. Diagnoses are persisted in the journal until they are done, so
+// the unfinished ones are resumed by the next run.
+type Tracker struct {
+	wg      sync.WaitGroup
+	mu      sync.Mutex
+	running map[string]journal.Record
+	// stopped is done once draining starts, cancelled once the drain times out
+	stopped   context.Context
+	stop      context.CancelFunc
+	cancelled context.Context
+	cancel    context.CancelFunc
+	journal   *journal.Journal
+	logger    *zap.SugaredLogger
+}
+
+func NewTracker(log *zap.SugaredLogger, j *journal.Journal) *Tracker {
+	t := &Tracker{
+		running: make(map[string]journal.Record),
+		journal: j,
+		logger:  log,
+	}
+	t.stopped, t.stop = context.WithCancel(context.Background())
+	t.cancelled, t.cancel = context.WithCancel(context.Background())
+	return t
+}
+
+// Resume returns the diagnoses left unfinished by a previous run
+func (t *Tracker) Resume() ([]journal.Record, error) {
+	records, err := t.journal.Load()
+	if err != nil {
+		return nil, err
+	}
+	for _, record := range records {
+		t.logger.Infof("Resuming diagnosis of (%s:%d)", record.FileName, record.Entry.LineNo)
+	}
+	return records, nil
+}
+
+// Go runs f in the background, Drain waits for it. ctx is done once draining starts.
+func (t *Tracker) Go(f func(ctx context.Context)) {
+	t.wg.Add(1)
+	go func() {
+		defer t.wg.Done()
+		f(t.stopped)
+	}()
+}
+
+// Run diagnoses the record, keeping track of it while it runs
+func (t *Tracker) Run(diagnose Diagnoser, record journal.Record) error {
+	t.mu.Lock()
+	t.running[record.ID] = record
+	t.mu.Unlock()
+	defer func() {
+		t.mu.Lock()
+		delete(t.running, record.ID)
+		t.mu.Unlock()
+	}()
+	return diagnose(t.cancelled, t.logger, record.FileName, record.OutputDir, record.Model, record.Entry, record.Context)
+}
+
+// Cancelled reports whether running diagnoses were cancelled by Drain
+func (t *Tracker) Cancelled() bool {
+	return t.cancelled.Err() != nil
+}
+
+// Drain waits for running diagnoses up to the timeout and cancels the ones left.
+// It returns how many diagnoses are left in the journal for the next run.
+func (t *Tracker) Drain(timeout time.Duration) int {
+	t.stop()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		t.wg.Wait()
+	}()
+	select {
+	case <-done:
+		t.logger.Info("All running diagnoses finished")
+	case <-time.After(timeout):
+		t.mu.Lock()
+		for _, record := range t.running {
+			t.logger.Warnf("Cancelling unfinished diagnosis of (%s:%d)", record.FileName, record.Entry.LineNo)
+		}
+		t.mu.Unlock()
+		t.cancel()
+		// Cancelled diagnoses return right away
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+		}
+	}
+	t.cancel()
+	records, err := t.journal.Load()
+	if err != nil {
+		t.logger.Errorf("Failed to read journal: %v", err)
+		return 0
+	}
+	return len(records)
+}
@@ -0,0 +1,66 @@
+package diagnose
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/ingyamilmolinar/doctorgpt/agent/internal/journal"
+	"github.com/ingyamilmolinar/doctorgpt/agent/internal/parser"
+)
+
+func TestTrackerDrainAndResume(t *testing.T) {
+	j, err := journal.Open(logger.Sugar(), t.TempDir())
+	require.NoError(t, err)
+	entry := parser.LogEntry{
+		Triggered: true,
+		Text:      "[ERROR] boom",
+		LineNo:    7,
+		Variables: map[string]string{"LEVEL": "ERROR", "LINENO": "7"},
+	}
+	record := journal.Record{FileName: "app.log", OutputDir: "out", Model: "gpt-4", Entry: entry, Context: []parser.LogEntry{entry}}
+	require.NoError(t, j.Save(&record))
+
+	// A diagnosis that never finishes before the shutdown deadline is cancelled
+	tracker := NewTracker(logger.Sugar(), j)
+	records, err := tracker.Resume()
+	require.NoError(t, err)
+	require.Len(t, records, 1)
+	started := make(chan struct{})
+	blocked := func(ctx context.Context, log *zap.SugaredLogger, fileName, outputDir, model string, entryToDiagnose parser.LogEntry, logContext []parser.LogEntry) error {
+		close(started)
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	result := make(chan error, 1)
+	tracker.Go(func(ctx context.Context) {
+		result <- tracker.Run(blocked, records[0])
+	})
+	<-started
+	require.False(t, tracker.Cancelled())
+	require.Equal(t, 1, tracker.Drain(50*time.Millisecond))
+	require.ErrorIs(t, <-result, context.Canceled)
+	require.True(t, tracker.Cancelled())
+
+	// The next run resumes the unfinished diagnosis
+	tracker = NewTracker(logger.Sugar(), j)
+	records, err = tracker.Resume()
+	require.NoError(t, err)
+	require.Len(t, records, 1)
+	resumed := func(ctx context.Context, log *zap.SugaredLogger, fileName, outputDir, model string, entryToDiagnose parser.LogEntry, logContext []parser.LogEntry) error {
+		require.Equal(t, "app.log", fileName)
+		require.Equal(t, "out", outputDir)
+		require.Equal(t, "gpt-4", model)
+		require.Equal(t, entry, entryToDiagnose)
+		require.Equal(t, []parser.LogEntry{entry}, logContext)
+		return j.Remove(record.ID)
+	}
+	tracker.Go(func(ctx context.Context) {
+		result <- tracker.Run(resumed, records[0])
+	})
+	require.NoError(t, <-result)
+	require.Equal(t, 0, tracker.Drain(time.Second))
+}
@@ -0,0 +1,142 @@
+package discovery
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/ingyamilmolinar/doctorgpt/agent/internal/tailer"
+)
+
+// Monitor is started once per discovered file and must return when ctx is done
+type Monitor func(ctx context.Context, path string)
+
+// Watch periodically expands the glob patterns and starts a monitor for every
+// new file found. Monitors of files that are no longer matched (deleted) are
+// cancelled. Watch blocks until ctx is done and every monitor has returned.
+func Watch(ctx context.Context, log *zap.SugaredLogger, patterns []string, interval time.Duration, monitor Monitor) {
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	monitored := make(map[string]*context.CancelFunc)
+
+	scan := func() {
+		found := make(map[string]bool)
+		for _, path := range expand(log, patterns) {
+			found[path] = true
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		for path := range found {
+			if _, ok := monitored[path]; ok {
+				continue
+			}
+			log.Infof("Discovered log file (%s)", path)
+			fileCtx, cancel := context.WithCancel(ctx)
+			handle := &cancel
+			monitored[path] = handle
+			wg.Add(1)
+			go func(path string) {
+				defer wg.Done()
+				monitor(fileCtx, path)
+				cancel()
+				// Forget the file so that it can be picked up again if it comes back
+				mu.Lock()
+				if monitored[path] == handle {
+					delete(monitored, path)
+				}
+				mu.Unlock()
+			}(path)
+		}
+		for path, cancel := range monitored {
+			if found[path] {
+				continue
+			}
+			log.Infof("Releasing removed log file (%s)", path)
+			(*cancel)()
+			delete(monitored, path)
+		}
+	}
+
+	scan()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			mu.Lock()
+			for _, cancel := range monitored {
+				(*cancel)()
+			}
+			mu.Unlock()
+			wg.Wait()
+			return
+		case <-ticker.C:
+			scan()
+		}
+	}
+}
+
+// Patterns returns the glob patterns to watch given a log file (or glob) and a log directory
+func Patterns(logFile, logDir string) []string {
+	var patterns []string
+	if logFile != "" {
+		patterns = append(patterns, logFile)
+	}
+	if logDir != "" {
+		patterns = append(patterns, filepath.Join(logDir, "*"))
+	}
+	return patterns
+}
+
+// expand returns the log files to monitor. Rotated segments (e.g. app.log.1) are left out
+// when their log file is matched (its monitor reads them) and so are compressed files.
+func expand(log *zap.SugaredLogger, patterns []string) []string {
+	paths := Files(log, patterns)
+	var logFiles []string
+	for _, path := range paths {
+		if tailer.IsCompressed(path) {
+			continue
+		}
+		segment := false
+		for _, other := range paths {
+			if other != path && tailer.IsSegment(other, path) {
+				segment = true
+				break
+			}
+		}
+		if !segment {
+			logFiles = append(logFiles, path)
+		}
+	}
+	return logFiles
+}
+
+// Files returns all regular files (and named pipes) matching any of the patterns
+func Files(log *zap.SugaredLogger, patterns []string) []string {
+	var paths []string
+	seen := make(map[string]bool)
+	for _, pattern := range patterns {
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			log.Errorf("Invalid log file pattern (%s): %v", pattern, err)
+			continue
+		}
+		for _, path := range matches {
+			if seen[path] {
+				continue
+			}
+			info, err := os.Stat(path)
+			if err != nil || !(info.Mode().IsRegular() || info.Mode()&os.ModeNamedPipe != 0) {
+				continue
+			}
+			seen[path] = true
+			paths = append(paths, path)
+		}
+	}
+	return paths
+}
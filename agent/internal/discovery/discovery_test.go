@@ -0,0 +1,77 @@
+package discovery
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+var logger, _ = zap.NewDevelopment()
+
+func TestWatch(t *testing.T) {
+	dir := t.TempDir()
+	first := filepath.Join(dir, "first.log")
+	second := filepath.Join(dir, "second.log")
+	require.NoError(t, os.WriteFile(first, []byte("line\n"), 0644))
+	// Rotated segments are read by the monitor of their log file
+	require.NoError(t, os.WriteFile(first+".1", []byte("line\n"), 0644))
+	// Unlike other files sharing their prefix
+	worker := first + "-worker.log"
+	require.NoError(t, os.WriteFile(worker, []byte("line\n"), 0644))
+
+	var mu sync.Mutex
+	started := map[string]int{}
+	stopped := map[string]int{}
+	monitor := func(ctx context.Context, path string) {
+		mu.Lock()
+		started[path]++
+		mu.Unlock()
+		<-ctx.Done()
+		mu.Lock()
+		stopped[path]++
+		mu.Unlock()
+	}
+	counts := func(m map[string]int, path string) func() bool {
+		return func() bool {
+			mu.Lock()
+			defer mu.Unlock()
+			return m[path] == 1
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		Watch(ctx, logger.Sugar(), Patterns("", dir), 10*time.Millisecond, monitor)
+	}()
+
+	// Existing file is monitored right away
+	require.Eventually(t, counts(started, first), time.Second, 5*time.Millisecond)
+	require.Eventually(t, counts(started, worker), time.Second, 5*time.Millisecond)
+
+	// New files are picked up later on
+	require.NoError(t, os.WriteFile(second, []byte("line\n"), 0644))
+	require.Eventually(t, counts(started, second), time.Second, 5*time.Millisecond)
+
+	// Removed files are released
+	require.NoError(t, os.Remove(first+".1"))
+	require.NoError(t, os.Remove(first))
+	require.Eventually(t, counts(stopped, first), time.Second, 5*time.Millisecond)
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Watch did not return after cancellation")
+	}
+	require.Equal(t, 1, started[first])
+	require.Equal(t, 1, stopped[second])
+	require.Equal(t, 0, started[first+".1"])
+}
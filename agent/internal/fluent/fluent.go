@@ -0,0 +1,503 @@
+package fluent
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/rand"
+	"crypto/sha512"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/vmihailenco/msgpack/v5"
+	"github.com/vmihailenco/msgpack/v5/msgpcode"
+	"go.uber.org/zap"
+
+	"github.com/ingyamilmolinar/doctorgpt/agent/internal/input"
+	"github.com/ingyamilmolinar/doctorgpt/agent/internal/parser"
+)
+
+// Variables set on every forwarded log entry
+const (
+	VariableTag       = "TAG"
+	VariableTimestamp = "TIMESTAMP"
+	// Prefix of the record fields (e.g. RECORD.kubernetes.pod_name)
+	VariableRecord = "RECORD"
+)
+
+// Record fields holding the log line (the whole record is used as JSON otherwise)
+var messageFields = []string{"log", "message", "msg"}
+
+// Limits of the messages received (so that a client can not exhaust the memory)
+const (
+	// Largest message (before decompression)
+	maxMessageSize = 16 << 20
+	// Largest decompressed events of a CompressedPackedForward message
+	maxDecompressedSize = 64 << 20
+	// Most array and map elements per message (or packed events)
+	maxElements = 1 << 20
+	// Deepest nesting of arrays and maps
+	maxDepth = 64
+	// Time a client has to authenticate
+	handshakeTimeout = 10 * time.Second
+)
+
+// Variables set on every forwarded log entry
+var Variables = parser.SourceVariables{VariableTag, VariableTimestamp, VariableRecord + ".*"}
+
+func init() {
+	msgpack.RegisterExt(0, (*EventTime)(nil))
+}
+
+// EventTime is the nanosecond precision time extension of the forward protocol
+type EventTime struct {
+	time.Time
+}
+
+func (t *EventTime) MarshalMsgpack() ([]byte, error) {
+	data := make([]byte, 8)
+	binary.BigEndian.PutUint32(data, uint32(t.Unix()))
+	binary.BigEndian.PutUint32(data[4:], uint32(t.Nanosecond()))
+	return data, nil
+}
+
+func (t *EventTime) UnmarshalMsgpack(data []byte) error {
+	if len(data) != 8 {
+		return fmt.Errorf("invalid event time length (%d)", len(data))
+	}
+	t.Time = time.Unix(int64(binary.BigEndian.Uint32(data)), int64(binary.BigEndian.Uint32(data[4:])))
+	return nil
+}
+
+// Listen receives forward protocol messages (Message, Forward, PackedForward and
+// CompressedPackedForward modes) over TCP (or TLS if tlsConfig is set) until ctx is
+// done. Clients must authenticate with the shared key handshake when sharedKey is set.
+// Every tag is monitored on its own. It returns the address it listens on.
+// See https://github.com/fluent/fluentd/wiki/Forward-Protocol-Specification-v1
+func Listen(ctx context.Context, log *zap.SugaredLogger, addr string, tlsConfig *tls.Config, sharedKey string, demux *input.Demux) (net.Addr, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen for forward messages: %w", err)
+	}
+	scheme := "tcp"
+	if tlsConfig != nil {
+		listener = tls.NewListener(listener, tlsConfig)
+		scheme = "tls"
+	}
+	log.Infof("Listening for forward messages on (%s://%s)", scheme, listener.Addr())
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+	}()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			if err != nil {
+				log.Errorf("Failed to accept forward connection: %v", err)
+				continue
+			}
+			go serve(ctx, log, conn, sharedKey, demux)
+		}
+	}()
+	return listener.Addr(), nil
+}
+
+func serve(ctx context.Context, log *zap.SugaredLogger, conn net.Conn, sharedKey string, demux *input.Demux) {
+	done := make(chan struct{})
+	defer close(done)
+	defer conn.Close()
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	// Every message is limited to maxMessageSize (give or take the bytes read ahead)
+	limited := &io.LimitedReader{R: conn, N: maxMessageSize}
+	decoder := msgpack.NewDecoder(limited)
+	encoder := msgpack.NewEncoder(conn)
+	if sharedKey != "" {
+		err := handshake(decoder, encoder, conn, sharedKey)
+		if err != nil {
+			log.Errorf("Forward handshake with (%s) failed: %v", conn.RemoteAddr(), err)
+			return
+		}
+	}
+	for {
+		limited.N = maxMessageSize
+		message, err := decodeMessage(decoder)
+		if err != nil {
+			switch {
+			case limited.N <= 0:
+				log.Errorf("Forward message from (%s) is larger than (%d) bytes", conn.RemoteAddr(), maxMessageSize)
+			case !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed):
+				log.Errorf("Failed to read forward message from (%s): %v", conn.RemoteAddr(), err)
+			}
+			return
+		}
+		tag, entries, option, err := Decode(message)
+		if err != nil {
+			log.Errorf("Invalid forward message from (%s): %v", conn.RemoteAddr(), err)
+			return
+		}
+		for _, entry := range entries {
+			if !demux.Send(tag, entry.Text, entry.Variables) {
+				return
+			}
+		}
+		// Acknowledge the chunk once its entries are queued (at-least-once delivery)
+		chunk, ok := option["chunk"].(string)
+		if ok {
+			err = encoder.Encode(map[string]string{"ack": chunk})
+			if err != nil {
+				log.Errorf("Failed to acknowledge forward message from (%s): %v", conn.RemoteAddr(), err)
+				return
+			}
+		}
+	}
+}
+
+// Entry is a forwarded log line along with its variables
+type Entry struct {
+	Text      string
+	Variables map[string]string
+}
+
+// Decode decodes a forward protocol message into its tag, entries and options
+func Decode(message []interface{}) (string, []Entry, map[string]interface{}, error) {
+	if len(message) < 2 {
+		return "", nil, nil, fmt.Errorf("message has (%d) elements", len(message))
+	}
+	tag, ok := normalize(message[0]).(string)
+	if !ok || tag == "" {
+		return "", nil, nil, fmt.Errorf("invalid tag (%v)", message[0])
+	}
+
+	var entries []Entry
+	var option map[string]interface{}
+	switch events := message[1].(type) {
+	case []interface{}:
+		// Forward mode: [tag, [[time, record], ...], option]
+		for _, event := range events {
+			pair, ok := event.([]interface{})
+			if !ok || len(pair) < 2 {
+				return "", nil, nil, fmt.Errorf("invalid event (%v)", event)
+			}
+			entry, err := newEntry(tag, pair[0], pair[1])
+			if err != nil {
+				return "", nil, nil, err
+			}
+			entries = append(entries, entry)
+		}
+		option = optionAt(message, 2)
+	case string, []byte:
+		// (Compressed)PackedForward mode: [tag, <msgpack stream of [time, record]>, option]
+		option = optionAt(message, 2)
+		packed := toBytes(events)
+		if option["compressed"] == "gzip" {
+			var err error
+			packed, err = decompress(packed)
+			if err != nil {
+				return "", nil, nil, err
+			}
+		}
+		decoder := msgpack.NewDecoder(bytes.NewReader(packed))
+		budget := maxElements
+		for {
+			value, err := decodeValue(decoder, &budget, 0)
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			if err != nil {
+				return "", nil, nil, fmt.Errorf("invalid packed event: %w", err)
+			}
+			pair, _ := value.([]interface{})
+			if len(pair) < 2 {
+				return "", nil, nil, fmt.Errorf("invalid packed event (%v)", pair)
+			}
+			entry, err := newEntry(tag, pair[0], pair[1])
+			if err != nil {
+				return "", nil, nil, err
+			}
+			entries = append(entries, entry)
+		}
+	default:
+		// Message mode: [tag, time, record, option]
+		if len(message) < 3 {
+			return "", nil, nil, fmt.Errorf("message has no record")
+		}
+		entry, err := newEntry(tag, message[1], message[2])
+		if err != nil {
+			return "", nil, nil, err
+		}
+		entries = append(entries, entry)
+		option = optionAt(message, 3)
+	}
+	return tag, entries, option, nil
+}
+
+// decompress gzip compressed events (up to maxDecompressedSize)
+func decompress(data []byte) ([]byte, error) {
+	gz, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("invalid compressed events: %w", err)
+	}
+	defer gz.Close()
+	decompressed, err := io.ReadAll(io.LimitReader(gz, maxDecompressedSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("invalid compressed events: %w", err)
+	}
+	if len(decompressed) > maxDecompressedSize {
+		return nil, fmt.Errorf("compressed events are larger than (%d) bytes", maxDecompressedSize)
+	}
+	return decompressed, nil
+}
+
+// decodeMessage decodes a message (an array) within the element limits
+func decodeMessage(decoder *msgpack.Decoder) ([]interface{}, error) {
+	budget := maxElements
+	value, err := decodeValue(decoder, &budget, 0)
+	if err != nil {
+		return nil, err
+	}
+	message, ok := value.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("message is not an array (%v)", value)
+	}
+	return message, nil
+}
+
+// decodeValue decodes a msgpack value, bounding the elements of its arrays and maps (budget,
+// shared by all of them) and their nesting, since lengths are chosen by the client
+func decodeValue(decoder *msgpack.Decoder, budget *int, depth int) (interface{}, error) {
+	code, err := decoder.PeekCode()
+	if err != nil {
+		return nil, err
+	}
+	isArray := msgpcode.IsFixedArray(code) || code == msgpcode.Array16 || code == msgpcode.Array32
+	isMap := msgpcode.IsFixedMap(code) || code == msgpcode.Map16 || code == msgpcode.Map32
+	if !isArray && !isMap {
+		return decoder.DecodeInterface()
+	}
+	if depth >= maxDepth {
+		return nil, fmt.Errorf("arrays and maps are nested more than (%d) levels", maxDepth)
+	}
+	var n int
+	if isArray {
+		n, err = decoder.DecodeArrayLen()
+	} else {
+		n, err = decoder.DecodeMapLen()
+	}
+	if err != nil {
+		return nil, err
+	}
+	if n > *budget {
+		return nil, fmt.Errorf("message has more than (%d) array and map elements", maxElements)
+	}
+	*budget -= n
+
+	if isArray {
+		values := make([]interface{}, 0, n)
+		for i := 0; i < n; i++ {
+			value, err := decodeValue(decoder, budget, depth+1)
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, value)
+		}
+		return values, nil
+	}
+	values := make(map[string]interface{}, n)
+	for i := 0; i < n; i++ {
+		key, err := decodeValue(decoder, budget, depth+1)
+		if err != nil {
+			return nil, err
+		}
+		value, err := decodeValue(decoder, budget, depth+1)
+		if err != nil {
+			return nil, err
+		}
+		values[fmt.Sprint(normalize(key))] = value
+	}
+	return values, nil
+}
+
+// handshake authenticates the client with the shared key (HELO, PING and PONG messages)
+func handshake(decoder *msgpack.Decoder, encoder *msgpack.Encoder, conn net.Conn, sharedKey string) error {
+	err := conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, 16)
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return err
+	}
+	// User authentication is not supported (empty auth salt)
+	err = encoder.Encode([]interface{}{"HELO", map[string]interface{}{"nonce": nonce, "auth": "", "keepalive": true}})
+	if err != nil {
+		return fmt.Errorf("failed to send HELO: %w", err)
+	}
+
+	// ["PING", client hostname, shared key salt, shared key digest, username, password]
+	ping, err := decodeMessage(decoder)
+	if err != nil {
+		return fmt.Errorf("failed to read PING: %w", err)
+	}
+	if len(ping) < 4 || normalize(ping[0]) != "PING" {
+		return fmt.Errorf("invalid PING (%v)", ping)
+	}
+	hostname, _ := normalize(ping[1]).(string)
+	salt, _ := normalize(ping[2]).(string)
+	digest, _ := normalize(ping[3]).(string)
+	if subtle.ConstantTimeCompare([]byte(digest), []byte(sharedKeyDigest(salt, hostname, nonce, sharedKey))) != 1 {
+		// The reason is sent to the client like fluentd does
+		_ = encoder.Encode([]interface{}{"PONG", false, "shared_key mismatch", "", ""})
+		return fmt.Errorf("shared key mismatch (client hostname %s)", hostname)
+	}
+
+	// ["PONG", authenticated, reason, server hostname, shared key digest]
+	serverHostname, err := os.Hostname()
+	if err != nil {
+		serverHostname = "doctorgpt"
+	}
+	err = encoder.Encode([]interface{}{"PONG", true, "", serverHostname, sharedKeyDigest(salt, serverHostname, nonce, sharedKey)})
+	if err != nil {
+		return fmt.Errorf("failed to send PONG: %w", err)
+	}
+	return conn.SetDeadline(time.Time{})
+}
+
+// sharedKeyDigest is the hex SHA-512 of the salt, hostname, nonce and shared key
+func sharedKeyDigest(salt, hostname string, nonce []byte, sharedKey string) string {
+	h := sha512.New()
+	h.Write([]byte(salt))
+	h.Write([]byte(hostname))
+	h.Write(nonce)
+	h.Write([]byte(sharedKey))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func optionAt(message []interface{}, i int) map[string]interface{} {
+	if len(message) <= i {
+		return nil
+	}
+	option, _ := normalize(message[i]).(map[string]interface{})
+	return option
+}
+
+func newEntry(tag string, eventTime, record interface{}) (Entry, error) {
+	fields, ok := normalize(record).(map[string]interface{})
+	if !ok {
+		return Entry{}, fmt.Errorf("invalid record (%v)", record)
+	}
+	variables := map[string]string{
+		VariableTag:       tag,
+		VariableTimestamp: timestamp(eventTime),
+	}
+	flatten(VariableRecord, fields, variables)
+
+	for _, field := range messageFields {
+		text, ok := fields[field].(string)
+		if ok {
+			return Entry{Text: trimNewline(text), Variables: variables}, nil
+		}
+	}
+	// Structured records are kept as JSON (see the json parser)
+	data, err := json.Marshal(fields)
+	if err != nil {
+		return Entry{}, fmt.Errorf("invalid record (%v): %w", record, err)
+	}
+	return Entry{Text: string(data), Variables: variables}, nil
+}
+
+// timestamp of the event (integer seconds or EventTime)
+func timestamp(eventTime interface{}) string {
+	var t time.Time
+	switch v := eventTime.(type) {
+	case *EventTime:
+		t = v.Time
+	case float64:
+		t = time.Unix(0, int64(v*float64(time.Second)))
+	default:
+		seconds, err := strconv.ParseInt(fmt.Sprint(v), 10, 64)
+		if err != nil {
+			return ""
+		}
+		t = time.Unix(seconds, 0)
+	}
+	return t.UTC().Format(time.RFC3339Nano)
+}
+
+// normalize converts binary strings into strings and maps keyed by anything into maps keyed by strings
+func normalize(value interface{}) interface{} {
+	switch v := value.(type) {
+	case []byte:
+		return string(v)
+	case map[string]interface{}:
+		for key, child := range v {
+			v[key] = normalize(child)
+		}
+		return v
+	case map[interface{}]interface{}:
+		result := make(map[string]interface{}, len(v))
+		for key, child := range v {
+			result[fmt.Sprint(normalize(key))] = normalize(child)
+		}
+		return result
+	case []interface{}:
+		for i, child := range v {
+			v[i] = normalize(child)
+		}
+		return v
+	}
+	return value
+}
+
+// flatten stores every leaf value of a record under its dotted path
+func flatten(path string, value interface{}, result map[string]string) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, child := range v {
+			flatten(path+"."+key, child, result)
+		}
+	case []interface{}:
+		for i, child := range v {
+			flatten(path+"."+strconv.Itoa(i), child, result)
+		}
+	case string:
+		result[path] = trimNewline(v)
+	case nil:
+		result[path] = ""
+	default:
+		result[path] = fmt.Sprint(v)
+	}
+}
+
+func toBytes(value interface{}) []byte {
+	if s, ok := value.(string); ok {
+		return []byte(s)
+	}
+	return value.([]byte)
+}
+
+// trimNewline drops the line terminator kept by tailing inputs (e.g. Docker logs)
+func trimNewline(s string) string {
+	return strings.TrimRight(s, "\r\n")
+}
@@ -0,0 +1,207 @@
+package fluent
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/vmihailenco/msgpack/v5"
+	"go.uber.org/zap"
+
+	"github.com/ingyamilmolinar/doctorgpt/agent/internal/input"
+	"github.com/ingyamilmolinar/doctorgpt/agent/internal/tailer"
+)
+
+var logger, _ = zap.NewDevelopment()
+
+func TestListen(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	var mu sync.Mutex
+	received := map[string][]tailer.Line{}
+	demux := input.NewDemux(ctx, logger.Sugar(), input.DefaultMaxSources, input.DefaultSourceTTL, func(ctx context.Context, name string, lines <-chan tailer.Line) {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case line := <-lines:
+				mu.Lock()
+				received[name] = append(received[name], line)
+				mu.Unlock()
+			}
+		}
+	})
+	defer func() {
+		cancel()
+		demux.Wait()
+	}()
+	addr, err := Listen(ctx, logger.Sugar(), "127.0.0.1:0", nil, "", demux)
+	require.NoError(t, err)
+	conn, err := net.Dial("tcp", addr.String())
+	require.NoError(t, err)
+	defer conn.Close()
+	encoder := msgpack.NewEncoder(conn)
+	decoder := msgpack.NewDecoder(conn)
+
+	eventTime := &EventTime{time.Date(2023, 7, 22, 4, 26, 40, 500, time.UTC)}
+
+	// Message mode, acknowledged
+	err = encoder.Encode([]interface{}{"app.billing", 1690000000, map[string]interface{}{
+		"log":        "ERROR invoice failed\n",
+		"kubernetes": map[string]interface{}{"pod_name": "billing-0"},
+	}, map[string]interface{}{"chunk": "c1"}})
+	require.NoError(t, err)
+	var ack map[string]string
+	require.NoError(t, decoder.Decode(&ack))
+	require.Equal(t, map[string]string{"ack": "c1"}, ack)
+
+	// Forward mode
+	err = encoder.Encode([]interface{}{"app.checkout", []interface{}{
+		[]interface{}{eventTime, map[string]interface{}{"message": "INFO start"}},
+		[]interface{}{eventTime, map[string]interface{}{"level": "error", "code": 502}},
+	}})
+	require.NoError(t, err)
+
+	// CompressedPackedForward mode (Fluent Bit)
+	var packed bytes.Buffer
+	gz := gzip.NewWriter(&packed)
+	packer := msgpack.NewEncoder(gz)
+	require.NoError(t, packer.Encode([]interface{}{eventTime, map[string]interface{}{"log": []byte("INFO done")}}))
+	require.NoError(t, gz.Close())
+	err = encoder.Encode([]interface{}{"app.checkout", packed.Bytes(), map[string]interface{}{"compressed": "gzip", "size": 1}})
+	require.NoError(t, err)
+
+	// Every tag has its own line numbers
+	require.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(received["app.billing"]) == 1 && len(received["app.checkout"]) == 3
+	}, time.Second, 5*time.Millisecond)
+	mu.Lock()
+	defer mu.Unlock()
+	billing := received["app.billing"][0]
+	require.Equal(t, "ERROR invoice failed", billing.Text)
+	require.Equal(t, map[string]string{
+		"TAG":                        "app.billing",
+		"TIMESTAMP":                  "2023-07-22T04:26:40Z",
+		"RECORD.log":                 "ERROR invoice failed",
+		"RECORD.kubernetes.pod_name": "billing-0",
+	}, billing.Variables)
+	checkout := received["app.checkout"]
+	require.Equal(t, "INFO start", checkout[0].Text)
+	require.Equal(t, "2023-07-22T04:26:40.0000005Z", checkout[0].Variables["TIMESTAMP"])
+	require.Equal(t, `{"code":502,"level":"error"}`, checkout[1].Text)
+	require.Equal(t, "502", checkout[1].Variables["RECORD.code"])
+	require.Equal(t, "INFO done", checkout[2].Text)
+	require.Equal(t, 3, checkout[2].Position.Line)
+}
+
+func TestHandshake(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	received := make(chan tailer.Line, 1)
+	demux := input.NewDemux(ctx, logger.Sugar(), input.DefaultMaxSources, input.DefaultSourceTTL, func(ctx context.Context, name string, lines <-chan tailer.Line) {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case line := <-lines:
+				received <- line
+			}
+		}
+	})
+	defer func() {
+		cancel()
+		demux.Wait()
+	}()
+	addr, err := Listen(ctx, logger.Sugar(), "127.0.0.1:0", nil, "secret", demux)
+	require.NoError(t, err)
+
+	connect := func(sharedKey string) (net.Conn, *msgpack.Encoder, []interface{}) {
+		conn, err := net.Dial("tcp", addr.String())
+		require.NoError(t, err)
+		encoder := msgpack.NewEncoder(conn)
+		decoder := msgpack.NewDecoder(conn)
+		var helo []interface{}
+		require.NoError(t, decoder.Decode(&helo))
+		require.Equal(t, "HELO", helo[0])
+		nonce := helo[1].(map[string]interface{})["nonce"].([]byte)
+		err = encoder.Encode([]interface{}{"PING", "client", "salt", sharedKeyDigest("salt", "client", nonce, sharedKey), "", ""})
+		require.NoError(t, err)
+		var pong []interface{}
+		require.NoError(t, decoder.Decode(&pong))
+		if pong[1] == true {
+			require.Equal(t, sharedKeyDigest("salt", pong[3].(string), nonce, sharedKey), pong[4])
+		}
+		return conn, encoder, pong
+	}
+
+	// Wrong shared keys are rejected
+	conn, _, pong := connect("guess")
+	require.Equal(t, []interface{}{"PONG", false, "shared_key mismatch", "", ""}, pong)
+	_, err = conn.Read(make([]byte, 1))
+	require.ErrorIs(t, err, io.EOF)
+	conn.Close()
+
+	conn, encoder, pong := connect("secret")
+	defer conn.Close()
+	require.Equal(t, true, pong[1])
+	require.NoError(t, encoder.Encode([]interface{}{"app", 1690000000, map[string]interface{}{"log": "ERROR boom"}}))
+	select {
+	case line := <-received:
+		require.Equal(t, "ERROR boom", line.Text)
+	case <-time.After(time.Second):
+		t.Fatal("line not received")
+	}
+}
+
+func TestLimits(t *testing.T) {
+	decode := func(data []byte) error {
+		_, err := decodeMessage(msgpack.NewDecoder(bytes.NewReader(data)))
+		return err
+	}
+	// Lengths are checked before anything is allocated
+	require.ErrorContains(t, decode([]byte{0xdd, 0xff, 0xff, 0xff, 0xff}), "elements")
+	require.ErrorContains(t, decode([]byte{0xdf, 0x00, 0x20, 0x00, 0x00}), "elements")
+	// The elements of nested arrays add up
+	nested := []byte{0xdd, 0x00, 0x08, 0x00, 0x00}
+	for i := 0; i < 1<<19; i++ {
+		nested = append(nested, 0x92, 0xc0, 0xc0)
+	}
+	require.ErrorContains(t, decode(nested), "elements")
+	deep := bytes.Repeat([]byte{0x91}, maxDepth+1)
+	require.ErrorContains(t, decode(append(deep, 0xc0)), "nested")
+
+	// Decompressed events are bounded too
+	var packed bytes.Buffer
+	gz := gzip.NewWriter(&packed)
+	_, err := gz.Write(make([]byte, maxDecompressedSize+1))
+	require.NoError(t, err)
+	require.NoError(t, gz.Close())
+	_, _, _, err = Decode([]interface{}{"app", packed.Bytes(), map[string]interface{}{"compressed": "gzip"}})
+	require.ErrorContains(t, err, "larger than")
+
+	// Connections sending larger messages are closed
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	demux := input.NewDemux(ctx, logger.Sugar(), input.DefaultMaxSources, input.DefaultSourceTTL, func(ctx context.Context, name string, lines <-chan tailer.Line) {
+		<-ctx.Done()
+	})
+	addr, err := Listen(ctx, logger.Sugar(), "127.0.0.1:0", nil, "", demux)
+	require.NoError(t, err)
+	conn, err := net.Dial("tcp", addr.String())
+	require.NoError(t, err)
+	defer conn.Close()
+	go msgpack.NewEncoder(conn).Encode([]interface{}{"app", 1690000000, map[string]interface{}{"log": string(make([]byte, maxMessageSize))}})
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+	_, err = conn.Read(make([]byte, 1))
+	// Closed with unread data (reset) rather than timed out
+	require.Error(t, err)
+	require.False(t, errors.Is(err, os.ErrDeadlineExceeded))
+}
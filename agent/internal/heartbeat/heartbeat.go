@@ -0,0 +1,211 @@
+package heartbeat
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/ingyamilmolinar/doctorgpt/agent/internal/buffer"
+	"github.com/ingyamilmolinar/doctorgpt/agent/internal/clock"
+	"github.com/ingyamilmolinar/doctorgpt/agent/internal/parser"
+	"github.com/ingyamilmolinar/doctorgpt/agent/internal/tokenizer"
+)
+
+// Monitor detects the silences of the heartbeats of the parsers (see parser.Heartbeat).
+// It is shared by every log source, so a heartbeat fires once per silence (not once per
+// log source), and it is safe for concurrent use. Log sources are told apart by their
+// clock: silences are measured in the time of each one (archived logs are in the past).
+type Monitor struct {
+	mu    sync.Mutex
+	beats []*beat
+	log   *zap.SugaredLogger
+}
+
+type beat struct {
+	// Heartbeat number (starting at 1, used in diagnosis names)
+	id int
+	// Index of the parser whose entries the heartbeat matches
+	index     int
+	parser    parser.Parser
+	heartbeat parser.Heartbeat
+	// Time of the last match (or of the start of the log source) in the time of every log source watched
+	lastSeen map[*clock.Clock]time.Time
+	// Log source that last matched the heartbeat (or that was last observed)
+	source string
+	// Last log entry and lines (of any parser) of the log sources watched
+	lastEntry parser.LogEntry
+	lines     *buffer.LogBuffer
+	// The silence was already diagnosed (the heartbeat fires again after its next match)
+	fired bool
+}
+
+// Silence of a heartbeat longer than its interval
+type Silence struct {
+	Parser    parser.Parser
+	Heartbeat parser.Heartbeat
+	// Heartbeat number and log source the silence is named after
+	ID     int
+	Source string
+	// Time the silence was detected
+	Time time.Time
+	// Time of the last matching log entry (or of the start of the monitoring)
+	LastSeen time.Time
+	Duration time.Duration
+	// Last log entry before the silence was detected
+	LastEntry parser.LogEntry
+	// Last log lines before the silence
+	Lines []parser.LogEntry
+}
+
+// NewMonitor returns the heartbeats of the parsers. Diagnoses fit in maxTokens.
+func NewMonitor(log *zap.SugaredLogger, parsers []parser.Parser, maxTokens int, count tokenizer.Counter) *Monitor {
+	m := &Monitor{log: log}
+	for i, p := range parsers {
+		for _, h := range p.Heartbeats {
+			m.beats = append(m.beats, &beat{
+				id:        len(m.beats) + 1,
+				index:     i,
+				parser:    p,
+				heartbeat: h,
+				lastSeen:  make(map[*clock.Clock]time.Time),
+				lines:     buffer.NewLogBuffer(log, h.Lines, maxTokens, count),
+			})
+		}
+	}
+	return m
+}
+
+// Start starts the heartbeats for a log source (its clock): they are silent from now on until they match
+func (m *Monitor) Start(logClock *clock.Clock) {
+	if m == nil || len(m.beats) == 0 {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := logClock.Now()
+	for _, b := range m.beats {
+		b.lastSeen[logClock] = now
+	}
+}
+
+// Stop stops the heartbeats for a log source that ended (its clock)
+func (m *Monitor) Stop(logClock *clock.Clock) {
+	if m == nil || len(m.beats) == 0 {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, b := range m.beats {
+		delete(b.lastSeen, logClock)
+	}
+}
+
+// Observe records a log entry of the named log source (whose clock tells its time)
+// matched by the parser (its index)
+func (m *Monitor) Observe(source string, logClock *clock.Clock, index int, entry parser.LogEntry) {
+	if m == nil || len(m.beats) == 0 {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := logClock.Now()
+	for _, b := range m.beats {
+		// The clock of archived logs starts in the past (see clock.Clock)
+		if lastSeen, ok := b.lastSeen[logClock]; !ok || now.Before(lastSeen) {
+			b.lastSeen[logClock] = now
+		}
+		if !b.heartbeat.Watches(source) {
+			continue
+		}
+		if !entry.Excluded {
+			b.lastEntry = entry
+			b.lines.Append(entry)
+		}
+		if b.source == "" {
+			b.source = source
+		}
+		if b.index != index || !b.heartbeat.Matcher.Match(entry, now) {
+			continue
+		}
+		m.log.Debugf("Heartbeat (%s) matched in (%s): (%s)", b.heartbeat.Description, source, entry.Text)
+		// A match in any log source counts for all of them (each one in its own time)
+		for other := range b.lastSeen {
+			b.lastSeen[other] = other.Now()
+		}
+		b.lastSeen[logClock] = now
+		b.source = source
+		b.fired = false
+	}
+}
+
+// Silent returns the heartbeats silent for longer than their interval in the time of
+// a log source (its clock), once per silence
+func (m *Monitor) Silent(logClock *clock.Clock) []Silence {
+	if m == nil || len(m.beats) == 0 {
+		return nil
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := logClock.Now()
+	var silences []Silence
+	for _, b := range m.beats {
+		lastSeen, ok := b.lastSeen[logClock]
+		if !ok {
+			continue
+		}
+		silence := now.Sub(lastSeen)
+		if b.fired || silence <= b.heartbeat.Interval {
+			continue
+		}
+		b.fired = true
+		m.log.Infof("Heartbeat (%s) silent for (%s)", b.heartbeat.Description, silence.Round(time.Second))
+		silences = append(silences, Silence{
+			Parser:    b.parser,
+			Heartbeat: b.heartbeat,
+			ID:        b.id,
+			Source:    b.source,
+			Time:      now,
+			LastSeen:  lastSeen,
+			Duration:  silence,
+			LastEntry: b.lastEntry,
+			Lines:     b.lines.Dump(),
+		})
+	}
+	return silences
+}
+
+// Name of the diagnosis of the silence: the log source plus a heartbeat suffix (silences
+// are not located at a log line, so their names never collide with those of triggers)
+func (s Silence) Name() string {
+	name := fmt.Sprintf("heartbeat-%d-%s", s.ID, s.Time.UTC().Format("20060102T150405Z"))
+	if s.Source == "" {
+		return name
+	}
+	return s.Source + ":" + name
+}
+
+// Entry is the log entry diagnosed for the silence (not located at any log line)
+func (s Silence) Entry() parser.LogEntry {
+	return parser.LogEntry{
+		Parser:    &s.Parser,
+		Triggered: true,
+		Text:      s.summary(),
+	}
+}
+
+// Context is the prompt context of the silence: a summary and the last log lines
+// before it (the most recent ones fitting in maxTokens)
+func (s Silence) Context(log *zap.SugaredLogger, maxTokens int, count tokenizer.Counter) []parser.LogEntry {
+	header := []parser.LogEntry{
+		{Text: s.summary()},
+		{Text: fmt.Sprintf("LAST LOG ENTRIES (last match at %s):", s.LastSeen.Format(time.RFC3339))},
+	}
+	lines := buffer.Trim(log, s.Lines, maxTokens-count(parser.Stringify(header)), count)
+	return append(header, lines...)
+}
+
+func (s Silence) summary() string {
+	return fmt.Sprintf("ABSENCE TRIGGER: no log entry matching (%s) for %s (interval: %s)", s.Heartbeat.Description, s.Duration.Round(time.Second), s.Heartbeat.Interval)
+}
@@ -0,0 +1,165 @@
+package heartbeat
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/ingyamilmolinar/doctorgpt/agent/internal/clock"
+	"github.com/ingyamilmolinar/doctorgpt/agent/internal/config"
+	"github.com/ingyamilmolinar/doctorgpt/agent/internal/parser"
+	"github.com/ingyamilmolinar/doctorgpt/agent/internal/tokenizer"
+)
+
+func TestMonitor(t *testing.T) {
+	log := zap.NewNop().Sugar()
+	jobParser, err := parser.NewParserFromConfig(log, config.ParserConfig{
+		Regex: `^(?P<MESSAGE>.*)$`,
+		Heartbeats: []config.HeartbeatConfig{
+			{Matcher: config.VariableMatcher{Expression: `MESSAGE =~ "processed batch"`}, Interval: time.Minute, Lines: 2},
+		},
+	}, nil)
+	require.NoError(t, err)
+	otherParser, err := parser.NewParser(log, `^other (?P<MESSAGE>.*)$`, nil, nil, nil)
+	require.NoError(t, err)
+	parse := func(text string) (parser.LogEntry, int) {
+		entry, matched, err := parser.ParseLogEntry(log, []parser.Parser{otherParser, jobParser}, text, 1)
+		require.NoError(t, err)
+		return entry, matched
+	}
+
+	start := time.Date(2023, 7, 22, 12, 0, 0, 0, time.UTC)
+	// Clocks are moved by the time of log entries (and by the wall clock, hence the seconds rounding)
+	at := func(c *clock.Clock, t time.Time) *clock.Clock {
+		c.Observe(t)
+		return c
+	}
+	jobClock := at(clock.New(), start)
+	m := NewMonitor(log, []parser.Parser{otherParser, jobParser}, 1000, tokenizer.Approximate)
+	m.Start(jobClock)
+	// Silent from the start of the log source
+	require.Empty(t, m.Silent(at(jobClock, start.Add(59*time.Second))))
+	silences := m.Silent(at(jobClock, start.Add(61*time.Second)))
+	require.Len(t, silences, 1)
+	require.Equal(t, 61*time.Second, silences[0].Duration.Round(time.Second))
+	// Once per silence
+	require.Empty(t, m.Silent(at(jobClock, start.Add(time.Hour))))
+
+	// Matches of other parsers do not count
+	entry, matched := parse("other processed batch")
+	m.Observe("job.log", jobClock, matched, entry)
+	require.Empty(t, m.Silent(at(jobClock, start.Add(2*time.Hour))))
+	entry, matched = parse("processed batch")
+	m.Observe("job.log", jobClock, matched, entry)
+	at(jobClock, start.Add(2*time.Hour+time.Second))
+	for _, text := range []string{"waiting", "still waiting"} {
+		entry, matched = parse(text)
+		m.Observe("job.log", jobClock, matched, entry)
+	}
+	require.Empty(t, m.Silent(at(jobClock, start.Add(2*time.Hour+59*time.Second))))
+	silences = m.Silent(at(jobClock, start.Add(2*time.Hour+2*time.Minute)))
+	require.Len(t, silences, 1)
+	require.Equal(t, start.Add(2*time.Hour), silences[0].LastSeen.Round(time.Second))
+	require.Equal(t, "still waiting", silences[0].LastEntry.Text)
+
+	context := silences[0].Context(log, 1000, tokenizer.Approximate)
+	require.Len(t, context, 4)
+	require.Equal(t, `ABSENCE TRIGGER: no log entry matching (MESSAGE =~ "processed batch") for 2m0s (interval: 1m0s)`, context[0].Text)
+	require.Equal(t, "waiting", context[2].Text)
+	require.Equal(t, "still waiting", context[3].Text)
+	require.True(t, silences[0].Entry().Triggered)
+	require.Equal(t, "job.log:heartbeat-1-20230722T140200Z", silences[0].Name())
+
+	// Archived logs move the clock back to their time
+	m = NewMonitor(log, []parser.Parser{otherParser, jobParser}, 1000, tokenizer.Approximate)
+	archivedClock := clock.New()
+	m.Start(archivedClock)
+	entry, matched = parse("waiting")
+	m.Observe("job.log", at(archivedClock, start.Add(-time.Hour)), matched, entry)
+	require.Empty(t, m.Silent(at(archivedClock, start.Add(-time.Hour+59*time.Second))))
+	require.Len(t, m.Silent(at(archivedClock, start.Add(-time.Hour+2*time.Minute))), 1)
+
+	// Heartbeats scoped to log sources ignore the entries of the other ones
+	scopedParser, err := parser.NewParserFromConfig(log, config.ParserConfig{
+		Regex: `^(?P<MESSAGE>.*)$`,
+		Heartbeats: []config.HeartbeatConfig{
+			{Matcher: config.VariableMatcher{Expression: `MESSAGE =~ "processed batch"`}, Interval: time.Minute, Source: "job-*.log"},
+		},
+	}, nil)
+	require.NoError(t, err)
+	m = NewMonitor(log, []parser.Parser{scopedParser}, 1000, tokenizer.Approximate)
+	sourceClock := at(clock.New(), start)
+	m.Start(sourceClock)
+	entry, matched, err = parser.ParseLogEntry(log, []parser.Parser{scopedParser}, "processed batch", 1)
+	require.NoError(t, err)
+	m.Observe("/var/log/other.log", at(sourceClock, start.Add(time.Minute)), matched, entry)
+	silences = m.Silent(at(sourceClock, start.Add(2*time.Minute)))
+	require.Len(t, silences, 1)
+	require.Equal(t, "heartbeat-1-20230722T120200Z", silences[0].Name())
+	m.Observe("/var/log/job-2.log", at(sourceClock, start.Add(3*time.Minute)), matched, entry)
+	require.Empty(t, m.Silent(at(sourceClock, start.Add(3*time.Minute+59*time.Second))))
+	// Shared by the log sources: a single silence for all of them
+	silences = m.Silent(at(sourceClock, start.Add(5*time.Minute)))
+	require.Len(t, silences, 1)
+	require.Equal(t, "/var/log/job-2.log:heartbeat-1-20230722T120500Z", silences[0].Name())
+	require.Empty(t, m.Silent(at(sourceClock, start.Add(6*time.Minute))))
+
+	// Invalid source globs
+	_, err = parser.NewParserFromConfig(log, config.ParserConfig{
+		Regex:      `^(?P<MESSAGE>.*)$`,
+		Heartbeats: []config.HeartbeatConfig{{Matcher: config.VariableMatcher{Expression: `MESSAGE =~ "batch"`}, Interval: time.Minute, Source: "["}},
+	}, nil)
+	require.Error(t, err)
+}
+
+func TestMonitorClocks(t *testing.T) {
+	log := zap.NewNop().Sugar()
+	jobParser, err := parser.NewParserFromConfig(log, config.ParserConfig{
+		Regex: `^(?P<MESSAGE>.*)$`,
+		Heartbeats: []config.HeartbeatConfig{
+			{Matcher: config.VariableMatcher{Expression: `MESSAGE =~ "processed batch"`}, Interval: time.Minute},
+		},
+	}, nil)
+	require.NoError(t, err)
+	parse := func(text string) (parser.LogEntry, int) {
+		entry, matched, err := parser.ParseLogEntry(log, []parser.Parser{jobParser}, text, 1)
+		require.NoError(t, err)
+		return entry, matched
+	}
+	m := NewMonitor(log, []parser.Parser{jobParser}, 1000, tokenizer.Approximate)
+
+	// A live log source (wall clock) and an archived one (in the past)
+	live := clock.New()
+	archived := clock.New()
+	archived.Observe(time.Date(2023, 7, 22, 12, 0, 0, 0, time.UTC))
+	m.Start(live)
+	m.Start(archived)
+
+	// The entries of the archived log source do not move the heartbeat back for the live one
+	entry, matched := parse("waiting")
+	m.Observe("old.log", archived, matched, entry)
+	require.Empty(t, m.Silent(live))
+	require.Empty(t, m.Silent(archived))
+
+	// The archived log source is silent in its own time (once for every log source)
+	archived.Observe(time.Date(2023, 7, 22, 12, 2, 0, 0, time.UTC))
+	silences := m.Silent(archived)
+	require.Len(t, silences, 1)
+	require.Equal(t, 2*time.Minute, silences[0].Duration.Round(time.Second))
+	require.Empty(t, m.Silent(live))
+
+	// A match in the live log source counts for the archived one as well
+	entry, matched = parse("processed batch")
+	m.Observe("new.log", live, matched, entry)
+	archived.Observe(time.Date(2023, 7, 22, 12, 2, 59, 0, time.UTC))
+	require.Empty(t, m.Silent(archived))
+	archived.Observe(time.Date(2023, 7, 22, 12, 3, 1, 0, time.UTC))
+	require.Len(t, m.Silent(archived), 1)
+
+	// Log sources that ended are no longer watched
+	m.Stop(archived)
+	archived.Observe(time.Date(2023, 7, 22, 13, 0, 0, 0, time.UTC))
+	require.Empty(t, m.Silent(archived))
+}
@@ -0,0 +1,130 @@
+package ingest
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/ingyamilmolinar/doctorgpt/agent/internal/input"
+)
+
+// Path the log lines of a stream are pushed to (followed by the stream name)
+const Path = "/logs/"
+
+// Max size of a request body
+const maxBodySize = 10 * 1024 * 1024
+
+// Time given to running requests to finish on shutdown
+const shutdownTimeout = 5 * time.Second
+
+// Serve serves the handler over HTTP until ctx is done. It returns the address it listens on.
+func Serve(ctx context.Context, log *zap.SugaredLogger, addr string, handler http.Handler) (net.Addr, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen for log lines: %w", err)
+	}
+	log.Infof("Listening for log lines on (http://%s)", listener.Addr())
+	server := &http.Server{
+		Handler:           handler,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		server.Shutdown(shutdownCtx)
+	}()
+	go func() {
+		err := server.Serve(listener)
+		if !errors.Is(err, http.ErrServerClosed) {
+			log.Errorf("Failed to serve log lines: %v", err)
+		}
+	}()
+	return listener.Addr(), nil
+}
+
+// Handler accepts log lines pushed to /logs/<stream> as newline delimited text or as a JSON
+// array (of strings, or of objects which are kept as JSON lines). Every stream is monitored
+// on its own. Requests must carry the bearer token (if any).
+func Handler(log *zap.SugaredLogger, demux *input.Demux, token string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if token != "" && r.Header.Get("Authorization") != "Bearer "+token {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		stream := strings.Trim(strings.TrimPrefix(r.URL.Path, Path), "/")
+		if stream == "" {
+			http.Error(w, "missing stream name", http.StatusNotFound)
+			return
+		}
+
+		lines, err := readLines(http.MaxBytesReader(w, r.Body, maxBodySize), r.Header.Get("Content-Type"))
+		if err != nil {
+			log.Debugf("Invalid log lines for stream (%s): %v", stream, err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		for _, line := range lines {
+			if !demux.Send(stream, line, nil) {
+				http.Error(w, "stream is no longer monitored", http.StatusServiceUnavailable)
+				return
+			}
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+func readLines(body io.Reader, contentType string) ([]string, error) {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	if mediaType == "application/json" {
+		var raw []json.RawMessage
+		err := json.NewDecoder(body).Decode(&raw)
+		if err != nil {
+			return nil, fmt.Errorf("invalid JSON array of log lines: %w", err)
+		}
+		lines := make([]string, 0, len(raw))
+		for _, r := range raw {
+			var line string
+			if json.Unmarshal(r, &line) == nil {
+				lines = append(lines, line)
+				continue
+			}
+			// Structured log lines are kept as (single line) JSON, see the json parser
+			var compact bytes.Buffer
+			err = json.Compact(&compact, r)
+			if err != nil {
+				return nil, fmt.Errorf("invalid JSON log line: %w", err)
+			}
+			lines = append(lines, compact.String())
+		}
+		return lines, nil
+	}
+
+	var lines []string
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 64*1024), maxBodySize)
+	for scanner.Scan() {
+		lines = append(lines, strings.TrimSuffix(scanner.Text(), "\r"))
+	}
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(scanner.Err(), &maxBytesErr) {
+		return nil, fmt.Errorf("request body is larger than %d bytes", maxBodySize)
+	}
+	return lines, scanner.Err()
+}
@@ -0,0 +1,84 @@
+package ingest
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/ingyamilmolinar/doctorgpt/agent/internal/input"
+	"github.com/ingyamilmolinar/doctorgpt/agent/internal/tailer"
+)
+
+var logger, _ = zap.NewDevelopment()
+
+func TestHandler(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	var mu sync.Mutex
+	received := map[string][]tailer.Line{}
+	demux := input.NewDemux(ctx, logger.Sugar(), input.DefaultMaxSources, input.DefaultSourceTTL, func(ctx context.Context, name string, lines <-chan tailer.Line) {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case line := <-lines:
+				mu.Lock()
+				received[name] = append(received[name], line)
+				mu.Unlock()
+			}
+		}
+	})
+	defer func() {
+		cancel()
+		demux.Wait()
+	}()
+	server := httptest.NewServer(Handler(logger.Sugar(), demux, "secret"))
+	defer server.Close()
+
+	post := func(path, contentType, body, token string) int {
+		req, err := http.NewRequest(http.MethodPost, server.URL+path, strings.NewReader(body))
+		require.NoError(t, err)
+		req.Header.Set("Content-Type", contentType)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	require.Equal(t, http.StatusNoContent, post("/logs/checkout", "text/plain", "INFO start\r\nERROR boom\n", "secret"))
+	require.Equal(t, http.StatusNoContent, post("/logs/billing", "application/json; charset=utf-8", `["INFO start", {"level": "error",
+		"msg": "boom"}]`, "secret"))
+	require.Equal(t, http.StatusNoContent, post("/logs/checkout", "text/plain", "INFO done", "secret"))
+
+	// Invalid requests
+	require.Equal(t, http.StatusUnauthorized, post("/logs/checkout", "text/plain", "INFO", ""))
+	require.Equal(t, http.StatusNotFound, post("/logs/", "text/plain", "INFO", "secret"))
+	require.Equal(t, http.StatusBadRequest, post("/logs/billing", "application/json", `{"not": "an array"}`, "secret"))
+	resp, err := http.Get(server.URL + "/logs/checkout")
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+
+	// Every stream has its own line numbers
+	require.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(received["checkout"]) == 3 && len(received["billing"]) == 2
+	}, time.Second, 5*time.Millisecond)
+	mu.Lock()
+	defer mu.Unlock()
+	require.Equal(t, "ERROR boom", received["checkout"][1].Text)
+	require.Equal(t, 3, received["checkout"][2].Position.Line)
+	require.Equal(t, "checkout", received["checkout"][2].File)
+	require.Equal(t, `{"level":"error","msg":"boom"}`, received["billing"][1].Text)
+	require.Equal(t, 2, received["billing"][1].Position.Line)
+}
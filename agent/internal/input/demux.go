@@ -0,0 +1,216 @@
+package input
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/ingyamilmolinar/doctorgpt/agent/internal/tailer"
+)
+
+// Lines waiting to be monitored per source before senders are slowed down
+const sourceBufferSize = 1024
+
+// Defaults of the source limits (source names are chosen by the senders)
+const (
+	DefaultMaxSources = 1000
+	DefaultSourceTTL  = time.Hour
+)
+
+// Monitor is started once per source and must return when ctx is done
+type Monitor func(ctx context.Context, name string, lines <-chan tailer.Line)
+
+// Demux splits the lines received from many senders (e.g. syslog hosts) into one
+// source per sender, each one with its own monitor and line numbers. Sources idle for
+// longer than a TTL are stopped, and so are sources whose monitor returned (both are
+// started again by their next line).
+type Demux struct {
+	ctx     context.Context
+	monitor Monitor
+	// Most sources monitored at once (0 means no limit) and idle time before they are stopped
+	maxSources int
+	ttl        time.Duration
+	mu         sync.Mutex
+	sources    map[string]*source
+	// The source limit was reached (logged once until a source can be started again)
+	full   bool
+	wg     sync.WaitGroup
+	logger *zap.SugaredLogger
+}
+
+type source struct {
+	mu     sync.Mutex
+	lines  chan tailer.Line
+	done   chan struct{}
+	cancel context.CancelFunc
+	count  int
+	// No line is sent to a stopped source (its monitor may be gone)
+	stopped bool
+	// Time of the last line (unix nanoseconds)
+	lastSeen atomic.Int64
+}
+
+// NewDemux returns a Demux monitoring up to maxSources sources (0 means no limit),
+// stopping the ones that did not receive any line for ttl (0 means never)
+func NewDemux(ctx context.Context, log *zap.SugaredLogger, maxSources int, ttl time.Duration, monitor Monitor) *Demux {
+	d := &Demux{
+		ctx:        ctx,
+		monitor:    monitor,
+		maxSources: maxSources,
+		ttl:        ttl,
+		sources:    make(map[string]*source),
+		logger:     log,
+	}
+	if ttl > 0 {
+		d.wg.Add(1)
+		go d.evictLoop()
+	}
+	return d
+}
+
+// Send hands a line to the monitor of the named source (starting it if necessary).
+// It returns false if the line was dropped because the source could not be monitored.
+func (d *Demux) Send(name, text string, variables map[string]string) bool {
+	// A source stopped in the meantime is started again (once)
+	for attempt := 0; attempt < 2; attempt++ {
+		src, ok := d.source(name)
+		if !ok {
+			return false
+		}
+		sent, stopped := d.send(src, name, text, variables)
+		if !stopped {
+			return sent
+		}
+		// Its monitor may not have removed it yet
+		d.remove(name, src)
+	}
+	return false
+}
+
+func (d *Demux) send(src *source, name, text string, variables map[string]string) (bool, bool) {
+	src.mu.Lock()
+	defer src.mu.Unlock()
+	if src.stopped {
+		return false, true
+	}
+	src.lastSeen.Store(time.Now().UnixNano())
+	src.count++
+	line := tailer.Line{
+		Text:      text,
+		File:      name,
+		Position:  tailer.Position{Line: src.count},
+		Variables: variables,
+	}
+	select {
+	case src.lines <- line:
+		return true, false
+	case <-src.done:
+		return false, true
+	case <-d.ctx.Done():
+		return false, false
+	}
+}
+
+// Wait blocks until every monitor has returned (which happens once ctx is done)
+func (d *Demux) Wait() {
+	d.wg.Wait()
+}
+
+// Len returns how many sources are monitored
+func (d *Demux) Len() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return len(d.sources)
+}
+
+func (d *Demux) source(name string) (*source, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	src, ok := d.sources[name]
+	if ok {
+		return src, true
+	}
+	if d.ctx.Err() != nil {
+		return nil, false
+	}
+	if d.maxSources > 0 && len(d.sources) >= d.maxSources {
+		if !d.full {
+			d.logger.Warnf("Too many log sources (%d), dropping the lines of new ones like (%s)", len(d.sources), name)
+			d.full = true
+		}
+		return nil, false
+	}
+	d.full = false
+	d.logger.Infof("Monitoring new log source (%s)", name)
+	ctx, cancel := context.WithCancel(d.ctx)
+	src = &source{
+		lines:  make(chan tailer.Line, sourceBufferSize),
+		done:   make(chan struct{}),
+		cancel: cancel,
+	}
+	src.lastSeen.Store(time.Now().UnixNano())
+	d.sources[name] = src
+	d.wg.Add(1)
+	go func() {
+		defer d.wg.Done()
+		d.monitor(ctx, name, src.lines)
+		cancel()
+		// Unblock senders waiting on a full buffer first (they hold the lock of the source)
+		close(src.done)
+		// Lines sent from now on start the source again
+		src.mu.Lock()
+		src.stopped = true
+		src.mu.Unlock()
+		d.remove(name, src)
+	}()
+	return src, true
+}
+
+// remove drops the source from the map (unless it was replaced already)
+func (d *Demux) remove(name string, src *source) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.sources[name] == src {
+		delete(d.sources, name)
+	}
+}
+
+func (d *Demux) evictLoop() {
+	defer d.wg.Done()
+	interval := d.ttl / 2
+	if interval > time.Minute {
+		interval = time.Minute
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-d.ctx.Done():
+			return
+		case now := <-ticker.C:
+			d.evict(now)
+		}
+	}
+}
+
+// evict stops the sources idle for longer than the TTL
+func (d *Demux) evict(now time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for name, src := range d.sources {
+		// Sources busy sending a line are not idle
+		if !src.mu.TryLock() {
+			continue
+		}
+		if now.Sub(time.Unix(0, src.lastSeen.Load())) > d.ttl {
+			d.logger.Infof("Stopping idle log source (%s)", name)
+			src.stopped = true
+			src.cancel()
+			delete(d.sources, name)
+		}
+		src.mu.Unlock()
+	}
+}
@@ -0,0 +1,151 @@
+package input
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/ingyamilmolinar/doctorgpt/agent/internal/tailer"
+)
+
+var logger, _ = zap.NewDevelopment()
+
+// recorder monitors sources, returning after a line with the text "exit"
+type recorder struct {
+	mu       sync.Mutex
+	lines    map[string][]tailer.Line
+	started  map[string]int
+	returned map[string]int
+}
+
+func newRecorder() *recorder {
+	return &recorder{lines: map[string][]tailer.Line{}, started: map[string]int{}, returned: map[string]int{}}
+}
+
+func (r *recorder) monitor(ctx context.Context, name string, lines <-chan tailer.Line) {
+	r.mu.Lock()
+	r.started[name]++
+	r.mu.Unlock()
+	defer func() {
+		r.mu.Lock()
+		r.returned[name]++
+		r.mu.Unlock()
+	}()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case line := <-lines:
+			r.mu.Lock()
+			r.lines[name] = append(r.lines[name], line)
+			r.mu.Unlock()
+			if line.Text == "exit" {
+				return
+			}
+		}
+	}
+}
+
+func (r *recorder) count(m map[string]int, name string) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return m[name]
+}
+
+func TestDemux(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	r := newRecorder()
+	// Eviction is triggered by hand below
+	demux := NewDemux(ctx, logger.Sugar(), 2, 0, r.monitor)
+	demux.ttl = time.Minute
+	defer func() {
+		cancel()
+		demux.Wait()
+	}()
+
+	require.True(t, demux.Send("a", "one", nil))
+	require.True(t, demux.Send("b", "one", nil))
+	// Sources over the limit are refused
+	require.False(t, demux.Send("c", "one", nil))
+	require.Equal(t, 2, demux.Len())
+
+	// Idle sources are stopped, making room for new ones
+	demux.evict(time.Now().Add(30 * time.Second))
+	require.Equal(t, 2, demux.Len())
+	demux.evict(time.Now().Add(2 * time.Minute))
+	require.Equal(t, 0, demux.Len())
+	require.Eventually(t, func() bool { return r.count(r.returned, "a") == 1 && r.count(r.returned, "b") == 1 }, time.Second, 5*time.Millisecond)
+	require.True(t, demux.Send("c", "one", nil))
+	require.True(t, demux.Send("a", "two", nil))
+	require.Eventually(t, func() bool { return r.count(r.started, "a") == 2 }, time.Second, 5*time.Millisecond)
+
+	// Sources whose monitor returned are started again by their next line
+	require.True(t, demux.Send("c", "exit", nil))
+	require.Eventually(t, func() bool { return r.count(r.returned, "c") == 1 && demux.Len() == 1 }, time.Second, 5*time.Millisecond)
+	require.True(t, demux.Send("c", "two", nil))
+	require.Eventually(t, func() bool {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		return len(r.lines["c"]) == 3
+	}, time.Second, 5*time.Millisecond)
+	r.mu.Lock()
+	require.Equal(t, "two", r.lines["c"][2].Text)
+	// Line numbers start over with the source
+	require.Equal(t, 1, r.lines["c"][2].Position.Line)
+	r.mu.Unlock()
+}
+
+func TestDemuxMonitorReturnsWithFullBuffer(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	release := make(chan struct{})
+	var mu sync.Mutex
+	started := 0
+	// The first monitor returns without reading any line, the next ones read every line
+	monitor := func(ctx context.Context, name string, lines <-chan tailer.Line) {
+		mu.Lock()
+		started++
+		first := started == 1
+		mu.Unlock()
+		if first {
+			<-release
+			return
+		}
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-lines:
+			}
+		}
+	}
+	demux := NewDemux(ctx, logger.Sugar(), 0, 0, monitor)
+	defer func() {
+		cancel()
+		demux.Wait()
+	}()
+
+	for i := 0; i < sourceBufferSize; i++ {
+		require.True(t, demux.Send("a", "line", nil))
+	}
+	sent := make(chan bool)
+	go func() {
+		sent <- demux.Send("a", "blocked", nil)
+	}()
+	close(release)
+	// The line goes to the source started again
+	select {
+	case ok := <-sent:
+		require.True(t, ok)
+	case <-time.After(3 * time.Second):
+		t.Fatal("Send blocked after the monitor returned")
+	}
+	require.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return started == 2
+	}, time.Second, 5*time.Millisecond)
+}
@@ -0,0 +1,183 @@
+package journal
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/ingyamilmolinar/doctorgpt/agent/internal/parser"
+)
+
+const extension = ".json"
+
+// Records are written to a temporary file first (left behind by crashes while saving)
+const tmpExtension = ".tmp"
+
+// Records that could not be processed are moved here
+const failedDir = "failed"
+
+// Record holds everything needed to (re)run a diagnosis
+type Record struct {
+	ID        string            `json:"id"`
+	FileName  string            `json:"fileName"`
+	OutputDir string            `json:"outputDir"`
+	Model     string            `json:"model"`
+	Entry     parser.LogEntry   `json:"entry"`
+	Context   []parser.LogEntry `json:"context"`
+	Attempts  int               `json:"attempts"`
+}
+
+// Journal persists records as one JSON file each under a directory
+type Journal struct {
+	dir    string
+	seq    uint64
+	logger *zap.SugaredLogger
+}
+
+func Open(log *zap.SugaredLogger, dir string) (*Journal, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create journal directory: %w", err)
+	}
+	tmps, err := filepath.Glob(filepath.Join(dir, "*"+extension+tmpExtension))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read journal directory: %w", err)
+	}
+	for _, tmp := range tmps {
+		log.Warnf("Removing incomplete journal record (%s)", tmp)
+		err = os.Remove(tmp)
+		if err != nil {
+			return nil, fmt.Errorf("failed to remove incomplete journal record: %w", err)
+		}
+	}
+	return &Journal{
+		dir:    dir,
+		logger: log,
+	}, nil
+}
+
+// NewID returns a unique and time ordered record ID
+func (j *Journal) NewID() string {
+	return fmt.Sprintf("%020d-%06d", time.Now().UnixNano(), atomic.AddUint64(&j.seq, 1))
+}
+
+// Save atomically and durably writes the record (assigning an ID if it has none)
+func (j *Journal) Save(record *Record) error {
+	if record.ID == "" {
+		record.ID = j.NewID()
+	}
+	bytes, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("failed to encode journal record: %w", err)
+	}
+	tmp := j.path(record.ID) + tmpExtension
+	err = writeFileSync(tmp, bytes)
+	if err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to write journal record: %w", err)
+	}
+	err = os.Rename(tmp, j.path(record.ID))
+	if err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to write journal record: %w", err)
+	}
+	// The rename is only durable once the directory is
+	err = syncDir(j.dir)
+	if err != nil {
+		return fmt.Errorf("failed to write journal record: %w", err)
+	}
+	j.logger.Debugf("Saved journal record (%s)", record.ID)
+	return nil
+}
+
+// writeFileSync writes the file and flushes it to disk
+func writeFileSync(name string, bytes []byte) error {
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(bytes)
+	if err == nil {
+		err = f.Sync()
+	}
+	closeErr := f.Close()
+	if err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+func (j *Journal) Remove(id string) error {
+	err := os.Remove(j.path(id))
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove journal record: %w", err)
+	}
+	j.logger.Debugf("Removed journal record (%s)", id)
+	return nil
+}
+
+// Fail moves the record to the failed directory so that it is kept but not loaded again
+func (j *Journal) Fail(record Record) error {
+	failed := &Journal{
+		dir:    filepath.Join(j.dir, failedDir),
+		logger: j.logger,
+	}
+	err := os.MkdirAll(failed.dir, 0755)
+	if err != nil {
+		return fmt.Errorf("failed to create failed journal directory: %w", err)
+	}
+	err = failed.Save(&record)
+	if err != nil {
+		return err
+	}
+	return j.Remove(record.ID)
+}
+
+// Load returns every record in the journal (oldest first)
+func (j *Journal) Load() ([]Record, error) {
+	files, err := os.ReadDir(j.dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read journal directory: %w", err)
+	}
+	var records []Record
+	for _, file := range files {
+		if file.IsDir() || !strings.HasSuffix(file.Name(), extension) {
+			continue
+		}
+		bytes, err := os.ReadFile(filepath.Join(j.dir, file.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read journal record: %w", err)
+		}
+		var record Record
+		err = json.Unmarshal(bytes, &record)
+		if err != nil {
+			j.logger.Errorf("Skipping corrupted journal record (%s): %v", file.Name(), err)
+			continue
+		}
+		records = append(records, record)
+	}
+	sort.Slice(records, func(a, b int) bool {
+		return records[a].ID < records[b].ID
+	})
+	return records, nil
+}
+
+func (j *Journal) path(id string) string {
+	return filepath.Join(j.dir, id+extension)
+}
@@ -0,0 +1,99 @@
+package journal
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/ingyamilmolinar/doctorgpt/agent/internal/parser"
+)
+
+var logger, _ = zap.NewDevelopment()
+
+func TestJournal(t *testing.T) {
+	dir := t.TempDir()
+	j, err := Open(logger.Sugar(), dir)
+	require.NoError(t, err)
+
+	entry := parser.LogEntry{
+		Triggered: true,
+		Text:      "[ERROR] boom",
+		LineNo:    7,
+		Variables: map[string]string{"LEVEL": "ERROR", "LINENO": "7"},
+	}
+	first := Record{FileName: "app.log", OutputDir: "out", Model: "gpt-4", Entry: entry, Context: []parser.LogEntry{entry}}
+	require.NoError(t, j.Save(&first))
+	require.NotEmpty(t, first.ID)
+	second := Record{FileName: "db.log", OutputDir: "out", Model: "gpt-4", Entry: entry}
+	require.NoError(t, j.Save(&second))
+	require.Less(t, first.ID, second.ID)
+
+	// Records are loaded oldest first
+	records, err := j.Load()
+	require.NoError(t, err)
+	require.Len(t, records, 2)
+	require.Equal(t, first.ID, records[0].ID)
+	require.Equal(t, "app.log", records[0].FileName)
+	require.Equal(t, entry.Text, records[0].Context[0].Text)
+	require.Equal(t, second.ID, records[1].ID)
+
+	// Saving again replaces the record
+	first.Attempts = 2
+	require.NoError(t, j.Save(&first))
+	records, err = j.Load()
+	require.NoError(t, err)
+	require.Len(t, records, 2)
+	require.Equal(t, 2, records[0].Attempts)
+
+	require.NoError(t, j.Remove(first.ID))
+	// Removing a missing record is not an error
+	require.NoError(t, j.Remove(first.ID))
+	records, err = j.Load()
+	require.NoError(t, err)
+	require.Len(t, records, 1)
+	require.Equal(t, second.ID, records[0].ID)
+
+	// Failed records are kept apart and not loaded again
+	require.NoError(t, j.Fail(second))
+	records, err = j.Load()
+	require.NoError(t, err)
+	require.Empty(t, records)
+	require.FileExists(t, filepath.Join(dir, failedDir, second.ID+extension))
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+}
+
+func TestJournalLeftovers(t *testing.T) {
+	dir := t.TempDir()
+	j, err := Open(logger.Sugar(), dir)
+	require.NoError(t, err)
+	record := Record{FileName: "app.log"}
+	require.NoError(t, j.Save(&record))
+
+	// A crash while saving leaves an incomplete temporary file behind
+	tmp := filepath.Join(dir, j.NewID()+extension+tmpExtension)
+	require.NoError(t, os.WriteFile(tmp, []byte(`{"id": "trunc`), 0644))
+	records, err := j.Load()
+	require.NoError(t, err)
+	require.Len(t, records, 1)
+	require.Equal(t, record.ID, records[0].ID)
+
+	// Corrupted records are skipped
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "corrupted"+extension), []byte(`{`), 0644))
+	records, err = j.Load()
+	require.NoError(t, err)
+	require.Len(t, records, 1)
+
+	// Opening the journal again removes the temporary file
+	j, err = Open(logger.Sugar(), dir)
+	require.NoError(t, err)
+	require.NoFileExists(t, tmp)
+	records, err = j.Load()
+	require.NoError(t, err)
+	require.Len(t, records, 1)
+	require.Equal(t, record.ID, records[0].ID)
+}
@@ -0,0 +1,170 @@
+package journald
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ingyamilmolinar/doctorgpt/agent/internal/parser"
+	"github.com/ingyamilmolinar/doctorgpt/agent/internal/tailer"
+)
+
+// Journal fields set on log entries (any other field is set as well, but
+// only json parsers can match on it)
+const (
+	VariableMessage   = "MESSAGE"
+	VariablePriority  = "PRIORITY"
+	VariableTimestamp = "TIMESTAMP"
+)
+
+// Field every entry starts with (in both formats)
+const cursorField = "__CURSOR"
+
+// Variables set on journal entries (their well-known fields)
+var Variables = parser.SourceVariables{VariableMessage, VariablePriority, VariableTimestamp, cursorField, "__REALTIME_TIMESTAMP",
+	"__MONOTONIC_TIMESTAMP", "MESSAGE_ID", "CODE_FILE", "CODE_LINE", "CODE_FUNC", "ERRNO", "SYSLOG_FACILITY",
+	"SYSLOG_IDENTIFIER", "SYSLOG_PID", "UNIT", "USER_UNIT", "CONTAINER_NAME", "CONTAINER_ID", "_PID", "_UID",
+	"_GID", "_COMM", "_EXE", "_CMDLINE", "_HOSTNAME", "_TRANSPORT", "_BOOT_ID", "_MACHINE_ID", "_SYSTEMD_UNIT",
+	"_SYSTEMD_USER_UNIT", "_SYSTEMD_SLICE", "_SYSTEMD_CGROUP", "_SYSTEMD_INVOCATION_ID"}
+
+// Decode turns the lines of a systemd journal in the JSON (journalctl -o json) or export
+// (journalctl -o export) format into one line per entry (its MESSAGE) with every field
+// as a variable. Lines of any other format are returned as is. The lines returned are
+// closed once lines is (or ctx is done).
+func Decode(ctx context.Context, lines <-chan tailer.Line) <-chan tailer.Line {
+	decoded := make(chan tailer.Line)
+	go func() {
+		defer close(decoded)
+		// The format is detected on the first line
+		first, ok := <-lines
+		if !ok {
+			return
+		}
+		decode := func(line tailer.Line) (tailer.Line, bool) {
+			return line, true
+		}
+		switch {
+		case strings.HasPrefix(first.Text, `{"`+cursorField+`"`):
+			decode = decodeJSON
+		case strings.HasPrefix(first.Text, cursorField+"="):
+			decode = newExportDecoder()
+		}
+
+		for line := first; ok; line, ok = <-lines {
+			entry, complete := decode(line)
+			if !complete {
+				continue
+			}
+			select {
+			case decoded <- entry:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return decoded
+}
+
+// decodeJSON decodes an entry per line (lines which are not entries are returned as is)
+func decodeJSON(line tailer.Line) (tailer.Line, bool) {
+	var fields map[string]interface{}
+	err := json.Unmarshal([]byte(line.Text), &fields)
+	if err != nil {
+		return line, true
+	}
+	values := make(map[string]string, len(fields))
+	for name, value := range fields {
+		values[name] = jsonValue(value)
+	}
+	return entry(line, values), true
+}
+
+// jsonValue decodes a field value: a string, null (too large), an array of bytes
+// (not valid UTF-8) or an array of those (repeated fields, joined by newlines)
+func jsonValue(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case []interface{}:
+		data := make([]byte, 0, len(v))
+		for _, item := range v {
+			b, ok := item.(float64)
+			if !ok {
+				values := make([]string, 0, len(v))
+				for _, item := range v {
+					values = append(values, jsonValue(item))
+				}
+				return strings.Join(values, "\n")
+			}
+			data = append(data, byte(b))
+		}
+		return string(data)
+	}
+	return ""
+}
+
+// newExportDecoder decodes entries made of many lines ("FIELD=value", or "FIELD" followed by
+// a little endian 64 bit length and the value for binary fields) ended by an empty line
+func newExportDecoder() func(tailer.Line) (tailer.Line, bool) {
+	values := map[string]string{}
+	var binaryField string
+	var binaryValue strings.Builder
+	var binaryLines int
+	return func(line tailer.Line) (tailer.Line, bool) {
+		if binaryField != "" {
+			// The value may span many lines (or even start with a newline)
+			if binaryLines > 0 {
+				binaryValue.WriteByte('\n')
+			}
+			binaryValue.WriteString(line.Text)
+			binaryLines++
+			data := binaryValue.String()
+			if len(data) < 8 || uint64(len(data)-8) < binary.LittleEndian.Uint64([]byte(data[:8])) {
+				return tailer.Line{}, false
+			}
+			values[binaryField] = data[8:]
+			binaryField = ""
+			binaryValue.Reset()
+			binaryLines = 0
+			return tailer.Line{}, false
+		}
+		if line.Text == "" {
+			if len(values) == 0 {
+				return tailer.Line{}, false
+			}
+			// Resuming from here skips the whole entry
+			decoded := entry(line, values)
+			values = map[string]string{}
+			return decoded, true
+		}
+		name, value, ok := strings.Cut(line.Text, "=")
+		if !ok {
+			binaryField = name
+			return tailer.Line{}, false
+		}
+		values[name] = value
+		return tailer.Line{}, false
+	}
+}
+
+func entry(line tailer.Line, fields map[string]string) tailer.Line {
+	fields[VariableTimestamp] = timestamp(fields["__REALTIME_TIMESTAMP"])
+	return tailer.Line{
+		Text:      strings.TrimRight(fields[VariableMessage], "\n"),
+		File:      line.File,
+		Position:  line.Position,
+		Variables: fields,
+	}
+}
+
+// timestamp of the entry (microseconds since the epoch)
+func timestamp(realtime string) string {
+	micros, err := strconv.ParseInt(realtime, 10, 64)
+	if err != nil {
+		return ""
+	}
+	return time.UnixMicro(micros).UTC().Format(time.RFC3339Nano)
+}
@@ -0,0 +1,81 @@
+package journald
+
+import (
+	"context"
+	"encoding/binary"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/ingyamilmolinar/doctorgpt/agent/internal/tailer"
+)
+
+func decodeAll(texts []string) []tailer.Line {
+	lines := make(chan tailer.Line, len(texts))
+	for i, text := range texts {
+		lines <- tailer.Line{Text: text, File: "stdin", Position: tailer.Position{Line: i + 1}}
+	}
+	close(lines)
+	var decoded []tailer.Line
+	for line := range Decode(context.Background(), lines) {
+		decoded = append(decoded, line)
+	}
+	return decoded
+}
+
+func TestDecodeJSON(t *testing.T) {
+	decoded := decodeAll([]string{
+		`{"__CURSOR":"s=1","__REALTIME_TIMESTAMP":"1690000000500000","PRIORITY":"6","_SYSTEMD_UNIT":"nginx.service","_PID":"42","MESSAGE":"started"}`,
+		`{"__CURSOR":"s=2","PRIORITY":"3","_SYSTEMD_UNIT":"billing.service","MESSAGE":[98,111,111,109,10,255]}`,
+		`{"__CURSOR":"s=3","PRIORITY":"4","MESSAGE":null,"TAGS":["a","b"]}`,
+	})
+	require.Len(t, decoded, 3)
+	require.Equal(t, "started", decoded[0].Text)
+	require.Equal(t, "stdin", decoded[0].File)
+	require.Equal(t, "nginx.service", decoded[0].Variables["_SYSTEMD_UNIT"])
+	require.Equal(t, "42", decoded[0].Variables["_PID"])
+	require.Equal(t, "2023-07-22T04:26:40.5Z", decoded[0].Variables["TIMESTAMP"])
+	require.Equal(t, "boom\n\xff", decoded[1].Text)
+	require.Equal(t, "3", decoded[1].Variables["PRIORITY"])
+	require.Equal(t, 2, decoded[1].Position.Line)
+	require.Equal(t, "", decoded[2].Text)
+	require.Equal(t, "a\nb", decoded[2].Variables["TAGS"])
+}
+
+func TestDecodeExport(t *testing.T) {
+	// Binary fields hold their length (which may contain a newline) before their value
+	size := make([]byte, 8)
+	binary.LittleEndian.PutUint64(size, 10)
+	decoded := decodeAll([]string{
+		"__CURSOR=s=1",
+		"PRIORITY=6",
+		"_SYSTEMD_UNIT=nginx.service",
+		"MESSAGE=started",
+		"",
+		"__CURSOR=s=2",
+		"PRIORITY=3",
+		"MESSAGE",
+		"",
+		string(size[1:]) + "panic boom",
+		"",
+		"__CURSOR=s=3",
+		"_PID=43",
+		"",
+	})
+	require.Len(t, decoded, 3)
+	require.Equal(t, "started", decoded[0].Text)
+	require.Equal(t, "nginx.service", decoded[0].Variables["_SYSTEMD_UNIT"])
+	require.Equal(t, 5, decoded[0].Position.Line)
+	require.Equal(t, "panic boom", decoded[1].Text)
+	require.Equal(t, "3", decoded[1].Variables["PRIORITY"])
+	require.Equal(t, 11, decoded[1].Position.Line)
+	require.Equal(t, "43", decoded[2].Variables["_PID"])
+	require.Equal(t, 14, decoded[2].Position.Line)
+}
+
+func TestDecodeOtherFormats(t *testing.T) {
+	decoded := decodeAll([]string{"INFO started", `{"__CURSOR":"s=1","MESSAGE":"not decoded"}`})
+	require.Len(t, decoded, 2)
+	require.Equal(t, "INFO started", decoded[0].Text)
+	require.Nil(t, decoded[1].Variables)
+}
@@ -0,0 +1,178 @@
+package kubernetes
+
+import (
+	"context"
+	"encoding/json"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/ingyamilmolinar/doctorgpt/agent/internal/parser"
+	"github.com/ingyamilmolinar/doctorgpt/agent/internal/tailer"
+)
+
+// Where the kubelet links the log file of every container running on the node
+const ContainerLogPattern = "/var/log/containers/*.log"
+
+// Variables set on every container log entry
+const (
+	VariableNamespace   = "NAMESPACE"
+	VariablePod         = "POD"
+	VariableContainer   = "CONTAINER"
+	VariableContainerID = "CONTAINER_ID"
+	VariableStream      = "STREAM"
+)
+
+// Variables set on every container log entry
+var Variables = parser.SourceVariables{VariableNamespace, VariablePod, VariableContainer, VariableContainerID, VariableStream}
+
+// Max number of partial lines joined into a line (it is flushed as is once reached, like multi-line log entries)
+var MaxPartialLines = parser.DefaultMultilineMaxLines
+
+// <pod>_<namespace>_<container>-<container ID>.log
+var containerLogRe = regexp.MustCompile(`^(?P<pod>[^_]+)_(?P<namespace>[^_]+)_(?P<container>.+)-(?P<id>[0-9a-f]{64})\.log$`)
+
+// Container a log file belongs to
+type Container struct {
+	Namespace string
+	Pod       string
+	Container string
+	ID        string
+}
+
+// ParseFileName returns the container of a /var/log/containers log file
+func ParseFileName(fileName string) (Container, bool) {
+	match := containerLogRe.FindStringSubmatch(filepath.Base(fileName))
+	if match == nil {
+		return Container{}, false
+	}
+	return Container{
+		Pod:       match[1],
+		Namespace: match[2],
+		Container: match[3],
+		ID:        match[4],
+	}, true
+}
+
+// Name identifies the container in diagnosis file names
+func (c Container) Name() string {
+	return c.Namespace + "_" + c.Pod + "_" + c.Container
+}
+
+// Decode turns the lines of a container log file (CRI or Docker json-file format) into
+// the lines logged by the container, joining partial lines (MaxPartialLines at most) of
+// each stream. The lines returned are closed once lines is (or ctx is done), lines left
+// partial being flushed as they are.
+func Decode(ctx context.Context, c Container, lines <-chan tailer.Line) <-chan tailer.Line {
+	decoded := make(chan tailer.Line)
+	go func() {
+		defer close(decoded)
+		// stdout and stderr are interleaved in the same file
+		partials := map[string]*partial{}
+		var last tailer.Position
+		send := func(stream string, position tailer.Position) bool {
+			p := partials[stream]
+			delete(partials, stream)
+			select {
+			case decoded <- c.line(p.text.String(), stream, position, partials):
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		}
+		for line := range lines {
+			text, stream, complete := decode(line.Text)
+			p, ok := partials[stream]
+			if !ok {
+				p = &partial{start: last}
+				partials[stream] = p
+			}
+			last = line.Position
+			p.text.WriteString(text)
+			p.parts++
+			if !complete && p.parts < MaxPartialLines {
+				continue
+			}
+			if !send(stream, line.Position) {
+				return
+			}
+		}
+		// Oldest first
+		for len(partials) > 0 {
+			oldest, first := "", true
+			for stream, p := range partials {
+				if first || p.start.Line < partials[oldest].start.Line {
+					oldest, first = stream, false
+				}
+			}
+			if !send(oldest, last) {
+				return
+			}
+		}
+	}()
+	return decoded
+}
+
+// partial is a line of a stream not completed yet
+type partial struct {
+	text  strings.Builder
+	parts int
+	// Position right before its first part
+	start tailer.Position
+}
+
+// line returns the decoded line of the stream ending at position. Resuming from it must
+// not skip the parts of the lines other streams have pending, so they are read again.
+func (c Container) line(text, stream string, position tailer.Position, pending map[string]*partial) tailer.Line {
+	line := tailer.Line{
+		Text:     text,
+		File:     c.Name(),
+		Position: position,
+		Variables: map[string]string{
+			VariableNamespace:   c.Namespace,
+			VariablePod:         c.Pod,
+			VariableContainer:   c.Container,
+			VariableContainerID: c.ID,
+			VariableStream:      stream,
+		},
+	}
+	for _, p := range pending {
+		if p.start.Line < line.Position.Line {
+			line.Position = p.start
+		}
+	}
+	if line.Position != position {
+		line.FirstLine = position.Line
+	}
+	return line
+}
+
+type dockerLine struct {
+	Log    string `json:"log"`
+	Stream string `json:"stream"`
+}
+
+// decode returns the text of a log line, its stream and whether it completes a line
+func decode(line string) (string, string, bool) {
+	// Docker json-file: {"log":"text\n","stream":"stdout","time":"..."} (partial lines lack the newline)
+	if strings.HasPrefix(line, "{") {
+		var d dockerLine
+		if json.Unmarshal([]byte(line), &d) == nil {
+			return strings.TrimSuffix(d.Log, "\n"), d.Stream, strings.HasSuffix(d.Log, "\n")
+		}
+	}
+	// CRI: <timestamp> <stream> <tags> <text> (the first tag is P for partial lines, F otherwise)
+	fields := strings.SplitN(line, " ", 4)
+	if len(fields) < 3 {
+		return line, "", true
+	}
+	tag, _, _ := strings.Cut(fields[2], ":")
+	if tag != "P" && tag != "F" {
+		return line, "", true
+	}
+	text := ""
+	if len(fields) == 4 {
+		text = fields[3]
+	}
+	return text, fields[1], tag == "F"
+}
@@ -0,0 +1,133 @@
+package kubernetes
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/ingyamilmolinar/doctorgpt/agent/internal/tailer"
+)
+
+const containerID = "7c8e3d2a4f1b9e6d5c0a8b7f6e5d4c3b2a1f0e9d8c7b6a5f4e3d2c1b0a9f8e7d"
+
+func TestParseFileName(t *testing.T) {
+	c, ok := ParseFileName("/var/log/containers/api-7d9f8-xk2lp_shop_api-server-" + containerID + ".log")
+	require.True(t, ok)
+	require.Equal(t, Container{Namespace: "shop", Pod: "api-7d9f8-xk2lp", Container: "api-server", ID: containerID}, c)
+	require.Equal(t, "shop_api-7d9f8-xk2lp_api-server", c.Name())
+
+	_, ok = ParseFileName("/var/log/syslog")
+	require.False(t, ok)
+}
+
+func TestDecode(t *testing.T) {
+	c := Container{Namespace: "shop", Pod: "api", Container: "server", ID: containerID}
+	raw := []string{
+		// CRI
+		"2023-05-02T10:00:00.000000001Z stdout F starting",
+		"2023-05-02T10:00:01.000000001Z stderr P panic: a very ",
+		"2023-05-02T10:00:01.000000002Z stderr P long ",
+		"2023-05-02T10:00:01.000000003Z stderr F line",
+		"2023-05-02T10:00:02.000000001Z stdout F",
+		// Docker json-file
+		`{"log":"partial ","stream":"stderr","time":"2023-05-02T10:00:03Z"}`,
+		`{"log":"error\n","stream":"stderr","time":"2023-05-02T10:00:03Z"}`,
+		// Anything else is left as is
+		"not a container log line",
+	}
+	lines := make(chan tailer.Line, len(raw))
+	for i, text := range raw {
+		lines <- tailer.Line{Text: text, File: "/var/log/containers/x.log", Position: tailer.Position{Line: i + 1}}
+	}
+	close(lines)
+
+	var decoded []tailer.Line
+	for line := range Decode(context.Background(), c, lines) {
+		decoded = append(decoded, line)
+	}
+	require.Len(t, decoded, 5)
+	expected := []struct {
+		text   string
+		stream string
+		line   int
+	}{
+		{"starting", "stdout", 1},
+		{"panic: a very long line", "stderr", 4},
+		{"", "stdout", 5},
+		{"partial error", "stderr", 7},
+		{"not a container log line", "", 8},
+	}
+	for i, e := range expected {
+		require.Equal(t, e.text, decoded[i].Text)
+		require.Equal(t, e.line, decoded[i].Position.Line)
+		require.Equal(t, "shop_api_server", decoded[i].File)
+		require.Equal(t, map[string]string{
+			"NAMESPACE":    "shop",
+			"POD":          "api",
+			"CONTAINER":    "server",
+			"CONTAINER_ID": containerID,
+			"STREAM":       e.stream,
+		}, decoded[i].Variables)
+	}
+}
+
+func TestDecodeMaxPartialLines(t *testing.T) {
+	defer func(max int) { MaxPartialLines = max }(MaxPartialLines)
+	MaxPartialLines = 2
+	lines := make(chan tailer.Line, 3)
+	for _, text := range []string{"a ", "b ", "c"} {
+		lines <- tailer.Line{Text: "2023-05-02T10:00:00.000000001Z stdout P " + text}
+	}
+	close(lines)
+
+	// Containers that never complete their line do not grow it without limit
+	var decoded []string
+	for line := range Decode(context.Background(), Container{}, lines) {
+		decoded = append(decoded, line.Text)
+	}
+	require.Equal(t, []string{"a b ", "c"}, decoded)
+}
+
+func TestDecodeInterleavedStreams(t *testing.T) {
+	raw := []string{
+		"2023-05-02T10:00:00.000000001Z stdout P request ",
+		"2023-05-02T10:00:00.000000002Z stderr P panic: ",
+		"2023-05-02T10:00:00.000000003Z stdout F done",
+		"2023-05-02T10:00:00.000000004Z stderr P nil ",
+		"2023-05-02T10:00:00.000000005Z stdout P exiting",
+		"2023-05-02T10:00:00.000000006Z stderr F pointer",
+		"2023-05-02T10:00:00.000000007Z stdout P ",
+		"2023-05-02T10:00:00.000000008Z stderr P goroutine 1",
+	}
+	lines := make(chan tailer.Line, len(raw))
+	for i, text := range raw {
+		lines <- tailer.Line{Text: text, Position: tailer.Position{Line: i + 1}}
+	}
+	close(lines)
+
+	var decoded []tailer.Line
+	for line := range Decode(context.Background(), Container{}, lines) {
+		decoded = append(decoded, line)
+	}
+	expected := []struct {
+		text   string
+		stream string
+		number int
+		// Resuming from it reads the lines other streams have pending again
+		resume int
+	}{
+		{"request done", "stdout", 3, 1},
+		{"panic: nil pointer", "stderr", 6, 4},
+		// Lines left partial are flushed once the file ends
+		{"exiting", "stdout", 8, 7},
+		{"goroutine 1", "stderr", 8, 8},
+	}
+	require.Len(t, decoded, len(expected))
+	for i, e := range expected {
+		require.Equal(t, e.text, decoded[i].Text)
+		require.Equal(t, e.stream, decoded[i].Variables[VariableStream])
+		require.Equal(t, e.number, decoded[i].Number())
+		require.Equal(t, e.resume, decoded[i].Position.Line)
+	}
+}
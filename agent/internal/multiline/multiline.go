@@ -0,0 +1,139 @@
+package multiline
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/ingyamilmolinar/doctorgpt/agent/internal/parser"
+	"github.com/ingyamilmolinar/doctorgpt/agent/internal/tailer"
+)
+
+// Enabled checks whether any parser joins multi-line log entries
+func Enabled(parsers []parser.Parser) bool {
+	for _, p := range parsers {
+		if p.Multiline != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// Assemble joins the lines of multi-line log entries (see parser.Multiline) into a single
+// line. A log entry is complete once a line does not continue it, it has max lines or no
+// line arrives within the flush timeout. The lines returned are closed once lines is
+// (or ctx is done).
+func Assemble(ctx context.Context, log *zap.SugaredLogger, parsers []parser.Parser, lines <-chan tailer.Line) <-chan tailer.Line {
+	assembled := make(chan tailer.Line)
+	go func() {
+		defer close(assembled)
+		send := func(line tailer.Line) bool {
+			select {
+			case assembled <- line:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		}
+
+		// Log entry being assembled (if any)
+		var pending *entry
+		flush := time.NewTimer(time.Hour)
+		flush.Stop()
+		defer flush.Stop()
+		for {
+			var line tailer.Line
+			var ok bool
+			select {
+			case <-ctx.Done():
+				return
+			case <-flush.C:
+				log.Debugf("Multi-line log entry flushed after (%s)", pending.parser.Multiline.FlushTimeout)
+				if !send(pending.line()) {
+					return
+				}
+				pending = nil
+				continue
+			case line, ok = <-lines:
+			}
+			if !ok {
+				if pending != nil {
+					send(pending.line())
+				}
+				return
+			}
+
+			if pending != nil {
+				stop(flush)
+				if len(pending.texts) < pending.parser.Multiline.MaxLines && pending.parser.Continues(log, line.Text) {
+					pending.add(line)
+					flush.Reset(pending.parser.Multiline.FlushTimeout)
+					continue
+				}
+				if !send(pending.line()) {
+					return
+				}
+				pending = nil
+			}
+
+			p, ok := starting(log, parsers, line.Text)
+			if !ok {
+				if !send(line) {
+					return
+				}
+				continue
+			}
+			pending = &entry{parser: p, first: line}
+			pending.add(line)
+			flush.Reset(p.Multiline.FlushTimeout)
+		}
+	}()
+	return assembled
+}
+
+// stop stops the timer draining its channel (so that it can be reset)
+func stop(timer *time.Timer) {
+	if !timer.Stop() {
+		select {
+		case <-timer.C:
+		default:
+		}
+	}
+}
+
+// starting returns the parser of the multi-line log entry the line starts (if any).
+// Parsers are tried in order, as when parsing.
+func starting(log *zap.SugaredLogger, parsers []parser.Parser, text string) (parser.Parser, bool) {
+	for _, p := range parsers {
+		if p.Starts(log, text) {
+			return p, true
+		}
+		if p.Matches(log, text) {
+			return parser.Parser{}, false
+		}
+	}
+	return parser.Parser{}, false
+}
+
+type entry struct {
+	parser parser.Parser
+	first  tailer.Line
+	last   tailer.Line
+	texts  []string
+}
+
+func (e *entry) add(line tailer.Line) {
+	e.texts = append(e.texts, line.Text)
+	e.last = line
+}
+
+// line is the joined log entry, numbered after its first line. Resuming from its position skips all of its lines.
+func (e *entry) line() tailer.Line {
+	line := e.first
+	line.Text = strings.Join(e.texts, "\n")
+	line.FirstLine = e.first.Number()
+	line.Position = e.last.Position
+	return line
+}
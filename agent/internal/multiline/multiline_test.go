@@ -0,0 +1,124 @@
+package multiline
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/ingyamilmolinar/doctorgpt/agent/internal/config"
+	"github.com/ingyamilmolinar/doctorgpt/agent/internal/parser"
+	"github.com/ingyamilmolinar/doctorgpt/agent/internal/tailer"
+)
+
+var logger, _ = zap.NewDevelopment()
+
+func newParsers(t *testing.T, cfgs ...config.ParserConfig) []parser.Parser {
+	var parsers []parser.Parser
+	for _, cfg := range append(cfgs, config.ParserConfig{Regex: "^(?P<TEXT>.*)$"}) {
+		p, err := parser.NewParserFromConfig(logger.Sugar(), cfg, nil)
+		require.NoError(t, err)
+		parsers = append(parsers, p)
+	}
+	return parsers
+}
+
+func assemble(parsers []parser.Parser, texts []string) []tailer.Line {
+	lines := make(chan tailer.Line, len(texts))
+	for i, text := range texts {
+		lines <- tailer.Line{Text: text, File: "app.log", Position: tailer.Position{Line: i + 1}}
+	}
+	close(lines)
+	var assembled []tailer.Line
+	for line := range Assemble(context.Background(), logger.Sugar(), parsers, lines) {
+		assembled = append(assembled, line)
+	}
+	return assembled
+}
+
+func TestAssembleJava(t *testing.T) {
+	// Lines not matched by the parser continue the log entry
+	parsers := newParsers(t, config.ParserConfig{
+		Regex:     `^(?P<DATE>\d{4}-\d{2}-\d{2}) (?P<LEVEL>[A-Z]+) (?P<MESSAGE>.*)$`,
+		Multiline: &config.MultilineConfig{MaxLines: 3},
+	})
+	assembled := assemble(parsers, []string{
+		"starting",
+		"2023-07-22 ERROR Request failed",
+		"java.lang.NullPointerException: boom",
+		"\tat com.example.App.handle(App.java:42)",
+		"\tat com.example.App.main(App.java:7)",
+		"2023-07-22 INFO Request done",
+	})
+	require.Len(t, assembled, 4)
+	require.Equal(t, "starting", assembled[0].Text)
+	require.Equal(t, "2023-07-22 ERROR Request failed\njava.lang.NullPointerException: boom\n\tat com.example.App.handle(App.java:42)", assembled[1].Text)
+	// Numbered after its first line, resumed after its last one
+	require.Equal(t, 2, assembled[1].Number())
+	require.Equal(t, 4, assembled[1].Position.Line)
+	// Max lines reached
+	require.Equal(t, "\tat com.example.App.main(App.java:7)", assembled[2].Text)
+	require.Equal(t, "2023-07-22 INFO Request done", assembled[3].Text)
+
+	entry, _, err := parser.ParseLogEntry(logger.Sugar(), parsers, assembled[1].Text, assembled[1].Number())
+	require.NoError(t, err)
+	require.Equal(t, 2, entry.LineNo)
+	require.Equal(t, "ERROR", entry.Variables["LEVEL"])
+	require.Equal(t, "Request failed", entry.Variables["MESSAGE"])
+	require.Equal(t, assembled[1].Text, entry.Text)
+}
+
+func TestAssemblePython(t *testing.T) {
+	parsers := newParsers(t, config.ParserConfig{
+		Regex: `^(?P<TRACEBACK>Traceback .*)$`,
+		Multiline: &config.MultilineConfig{
+			Continuation: `^(\s+|\w+Error: )`,
+		},
+	})
+	assembled := assemble(parsers, []string{
+		"Traceback (most recent call last):",
+		`  File "app.py", line 3, in <module>`,
+		"    main()",
+		"ValueError: boom",
+		"done",
+	})
+	require.Len(t, assembled, 2)
+	require.Equal(t, "Traceback (most recent call last):\n  File \"app.py\", line 3, in <module>\n    main()\nValueError: boom", assembled[0].Text)
+	require.Equal(t, "done", assembled[1].Text)
+}
+
+func TestAssembleFlushTimeout(t *testing.T) {
+	parsers := newParsers(t, config.ParserConfig{
+		Regex:     `^panic: (?P<MESSAGE>.*)$`,
+		Multiline: &config.MultilineConfig{Continuation: `^(\s|goroutine |$)`, FlushTimeout: 10 * time.Millisecond},
+	})
+	lines := make(chan tailer.Line)
+	defer close(lines)
+	assembled := Assemble(context.Background(), logger.Sugar(), parsers, lines)
+	lines <- tailer.Line{Text: "panic: boom"}
+	lines <- tailer.Line{Text: ""}
+	lines <- tailer.Line{Text: "goroutine 1 [running]:"}
+
+	// The log entry is complete once no line arrives for a while
+	select {
+	case line := <-assembled:
+		require.Equal(t, "panic: boom\n\ngoroutine 1 [running]:", line.Text)
+	case <-time.After(time.Second):
+		t.Fatal("multi-line log entry was not flushed")
+	}
+}
+
+func TestInvalidMultiline(t *testing.T) {
+	_, err := parser.NewParserFromConfig(logger.Sugar(), config.ParserConfig{
+		Regex:     "^(?P<TEXT>.*)$",
+		Multiline: &config.MultilineConfig{Start: "("},
+	}, nil)
+	require.Error(t, err)
+	_, err = parser.NewParserFromConfig(logger.Sugar(), config.ParserConfig{
+		Regex:     "^(?P<TEXT>.*)$",
+		Multiline: &config.MultilineConfig{MaxLines: -1},
+	}, nil)
+	require.Error(t, err)
+}
@@ -0,0 +1,186 @@
+package otlp
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+
+	collogspb "go.opentelemetry.io/proto/otlp/collector/logs/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	logspb "go.opentelemetry.io/proto/otlp/logs/v1"
+	resourcepb "go.opentelemetry.io/proto/otlp/resource/v1"
+)
+
+// OTLP/JSON differs from the canonical protobuf JSON mapping (hex trace and span IDs,
+// integer enums), so requests are decoded into these types and then converted.
+// See https://opentelemetry.io/docs/specs/otlp/#json-protobuf-encoding
+
+type exportRequest struct {
+	ResourceLogs []resourceLogs `json:"resourceLogs"`
+}
+
+type resourceLogs struct {
+	Resource struct {
+		Attributes []keyValue `json:"attributes"`
+	} `json:"resource"`
+	ScopeLogs []scopeLogs `json:"scopeLogs"`
+}
+
+type scopeLogs struct {
+	Scope struct {
+		Name    string `json:"name"`
+		Version string `json:"version"`
+	} `json:"scope"`
+	LogRecords []logRecord `json:"logRecords"`
+}
+
+type logRecord struct {
+	TimeUnixNano         jsonInt    `json:"timeUnixNano"`
+	ObservedTimeUnixNano jsonInt    `json:"observedTimeUnixNano"`
+	SeverityNumber       int32      `json:"severityNumber"`
+	SeverityText         string     `json:"severityText"`
+	Body                 *anyValue  `json:"body"`
+	Attributes           []keyValue `json:"attributes"`
+	TraceID              string     `json:"traceId"`
+	SpanID               string     `json:"spanId"`
+}
+
+type keyValue struct {
+	Key   string    `json:"key"`
+	Value *anyValue `json:"value"`
+}
+
+type anyValue struct {
+	StringValue *string  `json:"stringValue"`
+	BoolValue   *bool    `json:"boolValue"`
+	IntValue    *jsonInt `json:"intValue"`
+	DoubleValue *float64 `json:"doubleValue"`
+	BytesValue  *string  `json:"bytesValue"`
+	ArrayValue  *struct {
+		Values []*anyValue `json:"values"`
+	} `json:"arrayValue"`
+	KvlistValue *struct {
+		Values []keyValue `json:"values"`
+	} `json:"kvlistValue"`
+}
+
+// jsonInt is a 64 bit integer encoded as a JSON number or string
+type jsonInt int64
+
+func (i *jsonInt) UnmarshalJSON(data []byte) error {
+	value, err := strconv.ParseInt(strings.Trim(string(data), `"`), 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid integer (%s)", data)
+	}
+	*i = jsonInt(value)
+	return nil
+}
+
+func (r exportRequest) proto() (*collogspb.ExportLogsServiceRequest, error) {
+	request := &collogspb.ExportLogsServiceRequest{}
+	for _, rl := range r.ResourceLogs {
+		attributes, err := protoAttributes(rl.Resource.Attributes)
+		if err != nil {
+			return nil, err
+		}
+		resource := &logspb.ResourceLogs{
+			Resource: &resourcepb.Resource{Attributes: attributes},
+		}
+		for _, sl := range rl.ScopeLogs {
+			scope := &logspb.ScopeLogs{
+				Scope: &commonpb.InstrumentationScope{Name: sl.Scope.Name, Version: sl.Scope.Version},
+			}
+			for _, lr := range sl.LogRecords {
+				record, err := lr.proto()
+				if err != nil {
+					return nil, err
+				}
+				scope.LogRecords = append(scope.LogRecords, record)
+			}
+			resource.ScopeLogs = append(resource.ScopeLogs, scope)
+		}
+		request.ResourceLogs = append(request.ResourceLogs, resource)
+	}
+	return request, nil
+}
+
+func (r logRecord) proto() (*logspb.LogRecord, error) {
+	traceID, err := hex.DecodeString(r.TraceID)
+	if err != nil {
+		return nil, fmt.Errorf("invalid trace ID (%s)", r.TraceID)
+	}
+	spanID, err := hex.DecodeString(r.SpanID)
+	if err != nil {
+		return nil, fmt.Errorf("invalid span ID (%s)", r.SpanID)
+	}
+	body, err := r.Body.proto()
+	if err != nil {
+		return nil, err
+	}
+	attributes, err := protoAttributes(r.Attributes)
+	if err != nil {
+		return nil, err
+	}
+	return &logspb.LogRecord{
+		TimeUnixNano:         uint64(r.TimeUnixNano),
+		ObservedTimeUnixNano: uint64(r.ObservedTimeUnixNano),
+		SeverityNumber:       logspb.SeverityNumber(r.SeverityNumber),
+		SeverityText:         r.SeverityText,
+		Body:                 body,
+		Attributes:           attributes,
+		TraceId:              traceID,
+		SpanId:               spanID,
+	}, nil
+}
+
+func protoAttributes(attributes []keyValue) ([]*commonpb.KeyValue, error) {
+	var result []*commonpb.KeyValue
+	for _, kv := range attributes {
+		value, err := kv.Value.proto()
+		if err != nil {
+			return nil, fmt.Errorf("invalid attribute (%s): %w", kv.Key, err)
+		}
+		result = append(result, &commonpb.KeyValue{Key: kv.Key, Value: value})
+	}
+	return result, nil
+}
+
+func (v *anyValue) proto() (*commonpb.AnyValue, error) {
+	switch {
+	case v == nil:
+		return nil, nil
+	case v.StringValue != nil:
+		return &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: *v.StringValue}}, nil
+	case v.BoolValue != nil:
+		return &commonpb.AnyValue{Value: &commonpb.AnyValue_BoolValue{BoolValue: *v.BoolValue}}, nil
+	case v.IntValue != nil:
+		return &commonpb.AnyValue{Value: &commonpb.AnyValue_IntValue{IntValue: int64(*v.IntValue)}}, nil
+	case v.DoubleValue != nil:
+		return &commonpb.AnyValue{Value: &commonpb.AnyValue_DoubleValue{DoubleValue: *v.DoubleValue}}, nil
+	case v.BytesValue != nil:
+		data, err := base64.StdEncoding.DecodeString(*v.BytesValue)
+		if err != nil {
+			return nil, fmt.Errorf("invalid bytes value: %w", err)
+		}
+		return &commonpb.AnyValue{Value: &commonpb.AnyValue_BytesValue{BytesValue: data}}, nil
+	case v.ArrayValue != nil:
+		array := &commonpb.ArrayValue{}
+		for _, item := range v.ArrayValue.Values {
+			value, err := item.proto()
+			if err != nil {
+				return nil, err
+			}
+			array.Values = append(array.Values, value)
+		}
+		return &commonpb.AnyValue{Value: &commonpb.AnyValue_ArrayValue{ArrayValue: array}}, nil
+	case v.KvlistValue != nil:
+		values, err := protoAttributes(v.KvlistValue.Values)
+		if err != nil {
+			return nil, err
+		}
+		return &commonpb.AnyValue{Value: &commonpb.AnyValue_KvlistValue{KvlistValue: &commonpb.KeyValueList{Values: values}}}, nil
+	}
+	return &commonpb.AnyValue{}, nil
+}
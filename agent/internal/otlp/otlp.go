@@ -0,0 +1,264 @@
+package otlp
+
+import (
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"time"
+
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/ingyamilmolinar/doctorgpt/agent/internal/input"
+	"github.com/ingyamilmolinar/doctorgpt/agent/internal/parser"
+	collogspb "go.opentelemetry.io/proto/otlp/collector/logs/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	logspb "go.opentelemetry.io/proto/otlp/logs/v1"
+)
+
+// Path of the OTLP/HTTP logs endpoint
+const Path = "/v1/logs"
+
+// Max size of a (decompressed) request body
+const maxBodySize = 10 * 1024 * 1024
+
+// Stream of the log records whose resource has no service name
+const defaultStream = "otlp"
+
+// Variables set on every OTLP log entry
+const (
+	VariableSeverityText   = "SEVERITY_TEXT"
+	VariableSeverityNumber = "SEVERITY_NUMBER"
+	VariableTimestamp      = "TIMESTAMP"
+	VariableTraceID        = "TRACE_ID"
+	VariableSpanID         = "SPAN_ID"
+	VariableScope          = "SCOPE"
+	// Prefixes of the resource and log record attributes (e.g. RESOURCE.service.name)
+	VariableResource  = "RESOURCE"
+	VariableAttribute = "ATTRIBUTE"
+)
+
+// Variables set on every OTLP log record
+var Variables = parser.SourceVariables{VariableSeverityText, VariableSeverityNumber, VariableTimestamp, VariableTraceID,
+	VariableSpanID, VariableScope, VariableResource + ".*", VariableAttribute + ".*"}
+
+// Severity texts of the severity number ranges (see the OpenTelemetry log data model)
+var severities = []string{"TRACE", "DEBUG", "INFO", "WARN", "ERROR", "FATAL"}
+
+// Record is a log record along with the stream (service) it belongs to
+type Record struct {
+	Stream    string
+	Text      string
+	Variables map[string]string
+}
+
+// Handler receives OTLP/HTTP log export requests (protobuf or JSON, optionally gzipped).
+// Every service (service.name resource attribute) is monitored on its own.
+// Requests must carry the bearer token (if any).
+func Handler(log *zap.SugaredLogger, demux *input.Demux, token string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if token != "" && r.Header.Get("Authorization") != "Bearer "+token {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		if mediaType != "application/x-protobuf" && mediaType != "application/json" {
+			http.Error(w, "unsupported content type", http.StatusUnsupportedMediaType)
+			return
+		}
+
+		var body io.Reader = http.MaxBytesReader(w, r.Body, maxBodySize)
+		if r.Header.Get("Content-Encoding") == "gzip" {
+			gz, err := gzip.NewReader(body)
+			if err != nil {
+				http.Error(w, "invalid gzip body", http.StatusBadRequest)
+				return
+			}
+			defer gz.Close()
+			body = io.LimitReader(gz, maxBodySize)
+		}
+		data, err := io.ReadAll(body)
+		if err != nil {
+			http.Error(w, "failed to read request body", http.StatusBadRequest)
+			return
+		}
+		records, err := Decode(data, mediaType == "application/json")
+		if err != nil {
+			log.Debugf("Invalid OTLP logs request: %v", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		// Records that can not be monitored (e.g. too many services) are rejected on their own:
+		// clients retry whole requests, which would diagnose the records delivered twice
+		rejected := 0
+		for _, record := range records {
+			if !demux.Send(record.Stream, record.Text, record.Variables) {
+				rejected++
+			}
+		}
+
+		// Empty ExportLogsServiceResponse unless some records were rejected (partial success)
+		response := &collogspb.ExportLogsServiceResponse{}
+		if rejected > 0 {
+			log.Warnf("Rejected (%d) of (%d) OTLP log records", rejected, len(records))
+			response.PartialSuccess = &collogspb.ExportLogsPartialSuccess{
+				RejectedLogRecords: int64(rejected),
+				ErrorMessage:       "log streams are not monitored (too many of them)",
+			}
+		}
+		var out []byte
+		if mediaType == "application/json" {
+			out, err = protojson.Marshal(response)
+		} else {
+			out, err = proto.Marshal(response)
+		}
+		if err != nil {
+			http.Error(w, "failed to encode response", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", mediaType)
+		w.WriteHeader(http.StatusOK)
+		w.Write(out)
+	})
+}
+
+// Decode decodes an export logs request (protobuf or JSON encoded) into log records
+func Decode(data []byte, isJSON bool) ([]Record, error) {
+	request := &collogspb.ExportLogsServiceRequest{}
+	if isJSON {
+		var jsonRequest exportRequest
+		err := json.Unmarshal(data, &jsonRequest)
+		if err != nil {
+			return nil, fmt.Errorf("invalid OTLP/JSON logs request: %w", err)
+		}
+		request, err = jsonRequest.proto()
+		if err != nil {
+			return nil, fmt.Errorf("invalid OTLP/JSON logs request: %w", err)
+		}
+	} else {
+		err := proto.Unmarshal(data, request)
+		if err != nil {
+			return nil, fmt.Errorf("invalid OTLP/protobuf logs request: %w", err)
+		}
+	}
+
+	var records []Record
+	for _, resourceLogs := range request.ResourceLogs {
+		stream := defaultStream
+		resource := map[string]string{}
+		for _, kv := range resourceLogs.GetResource().GetAttributes() {
+			resource[VariableResource+"."+kv.Key] = stringify(kv.Value)
+			if kv.Key == "service.name" && kv.Value.GetStringValue() != "" {
+				stream = kv.Value.GetStringValue()
+			}
+		}
+		for _, scopeLogs := range resourceLogs.ScopeLogs {
+			for _, record := range scopeLogs.LogRecords {
+				variables := map[string]string{
+					VariableSeverityText:   severityText(record),
+					VariableSeverityNumber: strconv.Itoa(int(record.SeverityNumber)),
+					VariableTimestamp:      timestamp(record),
+					VariableTraceID:        hex.EncodeToString(record.TraceId),
+					VariableSpanID:         hex.EncodeToString(record.SpanId),
+					VariableScope:          scopeLogs.GetScope().GetName(),
+				}
+				for name, value := range resource {
+					variables[name] = value
+				}
+				for _, kv := range record.Attributes {
+					variables[VariableAttribute+"."+kv.Key] = stringify(kv.Value)
+				}
+				records = append(records, Record{
+					Stream:    stream,
+					Text:      stringify(record.Body),
+					Variables: variables,
+				})
+			}
+		}
+	}
+	return records, nil
+}
+
+// severityText falls back to the text of the severity number range when the record has none
+func severityText(record *logspb.LogRecord) string {
+	if record.SeverityText != "" || record.SeverityNumber <= 0 {
+		return record.SeverityText
+	}
+	i := (int(record.SeverityNumber) - 1) / 4
+	if i >= len(severities) {
+		return ""
+	}
+	return severities[i]
+}
+
+// timestamp of the event, falling back to the time it was observed at
+func timestamp(record *logspb.LogRecord) string {
+	nanos := record.TimeUnixNano
+	if nanos == 0 {
+		nanos = record.ObservedTimeUnixNano
+	}
+	if nanos == 0 {
+		return ""
+	}
+	return time.Unix(0, int64(nanos)).UTC().Format(time.RFC3339Nano)
+}
+
+// stringify returns strings as is and any other value as JSON
+func stringify(value *commonpb.AnyValue) string {
+	switch v := value.GetValue().(type) {
+	case *commonpb.AnyValue_StringValue:
+		return v.StringValue
+	case *commonpb.AnyValue_BoolValue:
+		return strconv.FormatBool(v.BoolValue)
+	case *commonpb.AnyValue_IntValue:
+		return strconv.FormatInt(v.IntValue, 10)
+	case *commonpb.AnyValue_DoubleValue:
+		return strconv.FormatFloat(v.DoubleValue, 'g', -1, 64)
+	case *commonpb.AnyValue_BytesValue:
+		return base64.StdEncoding.EncodeToString(v.BytesValue)
+	case nil:
+		return ""
+	}
+	data, err := json.Marshal(toJSON(value))
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
+
+// toJSON converts array and key-value list values into their natural JSON form
+func toJSON(value *commonpb.AnyValue) interface{} {
+	switch v := value.GetValue().(type) {
+	case *commonpb.AnyValue_ArrayValue:
+		values := make([]interface{}, 0, len(v.ArrayValue.GetValues()))
+		for _, item := range v.ArrayValue.GetValues() {
+			values = append(values, toJSON(item))
+		}
+		return values
+	case *commonpb.AnyValue_KvlistValue:
+		values := make(map[string]interface{}, len(v.KvlistValue.GetValues()))
+		for _, kv := range v.KvlistValue.GetValues() {
+			values[kv.Key] = toJSON(kv.Value)
+		}
+		return values
+	case *commonpb.AnyValue_BoolValue:
+		return v.BoolValue
+	case *commonpb.AnyValue_IntValue:
+		return v.IntValue
+	case *commonpb.AnyValue_DoubleValue:
+		return v.DoubleValue
+	}
+	return stringify(value)
+}
@@ -0,0 +1,228 @@
+package otlp
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/ingyamilmolinar/doctorgpt/agent/internal/input"
+	"github.com/ingyamilmolinar/doctorgpt/agent/internal/tailer"
+	collogspb "go.opentelemetry.io/proto/otlp/collector/logs/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	logspb "go.opentelemetry.io/proto/otlp/logs/v1"
+	resourcepb "go.opentelemetry.io/proto/otlp/resource/v1"
+)
+
+var logger, _ = zap.NewDevelopment()
+
+const jsonRequest = `{
+  "resourceLogs": [{
+    "resource": {"attributes": [
+      {"key": "service.name", "value": {"stringValue": "checkout"}},
+      {"key": "host.cpus", "value": {"intValue": "8"}}
+    ]},
+    "scopeLogs": [{
+      "scope": {"name": "checkout.payments"},
+      "logRecords": [{
+        "timeUnixNano": "1690000000000000000",
+        "severityNumber": 17,
+        "body": {"stringValue": "payment failed"},
+        "traceId": "5b8efff798038103d269b633813fc60c",
+        "spanId": "eee19b7ec3c1b174",
+        "attributes": [
+          {"key": "http.status_code", "value": {"intValue": 502}},
+          {"key": "retry", "value": {"boolValue": true}}
+        ]
+      }, {
+        "severityText": "Information",
+        "observedTimeUnixNano": 1690000000500000000,
+        "body": {"kvlistValue": {"values": [{"key": "msg", "value": {"stringValue": "done"}}]}}
+      }]
+    }]
+  }]
+}`
+
+func TestDecodeJSON(t *testing.T) {
+	records, err := Decode([]byte(jsonRequest), true)
+	require.NoError(t, err)
+	require.Len(t, records, 2)
+
+	require.Equal(t, "checkout", records[0].Stream)
+	require.Equal(t, "payment failed", records[0].Text)
+	require.Equal(t, map[string]string{
+		"SEVERITY_TEXT":              "ERROR",
+		"SEVERITY_NUMBER":            "17",
+		"TIMESTAMP":                  "2023-07-22T04:26:40Z",
+		"TRACE_ID":                   "5b8efff798038103d269b633813fc60c",
+		"SPAN_ID":                    "eee19b7ec3c1b174",
+		"SCOPE":                      "checkout.payments",
+		"RESOURCE.service.name":      "checkout",
+		"RESOURCE.host.cpus":         "8",
+		"ATTRIBUTE.http.status_code": "502",
+		"ATTRIBUTE.retry":            "true",
+	}, records[0].Variables)
+
+	require.Equal(t, `{"msg":"done"}`, records[1].Text)
+	require.Equal(t, "Information", records[1].Variables["SEVERITY_TEXT"])
+	require.Equal(t, "2023-07-22T04:26:40.5Z", records[1].Variables["TIMESTAMP"])
+	require.Equal(t, "", records[1].Variables["TRACE_ID"])
+
+	_, err = Decode([]byte(`{"resourceLogs": [{"scopeLogs": [{"logRecords": [{"traceId": "not hex"}]}]}]}`), true)
+	require.Error(t, err)
+}
+
+func TestHandler(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	var mu sync.Mutex
+	received := map[string][]tailer.Line{}
+	demux := input.NewDemux(ctx, logger.Sugar(), input.DefaultMaxSources, input.DefaultSourceTTL, func(ctx context.Context, name string, lines <-chan tailer.Line) {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case line := <-lines:
+				mu.Lock()
+				received[name] = append(received[name], line)
+				mu.Unlock()
+			}
+		}
+	})
+	defer func() {
+		cancel()
+		demux.Wait()
+	}()
+	server := httptest.NewServer(Handler(logger.Sugar(), demux, "secret"))
+	defer server.Close()
+
+	post := func(contentType string, body []byte, gzipped bool) int {
+		if gzipped {
+			var buf bytes.Buffer
+			gz := gzip.NewWriter(&buf)
+			gz.Write(body)
+			gz.Close()
+			body = buf.Bytes()
+		}
+		req, err := http.NewRequest(http.MethodPost, server.URL+Path, bytes.NewReader(body))
+		require.NoError(t, err)
+		req.Header.Set("Content-Type", contentType)
+		req.Header.Set("Authorization", "Bearer secret")
+		if gzipped {
+			req.Header.Set("Content-Encoding", "gzip")
+		}
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	request := &collogspb.ExportLogsServiceRequest{
+		ResourceLogs: []*logspb.ResourceLogs{{
+			Resource: &resourcepb.Resource{Attributes: []*commonpb.KeyValue{{
+				Key:   "service.name",
+				Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: "billing"}},
+			}}},
+			ScopeLogs: []*logspb.ScopeLogs{{
+				LogRecords: []*logspb.LogRecord{{
+					SeverityText: "ERROR",
+					Body:         &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: "invoice failed"}},
+					TraceId:      []byte{0x5b, 0x8e, 0xff, 0xf7, 0x98, 0x03, 0x81, 0x03, 0xd2, 0x69, 0xb6, 0x33, 0x81, 0x3f, 0xc6, 0x0c},
+				}},
+			}},
+		}, {
+			ScopeLogs: []*logspb.ScopeLogs{{
+				LogRecords: []*logspb.LogRecord{{
+					SeverityNumber: logspb.SeverityNumber_SEVERITY_NUMBER_WARN,
+					Body:           &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: "no service"}},
+				}},
+			}},
+		}},
+	}
+	data, err := proto.Marshal(request)
+	require.NoError(t, err)
+
+	require.Equal(t, http.StatusOK, post("application/x-protobuf", data, false))
+	require.Equal(t, http.StatusOK, post("application/json", []byte(jsonRequest), true))
+	require.Equal(t, http.StatusBadRequest, post("application/x-protobuf", []byte("not protobuf"), false))
+	require.Equal(t, http.StatusUnsupportedMediaType, post("text/plain", []byte("ERROR"), false))
+
+	// Every service has its own line numbers
+	require.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(received["billing"]) == 1 && len(received["otlp"]) == 1 && len(received["checkout"]) == 2
+	}, time.Second, 5*time.Millisecond)
+	mu.Lock()
+	defer mu.Unlock()
+	require.Equal(t, "invoice failed", received["billing"][0].Text)
+	require.Equal(t, "5b8efff798038103d269b633813fc60c", received["billing"][0].Variables["TRACE_ID"])
+	require.Equal(t, "WARN", received["otlp"][0].Variables["SEVERITY_TEXT"])
+	require.Equal(t, 2, received["checkout"][1].Position.Line)
+}
+
+func TestHandlerPartialSuccess(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	var mu sync.Mutex
+	received := map[string]int{}
+	// A single service can be monitored
+	demux := input.NewDemux(ctx, logger.Sugar(), 1, input.DefaultSourceTTL, func(ctx context.Context, name string, lines <-chan tailer.Line) {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-lines:
+				mu.Lock()
+				received[name]++
+				mu.Unlock()
+			}
+		}
+	})
+	defer func() {
+		cancel()
+		demux.Wait()
+	}()
+	server := httptest.NewServer(Handler(logger.Sugar(), demux, ""))
+	defer server.Close()
+
+	record := func(service string) *logspb.ResourceLogs {
+		return &logspb.ResourceLogs{
+			Resource: &resourcepb.Resource{Attributes: []*commonpb.KeyValue{{
+				Key:   "service.name",
+				Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: service}},
+			}}},
+			ScopeLogs: []*logspb.ScopeLogs{{
+				LogRecords: []*logspb.LogRecord{{Body: &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: "failed"}}}},
+			}},
+		}
+	}
+	data, err := proto.Marshal(&collogspb.ExportLogsServiceRequest{ResourceLogs: []*logspb.ResourceLogs{record("billing"), record("cart")}})
+	require.NoError(t, err)
+	resp, err := http.Post(server.URL+Path, "application/x-protobuf", bytes.NewReader(data))
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.NoError(t, err)
+
+	// The records of the service over the limit are rejected, not the whole request (it is not retried)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	response := &collogspb.ExportLogsServiceResponse{}
+	require.NoError(t, proto.Unmarshal(body, response))
+	require.Equal(t, int64(1), response.PartialSuccess.GetRejectedLogRecords())
+	require.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return received["billing"] == 1
+	}, time.Second, 5*time.Millisecond)
+	mu.Lock()
+	require.Zero(t, received["cart"])
+	mu.Unlock()
+}
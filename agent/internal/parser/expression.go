@@ -0,0 +1,333 @@
+package parser
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"go.uber.org/zap"
+)
+
+// Expressions combine variable conditions with boolean operators, for example:
+//
+//	LEVEL =~ "ERROR" && !(MESSAGE =~ "HTTP 401") && SERVICE == "billing"
+//
+// Conditions are a variable, an operator and a value (quoted, or a bare word such as
+// 500 or 2s). Operators are =~ and !~ (regex), the comparison operators (==, !=, <,
+// <=, >, >=) and "older than"/"newer than" (timestamps). ! binds tighter than &&,
+// which binds tighter than ||.
+
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenWord
+	tokenString
+	tokenOperator
+	tokenAnd
+	tokenOr
+	tokenNot
+	tokenOpen
+	tokenClose
+)
+
+// Regex operators (comparison operators are shared with compare)
+const (
+	regexMatch    = "=~"
+	regexNotMatch = "!~"
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	// Position of the token in the expression (starting at 1)
+	pos int
+}
+
+func (t token) String() string {
+	if t.kind == tokenEOF {
+		return "end of expression"
+	}
+	return fmt.Sprintf("(%s)", t.text)
+}
+
+// lex splits the expression into tokens
+func lex(expression string) ([]token, error) {
+	var tokens []token
+	for i := 0; i < len(expression); {
+		c := expression[i]
+		rest := expression[i:]
+		pos := i + 1
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+			continue
+		case c == '(' || c == ')':
+			kind := tokenOpen
+			if c == ')' {
+				kind = tokenClose
+			}
+			tokens = append(tokens, token{kind, string(c), pos})
+			i++
+			continue
+		case strings.HasPrefix(rest, "&&"):
+			tokens = append(tokens, token{tokenAnd, "&&", pos})
+			i += 2
+			continue
+		case strings.HasPrefix(rest, "||"):
+			tokens = append(tokens, token{tokenOr, "||", pos})
+			i += 2
+			continue
+		case c == '"' || c == '`':
+			end := closingQuote(expression, i)
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated string at position %d", pos)
+			}
+			value, err := strconv.Unquote(expression[i : end+1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid string at position %d: %w", pos, err)
+			}
+			tokens = append(tokens, token{tokenString, value, pos})
+			i = end + 1
+			continue
+		}
+		operator := ""
+		for _, o := range append([]string{regexMatch, regexNotMatch}, operators...) {
+			if strings.HasPrefix(rest, o) {
+				operator = o
+				break
+			}
+		}
+		if operator != "" {
+			tokens = append(tokens, token{tokenOperator, operator, pos})
+			i += len(operator)
+			continue
+		}
+		if c == '!' {
+			tokens = append(tokens, token{tokenNot, "!", pos})
+			i++
+			continue
+		}
+		end := i
+		for end < len(expression) && isWordByte(expression[end]) {
+			end++
+		}
+		if end == i {
+			return nil, fmt.Errorf("unexpected character (%c) at position %d", c, pos)
+		}
+		tokens = append(tokens, token{tokenWord, expression[i:end], pos})
+		i = end
+	}
+	return append(tokens, token{tokenEOF, "", len(expression) + 1}), nil
+}
+
+// closingQuote returns the index of the quote closing the string starting at start (-1 if none)
+func closingQuote(expression string, start int) int {
+	quote := expression[start]
+	for i := start + 1; i < len(expression); i++ {
+		switch {
+		case expression[i] == '\\' && quote == '"':
+			i++
+		case expression[i] == quote:
+			return i
+		}
+	}
+	return -1
+}
+
+// isWordByte checks whether the byte is part of variable names and bare values
+func isWordByte(c byte) bool {
+	return c >= 0x80 || unicode.IsLetter(rune(c)) || unicode.IsDigit(rune(c)) || strings.IndexByte("_.-+:/", c) >= 0
+}
+
+// expressionParser is a recursive descent parser of expressions
+type expressionParser struct {
+	log         *zap.SugaredLogger
+	tokens      []token
+	next        int
+	variableSet map[string]bool
+	types       map[string]Type
+}
+
+// newExpression compiles the expression, checking its variables against variableSet (unless it is nil)
+func newExpression(log *zap.SugaredLogger, kind, expression string, variableSet map[string]bool, types map[string]Type) (Matcher, error) {
+	tokens, err := lex(expression)
+	if err != nil {
+		return nil, fmt.Errorf("expression (%s) in %s is not valid: %w", expression, kind, err)
+	}
+	p := &expressionParser{log: log, tokens: tokens, variableSet: variableSet, types: types}
+	m, err := p.or()
+	if err == nil && p.peek().kind != tokenEOF {
+		err = p.unexpected("&&, || or end of expression")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("expression (%s) in %s is not valid: %w", expression, kind, err)
+	}
+	log.Debugf("Expression (%s) compiled to (%v)", expression, m)
+	return m, nil
+}
+
+func (p *expressionParser) peek() token {
+	return p.tokens[p.next]
+}
+
+func (p *expressionParser) advance() token {
+	t := p.tokens[p.next]
+	if t.kind != tokenEOF {
+		p.next++
+	}
+	return t
+}
+
+func (p *expressionParser) unexpected(expected string) error {
+	t := p.peek()
+	return fmt.Errorf("expected %s but found %v at position %d", expected, t, t.pos)
+}
+
+func (p *expressionParser) or() (Matcher, error) {
+	left, err := p.and()
+	if err != nil {
+		return nil, err
+	}
+	matchers := or{left}
+	for p.peek().kind == tokenOr {
+		p.advance()
+		right, err := p.and()
+		if err != nil {
+			return nil, err
+		}
+		matchers = append(matchers, right)
+	}
+	if len(matchers) == 1 {
+		return left, nil
+	}
+	return matchers, nil
+}
+
+func (p *expressionParser) and() (Matcher, error) {
+	left, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+	matchers := and{left}
+	for p.peek().kind == tokenAnd {
+		p.advance()
+		right, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		matchers = append(matchers, right)
+	}
+	if len(matchers) == 1 {
+		return left, nil
+	}
+	return matchers, nil
+}
+
+func (p *expressionParser) unary() (Matcher, error) {
+	switch p.peek().kind {
+	case tokenNot:
+		p.advance()
+		m, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return not{m}, nil
+	case tokenOpen:
+		p.advance()
+		m, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		if p.peek().kind != tokenClose {
+			return nil, p.unexpected("a closing parenthesis")
+		}
+		p.advance()
+		return m, nil
+	}
+	return p.condition()
+}
+
+// condition parses "VARIABLE operator value"
+func (p *expressionParser) condition() (Matcher, error) {
+	if p.peek().kind != tokenWord {
+		return nil, p.unexpected("a variable, ! or (")
+	}
+	variable := p.advance()
+	if p.variableSet != nil && !inVariableSet(p.variableSet, variable.text) {
+		return nil, fmt.Errorf("variable (%s) at position %d is not a regex variable", variable.text, variable.pos)
+	}
+
+	operator := p.peek()
+	switch {
+	case operator.kind == tokenOperator:
+		p.advance()
+	case operator.kind == tokenWord && (operator.text == "older" || operator.text == "newer"):
+		p.advance()
+		if p.peek().kind != tokenWord || p.peek().text != "than" {
+			return nil, p.unexpected("(than)")
+		}
+		p.advance()
+		operator.text += " than"
+	default:
+		return nil, p.unexpected("an operator (=~, !~, " + strings.Join(operators, ", ") + ", " + olderThan + " or " + newerThan + ")")
+	}
+
+	value := p.peek()
+	if value.kind != tokenWord && value.kind != tokenString {
+		return nil, p.unexpected("a value")
+	}
+	p.advance()
+
+	var m Matcher
+	var err error
+	switch operator.text {
+	case regexMatch, regexNotMatch:
+		var re matcher
+		re, err = newRegexMatcher(p.log, variable.text, value.text)
+		// Entries without the variable match neither operator
+		re.invert = operator.text == regexNotMatch
+		m = re
+	default:
+		m, err = newOperatorComparison(p.log, variable.text, operator.text, value.text, p.types)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("condition at position %d: %w", variable.pos, err)
+	}
+	return m, nil
+}
+
+// and matches when all of its matchers do
+type and []Matcher
+
+func (a and) Match(entry LogEntry, now time.Time) bool {
+	for _, m := range a {
+		if !m.Match(entry, now) {
+			return false
+		}
+	}
+	return true
+}
+
+// or matches when any of its matchers does
+type or []Matcher
+
+func (o or) Match(entry LogEntry, now time.Time) bool {
+	for _, m := range o {
+		if m.Match(entry, now) {
+			return true
+		}
+	}
+	return false
+}
+
+// not matches when its matcher does not
+type not struct {
+	Matcher
+}
+
+func (n not) Match(entry LogEntry, now time.Time) bool {
+	return !n.Matcher.Match(entry, now)
+}
@@ -0,0 +1,82 @@
+package parser
+
+import (
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/ingyamilmolinar/doctorgpt/agent/internal/config"
+)
+
+// Last log lines sent along with heartbeat diagnoses when not configured
+const DefaultHeartbeatLines = 50
+
+// Heartbeat expects log entries matching Matcher at least every Interval
+type Heartbeat struct {
+	Matcher Matcher
+	// Matcher as configured (for the prompt)
+	Description string
+	Interval    time.Duration
+	// Last log lines before the silence sent along with the diagnosis
+	Lines int
+	// Glob of the log sources whose entries count (any if empty)
+	Source string
+}
+
+// Watches checks whether the heartbeat counts the log entries of the named log source
+// (the glob is matched against the whole name and against its base name)
+func (h Heartbeat) Watches(source string) bool {
+	if h.Source == "" {
+		return true
+	}
+	if ok, _ := filepath.Match(h.Source, source); ok {
+		return true
+	}
+	ok, _ := filepath.Match(h.Source, filepath.Base(source))
+	return ok
+}
+
+func newHeartbeats(log *zap.SugaredLogger, p Parser, cfgs []config.HeartbeatConfig) ([]Heartbeat, error) {
+	var heartbeats []Heartbeat
+	for _, cfg := range cfgs {
+		if cfg.Interval <= 0 {
+			return nil, fmt.Errorf("heartbeat interval (%s) must be positive", cfg.Interval)
+		}
+		if cfg.Lines < 0 {
+			return nil, fmt.Errorf("heartbeat lines (%d) can not be negative", cfg.Lines)
+		}
+		if _, err := filepath.Match(cfg.Source, ""); err != nil {
+			return nil, fmt.Errorf("heartbeat source (%s) is not a valid glob: %w", cfg.Source, err)
+		}
+		matchers, err := newMatchers(log, "heartbeat", []config.VariableMatcher{cfg.Matcher}, p.variableSet(), p.Types)
+		if err != nil {
+			return nil, err
+		}
+		h := Heartbeat{
+			Matcher:     matchers[0],
+			Description: describe(cfg.Matcher),
+			Interval:    cfg.Interval,
+			Lines:       cfg.Lines,
+			Source:      cfg.Source,
+		}
+		if h.Lines == 0 {
+			h.Lines = DefaultHeartbeatLines
+		}
+		log.Debugf("Heartbeat: matcher (%s), interval (%s), lines (%d), source (%s)", h.Description, h.Interval, h.Lines, h.Source)
+		heartbeats = append(heartbeats, h)
+	}
+	return heartbeats, nil
+}
+
+// describe writes a matcher as an expression
+func describe(m config.VariableMatcher) string {
+	switch {
+	case m.Expression != "":
+		return m.Expression
+	case m.Compare != "":
+		return m.Variable + " " + m.Compare
+	}
+	return fmt.Sprintf("%s =~ %q", m.Variable, m.Regex)
+}
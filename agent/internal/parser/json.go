@@ -0,0 +1,67 @@
+package parser
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"go.uber.org/zap"
+
+	"github.com/ingyamilmolinar/doctorgpt/agent/internal/config"
+)
+
+// NewJSONParser builds a parser for structured logs with one JSON object per line.
+// Every field becomes a variable (nested fields are flattened using dotted paths).
+func NewJSONParser(log *zap.SugaredLogger, filtersRegex, triggersRegex, excludesRegex []config.VariableMatcher) (Parser, error) {
+	return newStructuredParser(log, KindJSON, nil, filtersRegex, triggersRegex, excludesRegex)
+}
+
+func parseJSON(log *zap.SugaredLogger, line string) (map[string]string, error) {
+	decoder := json.NewDecoder(strings.NewReader(line))
+	decoder.UseNumber()
+	var object map[string]interface{}
+	err := decoder.Decode(&object)
+	if err != nil || decoder.More() {
+		log.Debugf("JSON parser did not match line (%s)", line)
+		return nil, fmt.Errorf("json parser did not match line (%s)", line)
+	}
+
+	result := make(map[string]string)
+	flatten("", object, result)
+	for variable, value := range result {
+		log.Debugf("Variable: (%s), Match: (%s)", variable, value)
+	}
+	return result, nil
+}
+
+// flatten stores every leaf value of a decoded JSON value under its dotted path
+func flatten(path string, value interface{}, result map[string]string) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, child := range v {
+			flatten(join(path, key), child, result)
+		}
+	case []interface{}:
+		for i, child := range v {
+			flatten(join(path, strconv.Itoa(i)), child, result)
+		}
+	case string:
+		result[path] = v
+	case json.Number:
+		result[path] = v.String()
+	case bool:
+		result[path] = strconv.FormatBool(v)
+	case nil:
+		result[path] = ""
+	default:
+		result[path] = fmt.Sprintf("%v", v)
+	}
+}
+
+func join(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
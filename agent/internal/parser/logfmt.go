@@ -0,0 +1,82 @@
+package parser
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"go.uber.org/zap"
+
+	"github.com/ingyamilmolinar/doctorgpt/agent/internal/config"
+)
+
+// NewLogfmtParser builds a parser for logfmt (key=value) logs. Every key becomes a variable.
+func NewLogfmtParser(log *zap.SugaredLogger, filtersRegex, triggersRegex, excludesRegex []config.VariableMatcher) (Parser, error) {
+	return newStructuredParser(log, KindLogfmt, nil, filtersRegex, triggersRegex, excludesRegex)
+}
+
+// parseLogfmt decodes lines like: level=error msg="db timeout" dur=3s
+// Every token must be a key=value pair, otherwise the line is not considered logfmt.
+func parseLogfmt(log *zap.SugaredLogger, line string) (map[string]string, error) {
+	result := make(map[string]string)
+	rest := strings.TrimSpace(line)
+	for rest != "" {
+		// Read key
+		end := strings.IndexAny(rest, "= \t\"")
+		if end <= 0 || rest[end] != '=' {
+			log.Debugf("Logfmt parser did not match line (%s)", line)
+			return nil, fmt.Errorf("logfmt parser did not match line (%s)", line)
+		}
+		key := rest[:end]
+		rest = rest[end+1:]
+
+		// Read value (quoted or bare)
+		var value string
+		if strings.HasPrefix(rest, "\"") {
+			quoted, err := quotedPrefix(rest)
+			if err != nil {
+				log.Debugf("Logfmt parser did not match line (%s): %v", line, err)
+				return nil, fmt.Errorf("logfmt parser did not match line (%s): %w", line, err)
+			}
+			value, err = strconv.Unquote(quoted)
+			if err != nil {
+				log.Debugf("Logfmt parser did not match line (%s): %v", line, err)
+				return nil, fmt.Errorf("logfmt parser did not match line (%s): %w", line, err)
+			}
+			rest = rest[len(quoted):]
+			if rest != "" && rest[0] != ' ' && rest[0] != '\t' {
+				return nil, fmt.Errorf("logfmt parser did not match line (%s)", line)
+			}
+		} else {
+			end := strings.IndexAny(rest, " \t")
+			if end == -1 {
+				end = len(rest)
+			}
+			value = rest[:end]
+			rest = rest[end:]
+		}
+		result[key] = value
+		log.Debugf("Variable: (%s), Match: (%s)", key, value)
+		rest = strings.TrimLeft(rest, " \t")
+	}
+	if len(result) == 0 {
+		return nil, fmt.Errorf("logfmt parser did not match line (%s)", line)
+	}
+	return result, nil
+}
+
+// quotedPrefix returns the double quoted string at the start of s (quotes included)
+func quotedPrefix(s string) (string, error) {
+	escaped := false
+	for i := 1; i < len(s); i++ {
+		switch {
+		case escaped:
+			escaped = false
+		case s[i] == '\\':
+			escaped = true
+		case s[i] == '"':
+			return s[:i+1], nil
+		}
+	}
+	return "", fmt.Errorf("unterminated quoted value (%s)", s)
+}
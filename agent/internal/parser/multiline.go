@@ -0,0 +1,98 @@
+package parser
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/ingyamilmolinar/doctorgpt/agent/internal/config"
+)
+
+// Defaults of the multi-line settings
+const (
+	DefaultMultilineMaxLines     = 500
+	DefaultMultilineFlushTimeout = time.Second
+)
+
+// Multiline joins the lines of a log entry (e.g. a stack trace) into a single one
+type Multiline struct {
+	// First line regex (lines matched by the parser if nil)
+	Start *regexp.Regexp
+	// Following lines regex (lines not starting an entry if nil)
+	Continuation *regexp.Regexp
+	MaxLines     int
+	FlushTimeout time.Duration
+}
+
+func newMultiline(log *zap.SugaredLogger, cfg config.MultilineConfig) (*Multiline, error) {
+	m := &Multiline{
+		MaxLines:     cfg.MaxLines,
+		FlushTimeout: cfg.FlushTimeout,
+	}
+	var err error
+	if cfg.Start != "" {
+		m.Start, err = regexp.Compile(cfg.Start)
+		if err != nil {
+			return nil, fmt.Errorf("multiline start regex is not valid (%s)", cfg.Start)
+		}
+	}
+	if cfg.Continuation != "" {
+		m.Continuation, err = regexp.Compile(cfg.Continuation)
+		if err != nil {
+			return nil, fmt.Errorf("multiline continuation regex is not valid (%s)", cfg.Continuation)
+		}
+	}
+	if m.MaxLines < 0 || m.FlushTimeout < 0 {
+		return nil, fmt.Errorf("multiline maxLines (%d) and flushTimeout (%s) can not be negative", m.MaxLines, m.FlushTimeout)
+	}
+	if m.MaxLines == 0 {
+		m.MaxLines = DefaultMultilineMaxLines
+	}
+	if m.FlushTimeout == 0 {
+		m.FlushTimeout = DefaultMultilineFlushTimeout
+	}
+	log.Debugf("Multiline: start (%v), continuation (%v), max lines (%d), flush timeout (%s)", m.Start, m.Continuation, m.MaxLines, m.FlushTimeout)
+	return m, nil
+}
+
+// Matches checks whether the parser can parse the line
+func (p Parser) Matches(log *zap.SugaredLogger, line string) bool {
+	var err error
+	switch p.Kind {
+	case KindJSON:
+		_, err = parseJSON(log, line)
+	case KindLogfmt:
+		_, err = parseLogfmt(log, line)
+	default:
+		return p.Re.MatchString(line)
+	}
+	return err == nil
+}
+
+// Starts checks whether the line is the first one of a multi-line log entry of the parser
+func (p Parser) Starts(log *zap.SugaredLogger, line string) bool {
+	if p.Multiline == nil {
+		return false
+	}
+	if p.Multiline.Start != nil {
+		return p.Multiline.Start.MatchString(line)
+	}
+	return p.Matches(log, line)
+}
+
+// Continues checks whether the line belongs to the multi-line log entry of the parser started before it
+func (p Parser) Continues(log *zap.SugaredLogger, line string) bool {
+	if p.Multiline.Continuation != nil {
+		return p.Multiline.Continuation.MatchString(line)
+	}
+	return !p.Starts(log, line)
+}
+
+// firstLine is the part of multi-line log entries matched by regex and logfmt parsers
+func firstLine(text string) string {
+	line, _, _ := strings.Cut(text, "\n")
+	return line
+}
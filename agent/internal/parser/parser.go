@@ -5,29 +5,37 @@ import (
 	"go.uber.org/zap"
 	"regexp"
 	"strconv"
+	"time"
 
+	"github.com/ingyamilmolinar/doctorgpt/agent/internal/clock"
 	"github.com/ingyamilmolinar/doctorgpt/agent/internal/config"
 )
 
 // Struct representing a single log entry (message can be a multi-line string)
 type LogEntry struct {
-	Parser    *Parser
+	Parser    *Parser `json:"-"`
 	Triggered bool
 	Filtered  bool
 	Excluded  bool
 	Text      string
 	LineNo    int
-	// TODO: Support date and time
-	// TODO: Support matching on other types
+	// Time of the log entry (its timestamp variable), zero if unknown
+	Time      time.Time
 	Variables map[string]string
 }
 
 // Parse a log line into a LogEntry object
 func ParseLogEntry(log *zap.SugaredLogger, parsers []Parser, line string, lineNum int) (LogEntry, int, error) {
+	return ParseLogEntryWithVariables(log, parsers, line, lineNum, nil, nil)
+}
+
+// ParseLogEntryWithVariables parses a log line adding the variables set by its source.
+// The clock of the source (if any) is moved to the time of the entry.
+func ParseLogEntryWithVariables(log *zap.SugaredLogger, parsers []Parser, line string, lineNum int, variables map[string]string, logClock *clock.Clock) (LogEntry, int, error) {
 	var entry LogEntry
 	var err error
 	for i, parser := range parsers {
-		entry, err = parser.Parse(log, line, lineNum)
+		entry, err = parser.ParseWithVariables(log, line, lineNum, variables, logClock)
 		if err == nil {
 			log.Debugf("MATCHED: i (%d): Regex (%s), Line (%s)", i, parser.Regex, line)
 			if entry.Filtered {
@@ -52,17 +60,104 @@ func ParseLogEntry(log *zap.SugaredLogger, parsers []Parser, line string, lineNu
 	return LogEntry{}, 0, fmt.Errorf("No parser found for line (%s)", line)
 }
 
-// TODO: Support parsing structured logging
+// Idle time after which a partition buffer is dropped when not configured
+const DefaultPartitionTTL = 10 * time.Minute
+
+// Parser kinds
+const (
+	KindRegex  = "regex"
+	KindJSON   = "json"
+	KindLogfmt = "logfmt"
+)
+
 type Parser struct {
+	Kind      string
 	Regex     string
 	Re        regexp.Regexp
 	Variables []string
 	Triggers  []Matcher
 	Filters   []Matcher
 	Excludes  []Matcher
+	// Variable used to split log contexts into separate buffers (empty means no partitioning)
+	PartitionBy  string
+	PartitionTTL time.Duration
+	// Multi-line log entries settings (nil means one log entry per line)
+	Multiline *Multiline
+	// Declared variable types and the timestamp variable (if any)
+	Types        map[string]Type
+	TimeVariable string
+	// Rate trigger settings (nil means every trigger match is diagnosed)
+	Rate *Rate
+	// Log entries expected regularly (diagnosed when they stop arriving)
+	Heartbeats []Heartbeat
+	// Variables set by the log sources in use (matched as if the parser had them)
+	SourceVariables SourceVariables
+}
+
+// Build a parser out of its yaml configuration. Its variables are checked against those of its
+// regex and the variables set by the log sources in use.
+func NewParserFromConfig(log *zap.SugaredLogger, cfg config.ParserConfig, sources SourceVariables) (Parser, error) {
+	types, timeVariable, err := newTypes(log, cfg.Types)
+	if err != nil {
+		return Parser{}, err
+	}
+	var p Parser
+	switch cfg.Kind {
+	case "", KindRegex:
+		p, err = newRegexParser(log, cfg.Regex, types, sources, cfg.Filters, cfg.Triggers, cfg.Excludes)
+	case KindJSON, KindLogfmt:
+		p, err = newStructuredParser(log, cfg.Kind, types, cfg.Filters, cfg.Triggers, cfg.Excludes)
+	default:
+		err = fmt.Errorf("unknown parser kind (%s)", cfg.Kind)
+	}
+	if err != nil {
+		return Parser{}, err
+	}
+	for variable := range types {
+		if !p.hasVariable(variable) {
+			return Parser{}, fmt.Errorf("variable (%s) in types is not a regex variable", variable)
+		}
+	}
+	p.Types = types
+	p.TimeVariable = timeVariable
+	if cfg.PartitionBy != "" {
+		if !p.hasVariable(cfg.PartitionBy) {
+			return Parser{}, fmt.Errorf("variable (%s) in partitionBy is not a regex variable", cfg.PartitionBy)
+		}
+		if cfg.PartitionTTL < 0 {
+			return Parser{}, fmt.Errorf("partitionTTL (%s) can not be negative", cfg.PartitionTTL)
+		}
+		p.PartitionBy = cfg.PartitionBy
+		p.PartitionTTL = cfg.PartitionTTL
+		if p.PartitionTTL == 0 {
+			p.PartitionTTL = DefaultPartitionTTL
+		}
+		log.Debugf("Partition by: (%s), TTL: (%s)", p.PartitionBy, p.PartitionTTL)
+	}
+	if cfg.Multiline != nil {
+		p.Multiline, err = newMultiline(log, *cfg.Multiline)
+		if err != nil {
+			return Parser{}, err
+		}
+	}
+	if cfg.Rate != nil {
+		p.Rate, err = newRate(log, p, *cfg.Rate)
+		if err != nil {
+			return Parser{}, err
+		}
+	}
+	p.Heartbeats, err = newHeartbeats(log, p, cfg.Heartbeats)
+	if err != nil {
+		return Parser{}, err
+	}
+	return p, nil
 }
 
 func NewParser(log *zap.SugaredLogger, regex string, filtersRegex, triggersRegex, excludesRegex []config.VariableMatcher) (Parser, error) {
+	return newRegexParser(log, regex, nil, nil, filtersRegex, triggersRegex, excludesRegex)
+}
+
+func newRegexParser(log *zap.SugaredLogger, regex string, types map[string]Type, sources SourceVariables, filtersRegex, triggersRegex, excludesRegex []config.VariableMatcher) (Parser, error) {
 	re, err := regexp.Compile(regex)
 	if err != nil {
 		return Parser{}, err
@@ -81,53 +176,21 @@ func NewParser(log *zap.SugaredLogger, regex string, filtersRegex, triggersRegex
 
 	// We add a special LINENO variable to track the log line num
 	variableSet["LINENO"] = true
-
-	var filters []Matcher
-	for _, filter := range filtersRegex {
-		variable := filter.Variable
-		regex := filter.Regex
-		// check if variable is part of variable list
-		_, ok := variableSet[variable]
-		if !ok {
-			return Parser{}, fmt.Errorf("variable (%s) in filter is not a regex variable", variable)
-		}
-		filter, err := newMatcher(log, variable, regex)
-		if err != nil {
-			return Parser{}, err
-		}
-		filters = append(filters, filter)
+	for _, variable := range sources {
+		variableSet[variable] = true
 	}
 
-	var triggers []Matcher
-	for _, trigger := range triggersRegex {
-		variable := trigger.Variable
-		regex := trigger.Regex
-		// check if variable is part of variable list
-		_, ok := variableSet[variable]
-		if !ok {
-			return Parser{}, fmt.Errorf("variable (%s) in trigger is not a regex variable", variable)
-		}
-		trigger, err := newMatcher(log, variable, regex)
-		if err != nil {
-			return Parser{}, err
-		}
-		triggers = append(triggers, trigger)
+	filters, err := newMatchers(log, "filter", filtersRegex, variableSet, types)
+	if err != nil {
+		return Parser{}, err
 	}
-
-	var excludes []Matcher
-	for _, exclude := range excludesRegex {
-		variable := exclude.Variable
-		regex := exclude.Regex
-		// check if variable is part of variable list
-		_, ok := variableSet[variable]
-		if !ok {
-			return Parser{}, fmt.Errorf("variable (%s) in exclude is not a regex variable", variable)
-		}
-		exclude, err := newMatcher(log, variable, regex)
-		if err != nil {
-			return Parser{}, err
-		}
-		excludes = append(excludes, exclude)
+	triggers, err := newMatchers(log, "trigger", triggersRegex, variableSet, types)
+	if err != nil {
+		return Parser{}, err
+	}
+	excludes, err := newMatchers(log, "exclude", excludesRegex, variableSet, types)
+	if err != nil {
+		return Parser{}, err
 	}
 
 	log.Debugf("New parser: (%s)", regex)
@@ -136,29 +199,112 @@ func NewParser(log *zap.SugaredLogger, regex string, filtersRegex, triggersRegex
 	log.Debugf("Triggers: (%v)", triggers)
 	log.Debugf("Excludes: (%v)", excludes)
 	return Parser{
-		Regex:     regex,
-		Re:        *re,
-		Variables: variables,
-		Filters:   filters,
-		Triggers:  triggers,
-		Excludes:  excludes,
+		Kind:            KindRegex,
+		Regex:           regex,
+		Re:              *re,
+		Variables:       variables,
+		Filters:         filters,
+		Triggers:        triggers,
+		Excludes:        excludes,
+		SourceVariables: sources,
 	}, nil
 }
 
-func (p Parser) Parse(log *zap.SugaredLogger, line string, lineNum int) (LogEntry, error) {
-	matches := p.Re.FindStringSubmatch(line)
-	if len(matches) == 0 {
-		log.Debugf("Parser (%s) did not match line (%s)", p.Regex, line)
-		return LogEntry{}, fmt.Errorf("parser with regex (%s) did not match line (%s)", p.Regex, line)
+// Build a parser for structured logs, whose variables are only known at parsing time
+func newStructuredParser(log *zap.SugaredLogger, kind string, types map[string]Type, filtersRegex, triggersRegex, excludesRegex []config.VariableMatcher) (Parser, error) {
+	filters, err := newMatchers(log, "filter", filtersRegex, nil, types)
+	if err != nil {
+		return Parser{}, err
+	}
+	triggers, err := newMatchers(log, "trigger", triggersRegex, nil, types)
+	if err != nil {
+		return Parser{}, err
+	}
+	excludes, err := newMatchers(log, "exclude", excludesRegex, nil, types)
+	if err != nil {
+		return Parser{}, err
 	}
 
-	result := make(map[string]string)
-	for i, variable := range p.Re.SubexpNames() {
-		if i == 0 || variable == "" {
-			continue
+	log.Debugf("New %s parser", kind)
+	log.Debugf("Filters: (%v)", filters)
+	log.Debugf("Triggers: (%v)", triggers)
+	log.Debugf("Excludes: (%v)", excludes)
+	return Parser{
+		Kind:     kind,
+		Filters:  filters,
+		Triggers: triggers,
+		Excludes: excludes,
+	}, nil
+}
+
+func (p Parser) hasVariable(variable string) bool {
+	// Structured log fields are only known at parsing time
+	if p.Kind != KindRegex || p.SourceVariables.Has(variable) {
+		return true
+	}
+	for _, v := range p.Variables {
+		if v == variable {
+			return true
 		}
-		result[variable] = matches[i]
-		log.Debugf("Variable: (%s), Match: (%s)", variable, matches[i])
+	}
+	return false
+}
+
+// variableSet holds the variables matchers can use (nil when only known at parsing time)
+func (p Parser) variableSet() map[string]bool {
+	if p.Kind != KindRegex {
+		return nil
+	}
+	variableSet := map[string]bool{"LINENO": true}
+	for _, v := range p.Variables {
+		variableSet[v] = true
+	}
+	for _, v := range p.SourceVariables {
+		variableSet[v] = true
+	}
+	return variableSet
+}
+
+// Partition returns the key of the buffer the entry belongs to ("" when it has none)
+func (e LogEntry) Partition() string {
+	if e.Parser == nil || e.Parser.PartitionBy == "" {
+		return ""
+	}
+	value, ok := e.Variables[e.Parser.PartitionBy]
+	if !ok || value == "" {
+		return ""
+	}
+	return e.Parser.PartitionBy + "=" + value
+}
+
+func (p Parser) Parse(log *zap.SugaredLogger, line string, lineNum int) (LogEntry, error) {
+	return p.ParseWithVariables(log, line, lineNum, nil, nil)
+}
+
+// ParseWithVariables parses a log line adding the variables set by its source (which take precedence).
+// Ages of timestamps are relative to the clock of the source (the current time if nil).
+func (p Parser) ParseWithVariables(log *zap.SugaredLogger, line string, lineNum int, variables map[string]string, logClock *clock.Clock) (LogEntry, error) {
+	// Only the first line of multi-line log entries is matched (unless they are JSON)
+	text := line
+	if p.Multiline != nil {
+		text = firstLine(line)
+	}
+	var result map[string]string
+	var err error
+	switch p.Kind {
+	case KindJSON:
+		result, err = parseJSON(log, line)
+	case KindLogfmt:
+		result, err = parseLogfmt(log, text)
+	default:
+		result, err = p.parseRegex(log, text)
+	}
+	if err != nil {
+		return LogEntry{}, err
+	}
+
+	for variable, value := range variables {
+		result[variable] = value
 	}
 
 	// We add a special LINENO variable to match on line num
@@ -171,12 +317,27 @@ func (p Parser) Parse(log *zap.SugaredLogger, line string, lineNum int) (LogEntr
 		LineNo:    lineNum,
 		Variables: result,
 	}
+	now := time.Now()
+	if logClock != nil {
+		now = logClock.Now()
+	}
+	if p.TimeVariable != "" {
+		t, err := p.Types[p.TimeVariable].Parse(result[p.TimeVariable], now)
+		if err == nil {
+			entry.Time = t.(time.Time)
+		} else {
+			log.Debugf("Variable (%s) is not a timestamp (%s): %v", p.TimeVariable, result[p.TimeVariable], err)
+		}
+	}
+	if logClock != nil {
+		logClock.Observe(entry.Time)
+		now = logClock.Now()
+	}
 
 	// Set Filtered
-	// TODO: Support boolean primitives
 	for _, filter := range p.Filters {
 		log.Debugf("Matching filter: (%v)", filter)
-		if filter.Match(entry) {
+		if filter.Match(entry, now) {
 			log.Debugf("Matched filter: (%v)", filter)
 			entry.Filtered = true
 			break
@@ -184,10 +345,9 @@ func (p Parser) Parse(log *zap.SugaredLogger, line string, lineNum int) (LogEntr
 	}
 
 	// Set Triggered
-	// TODO: Support boolean primitives
 	for _, trigger := range p.Triggers {
 		log.Debugf("Matching trigger: (%v)", trigger)
-		if trigger.Match(entry) {
+		if trigger.Match(entry, now) {
 			log.Debugf("Matched trigger: (%v)", trigger)
 			entry.Triggered = true
 			break
@@ -195,10 +355,9 @@ func (p Parser) Parse(log *zap.SugaredLogger, line string, lineNum int) (LogEntr
 	}
 
 	// Set excluded
-	// TODO: Support boolean primitives
 	for _, exclude := range p.Excludes {
 		log.Debugf("Matching exclude: (%v)", exclude)
-		if exclude.Match(entry) {
+		if exclude.Match(entry, now) {
 			log.Debugf("Matched exclude: (%v)", exclude)
 			entry.Excluded = true
 			break
@@ -208,18 +367,81 @@ func (p Parser) Parse(log *zap.SugaredLogger, line string, lineNum int) (LogEntr
 	return entry, nil
 }
 
-// TODO: Composing multiple logical conditions in a single trigger
+func (p Parser) parseRegex(log *zap.SugaredLogger, line string) (map[string]string, error) {
+	matches := p.Re.FindStringSubmatch(line)
+	if len(matches) == 0 {
+		log.Debugf("Parser (%s) did not match line (%s)", p.Regex, line)
+		return nil, fmt.Errorf("parser with regex (%s) did not match line (%s)", p.Regex, line)
+	}
+
+	result := make(map[string]string)
+	for i, variable := range p.Re.SubexpNames() {
+		if i == 0 || variable == "" {
+			continue
+		}
+		result[variable] = matches[i]
+		log.Debugf("Variable: (%s), Match: (%s)", variable, matches[i])
+	}
+	return result, nil
+}
+
 type matcher struct {
 	variable string
 	re       regexp.Regexp
-	log      *zap.SugaredLogger
+	// Match values not matching the regex instead
+	invert bool
+	log    *zap.SugaredLogger
 }
 
+// Matcher matches log entries. Ages of timestamps are relative to now (the time of the log source).
 type Matcher interface {
-	Match(entry LogEntry) bool
+	Match(entry LogEntry, now time.Time) bool
+}
+
+// Build matchers, checking their variables against variableSet (unless it is nil, see inVariableSet)
+func newMatchers(log *zap.SugaredLogger, kind string, variableMatchers []config.VariableMatcher, variableSet map[string]bool, types map[string]Type) ([]Matcher, error) {
+	var matchers []Matcher
+	for _, m := range variableMatchers {
+		if m.Expression != "" {
+			if m.Variable != "" || m.Regex != "" || m.Compare != "" {
+				return nil, fmt.Errorf("expression (%s) in %s can not have a variable, regex or comparison", m.Expression, kind)
+			}
+			matcher, err := newExpression(log, kind, m.Expression, variableSet, types)
+			if err != nil {
+				return nil, err
+			}
+			matchers = append(matchers, matcher)
+			continue
+		}
+		// check if variable is part of variable list
+		if variableSet != nil && !inVariableSet(variableSet, m.Variable) {
+			return nil, fmt.Errorf("variable (%s) in %s is not a regex variable", m.Variable, kind)
+		}
+		if m.Compare != "" {
+			if m.Regex != "" {
+				return nil, fmt.Errorf("variable (%s) in %s has both a regex and a comparison", m.Variable, kind)
+			}
+			matcher, err := newComparison(log, m.Variable, m.Compare, types)
+			if err != nil {
+				return nil, err
+			}
+			matchers = append(matchers, matcher)
+			continue
+		}
+		matcher, err := newMatcher(log, m.Variable, m.Regex)
+		if err != nil {
+			return nil, err
+		}
+		matchers = append(matchers, matcher)
+	}
+	return matchers, nil
 }
 
 func newMatcher(log *zap.SugaredLogger, variable, regex string) (Matcher, error) {
+	return newRegexMatcher(log, variable, regex)
+}
+
+func newRegexMatcher(log *zap.SugaredLogger, variable, regex string) (matcher, error) {
 	re, err := regexp.Compile(regex)
 	if err != nil {
 		return matcher{}, fmt.Errorf("regex is not valid (%s)", regex)
@@ -231,7 +453,7 @@ func newMatcher(log *zap.SugaredLogger, variable, regex string) (Matcher, error)
 	}, nil
 }
 
-func (m matcher) Match(entry LogEntry) bool {
+func (m matcher) Match(entry LogEntry, now time.Time) bool {
 	// Decode entry into json field map
 	m.log.Debugf("Variable (%s) map (%v)", m.variable, entry.Variables)
 	value, ok := entry.Variables[m.variable]
@@ -240,7 +462,7 @@ func (m matcher) Match(entry LogEntry) bool {
 		return false
 	}
 	m.log.Debugf("Trying to match regex (%s)", m.re.String())
-	return m.re.MatchString(value)
+	return m.re.MatchString(value) != m.invert
 }
 
 func Stringify(entries []LogEntry) string {
@@ -0,0 +1,37 @@
+package parser
+
+import (
+	"fmt"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/ingyamilmolinar/doctorgpt/agent/internal/config"
+)
+
+// Rate makes the triggers of a parser diagnose once they match Threshold log entries within
+// Window (counted per value of GroupBy, if any) instead of on every match
+type Rate struct {
+	Threshold int
+	Window    time.Duration
+	// Variable whose values are counted separately (empty means a single count)
+	GroupBy string
+}
+
+func newRate(log *zap.SugaredLogger, p Parser, cfg config.RateConfig) (*Rate, error) {
+	if len(p.Triggers) == 0 {
+		return nil, fmt.Errorf("rate requires triggers")
+	}
+	if cfg.Threshold < 1 {
+		return nil, fmt.Errorf("rate threshold (%d) must be at least 1", cfg.Threshold)
+	}
+	if cfg.Window <= 0 {
+		return nil, fmt.Errorf("rate window (%s) must be positive", cfg.Window)
+	}
+	if cfg.GroupBy != "" && !p.hasVariable(cfg.GroupBy) {
+		return nil, fmt.Errorf("variable (%s) in rate groupBy is not a regex variable", cfg.GroupBy)
+	}
+	r := &Rate{Threshold: cfg.Threshold, Window: cfg.Window, GroupBy: cfg.GroupBy}
+	log.Debugf("Rate: threshold (%d), window (%s), group by (%s)", r.Threshold, r.Window, r.GroupBy)
+	return r, nil
+}
@@ -0,0 +1,231 @@
+package parser
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/ingyamilmolinar/doctorgpt/agent/internal/config"
+)
+
+// Variable types
+const (
+	TypeString    = "string"
+	TypeInt       = "int"
+	TypeFloat     = "float"
+	TypeDuration  = "duration"
+	TypeTimestamp = "timestamp"
+)
+
+// Special timestamp layouts (seconds and milliseconds since the epoch)
+const (
+	LayoutUnix   = "unix"
+	LayoutUnixMs = "unixms"
+)
+
+// Type of a variable
+type Type struct {
+	Name string
+	// Layout of timestamps
+	Layout string
+}
+
+// Build the variable types of a parser. The timestamp variable (at most one) is returned
+// as well since it holds the time of the log entries.
+func newTypes(log *zap.SugaredLogger, cfg map[string]config.TypeConfig) (map[string]Type, string, error) {
+	types := make(map[string]Type, len(cfg))
+	var timeVariable string
+	for variable, c := range cfg {
+		t := Type{Name: c.Type, Layout: c.Layout}
+		switch t.Name {
+		case "":
+			t.Name = TypeString
+		case TypeString, TypeInt, TypeFloat, TypeDuration:
+		case TypeTimestamp:
+			if timeVariable != "" {
+				return nil, "", fmt.Errorf("variables (%s) and (%s) can not both be timestamps", timeVariable, variable)
+			}
+			timeVariable = variable
+			if t.Layout == "" {
+				t.Layout = time.RFC3339
+			}
+		default:
+			return nil, "", fmt.Errorf("unknown type (%s) of variable (%s)", c.Type, variable)
+		}
+		if t.Layout != "" && t.Name != TypeTimestamp {
+			return nil, "", fmt.Errorf("variable (%s) has a layout but is not a timestamp", variable)
+		}
+		log.Debugf("Variable (%s) type (%v)", variable, t)
+		types[variable] = t
+	}
+	return types, timeVariable, nil
+}
+
+// Parse converts the value of a variable into an int64, float64, time.Duration, time.Time or string.
+// Timestamps without a year are placed in the year closest to now.
+func (t Type) Parse(value string, now time.Time) (interface{}, error) {
+	value = strings.TrimSpace(value)
+	switch t.Name {
+	case TypeInt:
+		return strconv.ParseInt(value, 10, 64)
+	case TypeFloat:
+		return strconv.ParseFloat(value, 64)
+	case TypeDuration:
+		return time.ParseDuration(value)
+	case TypeTimestamp:
+		return parseTimestamp(t.Layout, value, now)
+	}
+	return value, nil
+}
+
+func parseTimestamp(layout, value string, now time.Time) (time.Time, error) {
+	switch layout {
+	case LayoutUnix, LayoutUnixMs:
+		number, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return time.Time{}, err
+		}
+		unit := time.Second
+		if layout == LayoutUnixMs {
+			unit = time.Millisecond
+		}
+		return time.Unix(0, int64(number*float64(unit))), nil
+	}
+	// Layouts without a time zone are in the local one (like the logs of most hosts)
+	t, err := time.ParseInLocation(layout, value, time.Local)
+	if err != nil {
+		return time.Time{}, err
+	}
+	// Layouts without a year (e.g. syslog "Jan _2 15:04:05") are within 6 months of now,
+	// which keeps archived logs crossing a new year in order
+	if t.Year() == 0 {
+		t = t.AddDate(now.Year(), 0, 0)
+		switch {
+		case t.Sub(now) > 183*24*time.Hour:
+			t = t.AddDate(-1, 0, 0)
+		case now.Sub(t) > 183*24*time.Hour:
+			t = t.AddDate(1, 0, 0)
+		}
+	}
+	return t, nil
+}
+
+// compareValues returns -1, 0 or 1 if a is less, equal or greater than b (both of the same type)
+func compareValues(a, b interface{}) int {
+	switch a := a.(type) {
+	case int64:
+		return compareOrdered(a, b.(int64))
+	case float64:
+		return compareOrdered(a, b.(float64))
+	case time.Duration:
+		return compareOrdered(a, b.(time.Duration))
+	case time.Time:
+		return a.Compare(b.(time.Time))
+	case string:
+		return strings.Compare(a, b.(string))
+	}
+	return 0
+}
+
+func compareOrdered[T int64 | float64 | time.Duration](a, b T) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// comparison matches typed variables against a value (or timestamps against their age)
+type comparison struct {
+	variable string
+	operator string
+	t        Type
+	value    interface{}
+	// Max (older than) or min (newer than) age of timestamps
+	age time.Duration
+	log *zap.SugaredLogger
+}
+
+// Comparison operators (longest first)
+var operators = []string{"==", "!=", "<=", ">=", "<", ">"}
+
+// Age operators of timestamps
+const (
+	olderThan = "older than"
+	newerThan = "newer than"
+)
+
+func newComparison(log *zap.SugaredLogger, variable, compare string, types map[string]Type) (Matcher, error) {
+	compare = strings.TrimSpace(compare)
+	for _, operator := range append([]string{olderThan, newerThan}, operators...) {
+		if strings.HasPrefix(compare, operator) {
+			return newOperatorComparison(log, variable, operator, strings.TrimPrefix(compare, operator), types)
+		}
+	}
+	return nil, fmt.Errorf("comparison (%s) of variable (%s) has no operator (%s, %s or %s)", compare, variable, strings.Join(operators, ", "), olderThan, newerThan)
+}
+
+// newOperatorComparison compares the variable with the value using one of the operators (or age operators)
+func newOperatorComparison(log *zap.SugaredLogger, variable, operator, value string, types map[string]Type) (Matcher, error) {
+	t, ok := types[variable]
+	if !ok {
+		t = Type{Name: TypeString}
+	}
+	compare := strings.TrimSpace(operator + " " + value)
+	if operator == olderThan || operator == newerThan {
+		if t.Name != TypeTimestamp {
+			return nil, fmt.Errorf("variable (%s) is not a timestamp to compare (%s)", variable, compare)
+		}
+		age, err := time.ParseDuration(strings.TrimSpace(value))
+		if err != nil {
+			return nil, fmt.Errorf("comparison (%s) of variable (%s) is not valid: %w", compare, variable, err)
+		}
+		return comparison{variable: variable, operator: operator, t: t, age: age, log: log}, nil
+	}
+	if t.Name == TypeString && operator != "==" && operator != "!=" {
+		return nil, fmt.Errorf("variable (%s) must be declared as int, float, duration or timestamp to compare (%s)", variable, compare)
+	}
+	parsed, err := t.Parse(value, time.Now())
+	if err != nil {
+		return nil, fmt.Errorf("comparison (%s) of variable (%s) is not valid: %w", compare, variable, err)
+	}
+	return comparison{variable: variable, operator: operator, t: t, value: parsed, log: log}, nil
+}
+
+func (c comparison) Match(entry LogEntry, now time.Time) bool {
+	raw, ok := entry.Variables[c.variable]
+	if !ok {
+		c.log.Debugf("Variable not found in entry (%s)", entry.Text)
+		return false
+	}
+	value, err := c.t.Parse(raw, now)
+	if err != nil {
+		c.log.Debugf("Variable (%s) is not a %s (%s): %v", c.variable, c.t.Name, raw, err)
+		return false
+	}
+	switch c.operator {
+	case olderThan:
+		return now.Sub(value.(time.Time)) > c.age
+	case newerThan:
+		return now.Sub(value.(time.Time)) < c.age
+	}
+	result := compareValues(value, c.value)
+	switch c.operator {
+	case "==":
+		return result == 0
+	case "!=":
+		return result != 0
+	case "<":
+		return result < 0
+	case "<=":
+		return result <= 0
+	case ">":
+		return result > 0
+	}
+	return result >= 0
+}
@@ -0,0 +1,32 @@
+package parser
+
+import "strings"
+
+// SourceVariables are the variables set by the log sources in use (syslog header fields,
+// Kubernetes metadata...) that every parser can match on.
+// Names ending with "*" stand for every variable with that prefix.
+type SourceVariables []string
+
+// Has checks whether the variable is set by the log sources
+func (s SourceVariables) Has(variable string) bool {
+	for _, name := range s {
+		if name == variable || strings.HasSuffix(name, "*") && strings.HasPrefix(variable, strings.TrimSuffix(name, "*")) {
+			return true
+		}
+	}
+	return false
+}
+
+// inVariableSet checks whether the variable is in variableSet, whose names ending
+// with "*" stand for every variable with that prefix (like SourceVariables)
+func inVariableSet(variableSet map[string]bool, variable string) bool {
+	if variableSet[variable] {
+		return true
+	}
+	for name := range variableSet {
+		if strings.HasSuffix(name, "*") && strings.HasPrefix(variable, strings.TrimSuffix(name, "*")) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,184 @@
+package rate
+
+import (
+	"fmt"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/ingyamilmolinar/doctorgpt/agent/internal/buffer"
+	"github.com/ingyamilmolinar/doctorgpt/agent/internal/parser"
+	"github.com/ingyamilmolinar/doctorgpt/agent/internal/tokenizer"
+)
+
+// Most recent matching entries kept per group (for the prompt context)
+const MaxEntries = 100
+
+// Matches are counted in buckets, each one spanning this fraction of the window
+const bucketsPerWindow = 60
+
+// Burst of log entries matched by the triggers of a rate parser (see parser.Rate)
+type Burst struct {
+	Rate parser.Rate
+	// Value of the GroupBy variable
+	Group string
+	// Matching entries within the window
+	Count int
+	// Most recent matching entries (MaxEntries at most)
+	Entries []parser.LogEntry
+}
+
+// Counter counts the log entries matched by the triggers of rate parsers in sliding windows
+type Counter struct {
+	groups map[key]*group
+	log    *zap.SugaredLogger
+}
+
+// Groups are counted per parser (its index) and value of the GroupBy variable
+type key struct {
+	parser int
+	value  string
+}
+
+type group struct {
+	rate    parser.Rate
+	buckets []bucket
+	// Matches within the window (the sum of the buckets)
+	count   int
+	entries []parser.LogEntry
+	// The group already crossed the threshold (it fires again once a whole window goes by without matches)
+	fired bool
+}
+
+// bucket counts the matches from its first one on (for a fraction of the window)
+type bucket struct {
+	first time.Time
+	last  time.Time
+	count int
+}
+
+func NewCounter(log *zap.SugaredLogger) *Counter {
+	return &Counter{
+		groups: make(map[key]*group),
+		log:    log,
+	}
+}
+
+// Count adds an entry matched by the triggers of the parser (its index) at time now. It returns
+// the burst of matching entries when they reach the threshold within the window.
+func (c *Counter) Count(parserIndex int, entry parser.LogEntry, now time.Time) (Burst, bool) {
+	rate := *entry.Parser.Rate
+	k := key{parser: parserIndex}
+	if rate.GroupBy != "" {
+		k.value = entry.Variables[rate.GroupBy]
+	}
+	g, ok := c.groups[k]
+	if !ok {
+		g = &group{rate: rate}
+		c.groups[k] = g
+	}
+	g.expire(now)
+	g.add(now)
+	g.entries = append(g.entries, entry)
+	if len(g.entries) > MaxEntries {
+		g.entries = g.entries[len(g.entries)-MaxEntries:]
+	}
+	c.log.Debugf("Rate group (%d/%s): %d matches within (%s)", k.parser, k.value, g.count, rate.Window)
+	if g.fired || g.count < rate.Threshold {
+		return Burst{}, false
+	}
+	g.fired = true
+	c.log.Infof("Rate threshold (%d) reached within (%s) for group (%s)", rate.Threshold, rate.Window, k.value)
+	return Burst{
+		Rate:    rate,
+		Group:   k.value,
+		Count:   g.count,
+		Entries: append([]parser.LogEntry(nil), g.entries...),
+	}, true
+}
+
+// Evict drops the matches out of the window of every group (and the groups left without any)
+func (c *Counter) Evict(now time.Time) {
+	for k, g := range c.groups {
+		g.expire(now)
+		if g.count == 0 {
+			c.log.Debugf("Evicting rate group (%d/%s)", k.parser, k.value)
+			delete(c.groups, k)
+		}
+	}
+}
+
+func (c *Counter) Len() int {
+	return len(c.groups)
+}
+
+// add counts a match at time now in the latest bucket (or a new one once it spans its part of the window)
+func (g *group) add(now time.Time) {
+	if n := len(g.buckets); n > 0 && now.Sub(g.buckets[n-1].first) < g.rate.Window/bucketsPerWindow {
+		g.buckets[n-1].last = now
+		g.buckets[n-1].count++
+	} else {
+		g.buckets = append(g.buckets, bucket{first: now, last: now, count: 1})
+	}
+	g.count++
+}
+
+// expire drops the buckets out of the window, rearming the group once there are none left
+func (g *group) expire(now time.Time) {
+	i := 0
+	for i < len(g.buckets) && now.Sub(g.buckets[i].last) > g.rate.Window {
+		g.count -= g.buckets[i].count
+		i++
+	}
+	g.buckets = g.buckets[i:]
+	// Entries are the most recent matches
+	if drop := len(g.entries) - g.count; drop > 0 {
+		g.entries = g.entries[drop:]
+	}
+	if g.count == 0 {
+		g.fired = false
+	}
+}
+
+// Context is the prompt context of the burst: a summary, the matching entries (up to half
+// of maxTokens) and the rest of the log context, keeping the most recent entries of each
+func (b Burst) Context(log *zap.SugaredLogger, logContext []parser.LogEntry, maxTokens int, count tokenizer.Counter) []parser.LogEntry {
+	summary := fmt.Sprintf("RATE TRIGGER: %d matching log entries within %s (threshold: %d)", b.Count, b.Rate.Window, b.Rate.Threshold)
+	if b.Rate.GroupBy != "" {
+		summary += fmt.Sprintf(" for %s (%s)", b.Rate.GroupBy, b.Group)
+	}
+	header := []parser.LogEntry{{Text: summary}, {Text: "MATCHING LOG ENTRIES:"}}
+	separator := parser.LogEntry{Text: "LOG CONTEXT:"}
+	maxTokens -= count(parser.Stringify(append(header, separator)))
+
+	entries := buffer.Trim(log, b.Entries, maxTokens/2, count)
+	if len(entries) < b.Count {
+		header[1].Text = fmt.Sprintf("MATCHING LOG ENTRIES (last %d):", len(entries))
+	}
+	maxTokens -= count(parser.Stringify(entries))
+	logContext = b.without(logContext)
+	logContext = buffer.Trim(log, logContext, maxTokens, count)
+
+	result := append(header, entries...)
+	result = append(result, separator)
+	return append(result, logContext...)
+}
+
+// without returns the log context without the matching entries of the burst (they are listed already)
+func (b Burst) without(logContext []parser.LogEntry) []parser.LogEntry {
+	type line struct {
+		lineNo int
+		text   string
+	}
+	matching := make(map[line]bool, len(b.Entries))
+	for _, entry := range b.Entries {
+		matching[line{entry.LineNo, entry.Text}] = true
+	}
+	var result []parser.LogEntry
+	for _, entry := range logContext {
+		if !matching[line{entry.LineNo, entry.Text}] {
+			result = append(result, entry)
+		}
+	}
+	return result
+}
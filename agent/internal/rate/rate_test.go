@@ -0,0 +1,106 @@
+package rate
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/ingyamilmolinar/doctorgpt/agent/internal/parser"
+	"github.com/ingyamilmolinar/doctorgpt/agent/internal/tokenizer"
+)
+
+func TestCounter(t *testing.T) {
+	log := zap.NewNop().Sugar()
+	p := &parser.Parser{Rate: &parser.Rate{Threshold: 3, Window: time.Minute}}
+	entry := func(text string) parser.LogEntry {
+		return parser.LogEntry{Parser: p, Text: text}
+	}
+	c := NewCounter(log)
+	start := time.Date(2023, 7, 22, 12, 0, 0, 0, time.UTC)
+
+	_, fired := c.Count(0, entry("a"), start)
+	require.False(t, fired)
+	_, fired = c.Count(0, entry("b"), start.Add(30*time.Second))
+	require.False(t, fired)
+	// Other parsers are counted on their own
+	_, fired = c.Count(1, entry("x"), start.Add(40*time.Second))
+	require.False(t, fired)
+	burst, fired := c.Count(0, entry("c"), start.Add(time.Minute))
+	require.True(t, fired)
+	require.Equal(t, 3, burst.Count)
+	require.Equal(t, []parser.LogEntry{entry("a"), entry("b"), entry("c")}, burst.Entries)
+
+	// Fires once per burst (even if it goes on)
+	for i := 1; i <= 5; i++ {
+		_, fired = c.Count(0, entry("d"), start.Add(time.Minute+time.Duration(i)*20*time.Second))
+		require.False(t, fired)
+	}
+	// Until a whole window goes by without matches
+	c.Evict(start.Add(5 * time.Minute))
+	require.Equal(t, 0, c.Len())
+	for i := 0; i < 2; i++ {
+		_, fired = c.Count(0, entry("e"), start.Add(5*time.Minute))
+		require.False(t, fired)
+	}
+	burst, fired = c.Count(0, entry("f"), start.Add(5*time.Minute))
+	require.True(t, fired)
+	require.Equal(t, 3, burst.Count)
+
+	// Storms are counted in a bounded number of buckets
+	for i := 0; i < 10000; i++ {
+		c.Count(0, entry("g"), start.Add(5*time.Minute+time.Duration(i)*10*time.Millisecond))
+	}
+	g := c.groups[key{}]
+	// Matches within the window (plus those of its oldest bucket at most)
+	require.InDelta(t, 6001, g.count, 100)
+	require.LessOrEqual(t, len(g.buckets), bucketsPerWindow+1)
+	require.Len(t, g.entries, MaxEntries)
+}
+
+func TestGroups(t *testing.T) {
+	p := &parser.Parser{Rate: &parser.Rate{Threshold: 2, Window: time.Minute, GroupBy: "SERVICE"}}
+	entry := func(service string) parser.LogEntry {
+		return parser.LogEntry{Parser: p, Text: service, Variables: map[string]string{"SERVICE": service}}
+	}
+	c := NewCounter(zap.NewNop().Sugar())
+	now := time.Now()
+	_, fired := c.Count(0, entry("billing"), now)
+	require.False(t, fired)
+	_, fired = c.Count(0, entry("cart"), now)
+	require.False(t, fired)
+	burst, fired := c.Count(0, entry("cart"), now)
+	require.True(t, fired)
+	require.Equal(t, "cart", burst.Group)
+	require.Equal(t, 2, c.Len())
+}
+
+func TestContext(t *testing.T) {
+	log := zap.NewNop().Sugar()
+	var entries []parser.LogEntry
+	for i := 0; i < MaxEntries; i++ {
+		entries = append(entries, parser.LogEntry{Text: fmt.Sprintf("timeout %d", i)})
+	}
+	burst := Burst{
+		Rate:    parser.Rate{Threshold: 50, Window: time.Minute, GroupBy: "SERVICE"},
+		Group:   "billing",
+		Count:   120,
+		Entries: entries,
+	}
+	logContext := []parser.LogEntry{{Text: "retrying"}, {Text: "timeout 99"}}
+	result := burst.Context(log, logContext, 10000, tokenizer.Approximate)
+	require.Equal(t, "RATE TRIGGER: 120 matching log entries within 1m0s (threshold: 50) for SERVICE (billing)", result[0].Text)
+	require.Equal(t, "MATCHING LOG ENTRIES (last 100):", result[1].Text)
+	require.Equal(t, entries, result[2:2+MaxEntries])
+	require.Equal(t, "LOG CONTEXT:", result[2+MaxEntries].Text)
+	// Matching entries are not repeated in the log context
+	require.Equal(t, logContext[:1], result[3+MaxEntries:])
+
+	// Matching entries take half of the tokens at most
+	result = burst.Context(log, logContext, 100, tokenizer.Approximate)
+	require.Less(t, len(result), 2+MaxEntries)
+	require.Equal(t, logContext[:1], result[len(result)-1:])
+	require.LessOrEqual(t, tokenizer.Approximate(parser.Stringify(result)), 100)
+}
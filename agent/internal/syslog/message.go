@@ -0,0 +1,214 @@
+package syslog
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/ingyamilmolinar/doctorgpt/agent/internal/parser"
+)
+
+// Variables set on every syslog log entry
+const (
+	VariablePriority       = "PRI"
+	VariableFacility       = "FACILITY"
+	VariableSeverity       = "SEVERITY"
+	VariableTimestamp      = "TIMESTAMP"
+	VariableHostname       = "HOSTNAME"
+	VariableAppName        = "APPNAME"
+	VariableProcID         = "PROCID"
+	VariableMsgID          = "MSGID"
+	VariableStructuredData = "STRUCTURED_DATA"
+)
+
+// Variables set on every syslog message
+var Variables = parser.SourceVariables{VariablePriority, VariableFacility, VariableSeverity, VariableTimestamp, VariableHostname,
+	VariableAppName, VariableProcID, VariableMsgID, VariableStructuredData, VariableStructuredData + ".*"}
+
+var severities = []string{"emerg", "alert", "crit", "err", "warning", "notice", "info", "debug"}
+
+var facilities = []string{"kern", "user", "mail", "daemon", "auth", "syslog", "lpr", "news", "uucp", "cron", "authpriv",
+	"ftp", "ntp", "security", "console", "solaris-cron", "local0", "local1", "local2", "local3", "local4", "local5", "local6", "local7"}
+
+// Message is a syslog message (RFC 3164 or RFC 5424). Missing fields are left empty.
+type Message struct {
+	Priority       int
+	Timestamp      string
+	Hostname       string
+	AppName        string
+	ProcID         string
+	MsgID          string
+	StructuredData string
+	// Structured data parameters, keyed by "<SD-ID>.<PARAM-NAME>"
+	Params map[string]string
+	Text   string
+}
+
+func (m Message) Facility() string {
+	return facilities[m.Priority/8]
+}
+
+func (m Message) Severity() string {
+	return severities[m.Priority%8]
+}
+
+// Variables returns the message header fields as log entry variables
+func (m Message) Variables() map[string]string {
+	variables := map[string]string{
+		VariablePriority:       strconv.Itoa(m.Priority),
+		VariableFacility:       m.Facility(),
+		VariableSeverity:       m.Severity(),
+		VariableTimestamp:      m.Timestamp,
+		VariableHostname:       m.Hostname,
+		VariableAppName:        m.AppName,
+		VariableProcID:         m.ProcID,
+		VariableMsgID:          m.MsgID,
+		VariableStructuredData: m.StructuredData,
+	}
+	for name, value := range m.Params {
+		variables[VariableStructuredData+"."+name] = value
+	}
+	return variables
+}
+
+// Parse parses an RFC 5424 message, falling back to RFC 3164 (BSD syslog)
+func Parse(data string) (Message, error) {
+	data = strings.TrimRight(data, "\r\n\x00")
+	if !strings.HasPrefix(data, "<") {
+		return Message{}, errors.New("missing priority")
+	}
+	end := strings.IndexByte(data, '>')
+	if end < 2 || end > 4 {
+		return Message{}, errors.New("invalid priority")
+	}
+	priority, err := strconv.Atoi(data[1:end])
+	if err != nil || priority < 0 || priority > 191 {
+		return Message{}, fmt.Errorf("invalid priority (%s)", data[1:end])
+	}
+	m := Message{Priority: priority}
+	rest := data[end+1:]
+	if strings.HasPrefix(rest, "1 ") {
+		return parse5424(m, rest[2:])
+	}
+	return parse3164(m, rest), nil
+}
+
+// <PRI>1 TIMESTAMP HOSTNAME APP-NAME PROCID MSGID STRUCTURED-DATA [MSG]
+func parse5424(m Message, rest string) (Message, error) {
+	fields := make([]string, 5)
+	for i := range fields {
+		var field string
+		field, rest, _ = strings.Cut(rest, " ")
+		if field == "" {
+			return Message{}, errors.New("missing RFC 5424 header fields")
+		}
+		if field != "-" {
+			fields[i] = field
+		}
+	}
+	m.Timestamp, m.Hostname, m.AppName, m.ProcID, m.MsgID = fields[0], fields[1], fields[2], fields[3], fields[4]
+
+	if strings.HasPrefix(rest, "-") {
+		rest = rest[1:]
+	} else {
+		params, remaining, err := parseStructuredData(rest)
+		if err != nil {
+			return Message{}, err
+		}
+		m.StructuredData = rest[:len(rest)-len(remaining)]
+		m.Params = params
+		rest = remaining
+	}
+	// The message might start with a UTF-8 BOM
+	m.Text = strings.TrimPrefix(strings.TrimPrefix(rest, " "), "\ufeff")
+	return m, nil
+}
+
+// parseStructuredData parses one or more [SD-ID PARAM="VALUE" ...] elements
+func parseStructuredData(data string) (map[string]string, string, error) {
+	params := map[string]string{}
+	i := 0
+	for i < len(data) && data[i] == '[' {
+		i++
+		start := i
+		for i < len(data) && data[i] != ' ' && data[i] != ']' {
+			i++
+		}
+		id := data[start:i]
+		for i < len(data) && data[i] == ' ' {
+			i++
+			start = i
+			for i < len(data) && data[i] != '=' {
+				i++
+			}
+			name := data[start:i]
+			if i+1 >= len(data) || data[i+1] != '"' {
+				return nil, "", fmt.Errorf("invalid structured data parameter (%s)", name)
+			}
+			i += 2
+			var value strings.Builder
+			for i < len(data) && data[i] != '"' {
+				if data[i] == '\\' && i+1 < len(data) && strings.IndexByte(`"\]`, data[i+1]) >= 0 {
+					i++
+				}
+				r, size := utf8.DecodeRuneInString(data[i:])
+				value.WriteRune(r)
+				i += size
+			}
+			if i >= len(data) {
+				return nil, "", errors.New("unterminated structured data parameter")
+			}
+			i++
+			params[id+"."+name] = value.String()
+		}
+		if i >= len(data) || data[i] != ']' {
+			return nil, "", fmt.Errorf("unterminated structured data element (%s)", id)
+		}
+		i++
+	}
+	return params, data[i:], nil
+}
+
+// <PRI>Mmm dd hh:mm:ss HOSTNAME TAG[PID]: MSG (the header is loosely followed by senders)
+func parse3164(m Message, rest string) Message {
+	if len(rest) > len(time.Stamp) {
+		if _, err := time.Parse(time.Stamp, rest[:len(time.Stamp)]); err == nil {
+			m.Timestamp = rest[:len(time.Stamp)]
+			rest = strings.TrimPrefix(rest[len(time.Stamp):], " ")
+		}
+	}
+	if m.Timestamp == "" {
+		// Some senders use RFC 3339 timestamps instead
+		token, after, _ := strings.Cut(rest, " ")
+		if _, err := time.Parse(time.RFC3339Nano, token); err == nil {
+			m.Timestamp = token
+			rest = after
+		}
+	}
+
+	// The hostname is only sent along with the timestamp (and it is not a tag)
+	if m.Timestamp != "" {
+		token, after, found := strings.Cut(rest, " ")
+		if found && !strings.HasSuffix(token, ":") && !strings.Contains(token, "[") {
+			m.Hostname = token
+			rest = after
+		}
+	}
+
+	// TAG[PID]: or TAG:
+	token, after, found := strings.Cut(rest, " ")
+	if found && strings.HasSuffix(token, ":") {
+		tag := strings.TrimSuffix(token, ":")
+		if open := strings.IndexByte(tag, '['); open > 0 && strings.HasSuffix(tag, "]") {
+			m.ProcID = tag[open+1 : len(tag)-1]
+			tag = tag[:open]
+		}
+		m.AppName = tag
+		rest = after
+	}
+	m.Text = rest
+	return m
+}
@@ -0,0 +1,98 @@
+package syslog
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name     string
+		data     string
+		expected Message
+	}{
+		{
+			name: "RFC 5424",
+			data: `<165>1 2003-10-11T22:14:15.003Z mymachine.example.com evntslog - ID47 [exampleSDID@32473 iut="3" eventSource="Appli\"cation"][examplePriority@32473 class="high"] ` + "\ufeff" + `An application event log entry...`,
+			expected: Message{
+				Priority:       165,
+				Timestamp:      "2003-10-11T22:14:15.003Z",
+				Hostname:       "mymachine.example.com",
+				AppName:        "evntslog",
+				MsgID:          "ID47",
+				StructuredData: `[exampleSDID@32473 iut="3" eventSource="Appli\"cation"][examplePriority@32473 class="high"]`,
+				Params: map[string]string{
+					"exampleSDID@32473.iut":         "3",
+					"exampleSDID@32473.eventSource": `Appli"cation`,
+					"examplePriority@32473.class":   "high",
+				},
+				Text: "An application event log entry...",
+			},
+		},
+		{
+			name: "RFC 5424 without structured data nor message",
+			data: "<34>1 2003-10-11T22:14:15.003Z mymachine su 1234 - -\n",
+			expected: Message{
+				Priority:  34,
+				Timestamp: "2003-10-11T22:14:15.003Z",
+				Hostname:  "mymachine",
+				AppName:   "su",
+				ProcID:    "1234",
+			},
+		},
+		{
+			name: "RFC 3164",
+			data: "<34>Oct 11 22:14:15 mymachine su[230]: 'su root' failed for lonvick on /dev/pts/8",
+			expected: Message{
+				Priority:  34,
+				Timestamp: "Oct 11 22:14:15",
+				Hostname:  "mymachine",
+				AppName:   "su",
+				ProcID:    "230",
+				Text:      "'su root' failed for lonvick on /dev/pts/8",
+			},
+		},
+		{
+			name: "RFC 3164 without hostname",
+			data: "<13>Feb  5 17:32:18 sshd: Connection closed",
+			expected: Message{
+				Priority:  13,
+				Timestamp: "Feb  5 17:32:18",
+				AppName:   "sshd",
+				Text:      "Connection closed",
+			},
+		},
+		{
+			name: "RFC 3164 without header",
+			data: "<11>Use the BFG!",
+			expected: Message{
+				Priority: 11,
+				Text:     "Use the BFG!",
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			m, err := Parse(test.data)
+			require.NoError(t, err)
+			require.Equal(t, test.expected, m)
+		})
+	}
+
+	m, err := Parse("<165>1 2003-10-11T22:14:15.003Z host app - - [id a=\"1\"] msg")
+	require.NoError(t, err)
+	variables := m.Variables()
+	require.Equal(t, "165", variables["PRI"])
+	require.Equal(t, "local4", variables["FACILITY"])
+	require.Equal(t, "notice", variables["SEVERITY"])
+	require.Equal(t, "host", variables["HOSTNAME"])
+	require.Equal(t, "app", variables["APPNAME"])
+	require.Equal(t, "", variables["PROCID"])
+	require.Equal(t, "1", variables["STRUCTURED_DATA.id.a"])
+
+	for _, data := range []string{"no priority", "<999>1 too high", "<34>1 missing fields", `<34>1 - - - - - [id a="1"`} {
+		_, err := Parse(data)
+		require.Error(t, err, data)
+	}
+}
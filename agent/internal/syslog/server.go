@@ -0,0 +1,167 @@
+package syslog
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+
+	"go.uber.org/zap"
+
+	"github.com/ingyamilmolinar/doctorgpt/agent/internal/input"
+)
+
+// Max size of a syslog message
+const maxMessageSize = 64 * 1024
+
+// Priority of messages without one (user.notice, see RFC 3164)
+const defaultPriority = 13
+
+// ListenUDP receives syslog messages (one per datagram) until ctx is done.
+// It returns the address it listens on.
+func ListenUDP(ctx context.Context, log *zap.SugaredLogger, addr string, demux *input.Demux) (net.Addr, error) {
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen for syslog messages: %w", err)
+	}
+	log.Infof("Listening for syslog messages on (udp://%s)", conn.LocalAddr())
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+	go func() {
+		buf := make([]byte, maxMessageSize)
+		for {
+			n, remote, err := conn.ReadFrom(buf)
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			if err != nil {
+				log.Errorf("Failed to read syslog message: %v", err)
+				continue
+			}
+			receive(log, demux, string(buf[:n]), remote)
+		}
+	}()
+	return conn.LocalAddr(), nil
+}
+
+// ListenTCP receives syslog messages (newline delimited or octet counted, see RFC 6587)
+// until ctx is done, over TLS if tlsConfig is set. It returns the address it listens on.
+func ListenTCP(ctx context.Context, log *zap.SugaredLogger, addr string, tlsConfig *tls.Config, demux *input.Demux) (net.Addr, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen for syslog messages: %w", err)
+	}
+	scheme := "tcp"
+	if tlsConfig != nil {
+		listener = tls.NewListener(listener, tlsConfig)
+		scheme = "tls"
+	}
+	log.Infof("Listening for syslog messages on (%s://%s)", scheme, listener.Addr())
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+	}()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			if err != nil {
+				log.Errorf("Failed to accept syslog connection: %v", err)
+				continue
+			}
+			go serve(ctx, log, conn, demux)
+		}
+	}()
+	return listener.Addr(), nil
+}
+
+// LoadTLSConfig loads the certificate (and its key) the TLS listener presents to senders
+func LoadTLSConfig(certFile, keyFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load syslog TLS certificate: %w", err)
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+func serve(ctx context.Context, log *zap.SugaredLogger, conn net.Conn, demux *input.Demux) {
+	done := make(chan struct{})
+	defer close(done)
+	defer conn.Close()
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	reader := bufio.NewReaderSize(conn, maxMessageSize)
+	for {
+		data, err := readFrame(reader)
+		if err != nil {
+			if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+				log.Errorf("Failed to read syslog message from (%s): %v", conn.RemoteAddr(), err)
+			}
+			return
+		}
+		if data != "" {
+			receive(log, demux, data, conn.RemoteAddr())
+		}
+	}
+}
+
+// readFrame reads an octet counted ("<length> <message>") or a newline delimited message
+func readFrame(reader *bufio.Reader) (string, error) {
+	first, err := reader.Peek(1)
+	if err != nil {
+		return "", err
+	}
+	if first[0] < '0' || first[0] > '9' {
+		data, err := reader.ReadString('\n')
+		if errors.Is(err, io.EOF) && data != "" {
+			return data, nil
+		}
+		return data, err
+	}
+	length, err := reader.ReadString(' ')
+	if err != nil {
+		return "", err
+	}
+	size, err := strconv.Atoi(strings.TrimSuffix(length, " "))
+	if err != nil || size > maxMessageSize {
+		return "", fmt.Errorf("invalid message length (%s)", length)
+	}
+	data := make([]byte, size)
+	_, err = io.ReadFull(reader, data)
+	return string(data), err
+}
+
+// receive hands the message to the monitor of its sending host
+func receive(log *zap.SugaredLogger, demux *input.Demux, data string, remote net.Addr) {
+	m, err := Parse(data)
+	if err != nil {
+		log.Debugf("Invalid syslog message from (%s): %v", remote, err)
+		m = Message{Priority: defaultPriority, Text: strings.TrimRight(data, "\r\n\x00")}
+	}
+	if m.Hostname == "" {
+		host, _, err := net.SplitHostPort(remote.String())
+		if err != nil {
+			host = remote.String()
+		}
+		m.Hostname = host
+	}
+	demux.Send(m.Hostname, m.Text, m.Variables())
+}
@@ -0,0 +1,137 @@
+package syslog
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/ingyamilmolinar/doctorgpt/agent/internal/input"
+	"github.com/ingyamilmolinar/doctorgpt/agent/internal/tailer"
+)
+
+var logger, _ = zap.NewDevelopment()
+
+type received struct {
+	mu    sync.Mutex
+	lines map[string][]tailer.Line
+}
+
+func (r *received) monitor(ctx context.Context, name string, lines <-chan tailer.Line) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case line := <-lines:
+			r.mu.Lock()
+			r.lines[name] = append(r.lines[name], line)
+			r.mu.Unlock()
+		}
+	}
+}
+
+func (r *received) get(name string) []tailer.Line {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]tailer.Line(nil), r.lines[name]...)
+}
+
+func TestServer(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	r := &received{lines: map[string][]tailer.Line{}}
+	demux := input.NewDemux(ctx, logger.Sugar(), input.DefaultMaxSources, input.DefaultSourceTTL, r.monitor)
+	defer func() {
+		cancel()
+		demux.Wait()
+	}()
+
+	// UDP: one message per datagram, each host is a source of its own
+	udpAddr, err := ListenUDP(ctx, logger.Sugar(), "127.0.0.1:0", demux)
+	require.NoError(t, err)
+	udp, err := net.Dial("udp", udpAddr.String())
+	require.NoError(t, err)
+	defer udp.Close()
+	_, err = udp.Write([]byte("<11>Oct 11 22:14:15 router1 kernel: link down"))
+	require.NoError(t, err)
+	_, err = udp.Write([]byte("<14>Oct 11 22:14:16 router2 kernel: link up"))
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		return len(r.get("router1")) == 1 && len(r.get("router2")) == 1
+	}, time.Second, 5*time.Millisecond)
+	line := r.get("router1")[0]
+	require.Equal(t, "link down", line.Text)
+	require.Equal(t, "router1", line.File)
+	require.Equal(t, 1, line.Position.Line)
+	require.Equal(t, "err", line.Variables["SEVERITY"])
+	require.Equal(t, "kernel", line.Variables["APPNAME"])
+
+	// TCP: octet counting and newline delimited framing (hostname defaults to the sender address)
+	tcpAddr, err := ListenTCP(ctx, logger.Sugar(), "127.0.0.1:0", nil, demux)
+	require.NoError(t, err)
+	tcp, err := net.Dial("tcp", tcpAddr.String())
+	require.NoError(t, err)
+	message := "<165>1 - - app - - - first\nline"
+	_, err = fmt.Fprintf(tcp, "%d %s<11>second\n", len(message), message)
+	require.NoError(t, err)
+	require.NoError(t, tcp.Close())
+	require.Eventually(t, func() bool {
+		return len(r.get("127.0.0.1")) == 2
+	}, time.Second, 5*time.Millisecond)
+	lines := r.get("127.0.0.1")
+	require.Equal(t, "first\nline", lines[0].Text)
+	require.Equal(t, "second", lines[1].Text)
+	require.Equal(t, 2, lines[1].Position.Line)
+
+	// TLS
+	dir := t.TempDir()
+	certFile, keyFile := writeCertificate(t, dir)
+	tlsConfig, err := LoadTLSConfig(certFile, keyFile)
+	require.NoError(t, err)
+	tlsAddr, err := ListenTCP(ctx, logger.Sugar(), "127.0.0.1:0", tlsConfig, demux)
+	require.NoError(t, err)
+	conn, err := tls.Dial("tcp", tlsAddr.String(), &tls.Config{InsecureSkipVerify: true})
+	require.NoError(t, err)
+	_, err = conn.Write([]byte("<11>Oct 11 22:14:15 firewall sshd[1]: denied\n"))
+	require.NoError(t, err)
+	require.NoError(t, conn.Close())
+	require.Eventually(t, func() bool {
+		return len(r.get("firewall")) == 1
+	}, time.Second, 5*time.Millisecond)
+	require.Equal(t, "1", r.get("firewall")[0].Variables["PROCID"])
+}
+
+func writeCertificate(t *testing.T, dir string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	require.NoError(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600))
+	return certFile, keyFile
+}
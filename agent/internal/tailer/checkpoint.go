@@ -0,0 +1,65 @@
+package tailer
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+type checkpoint struct {
+	FileName string `json:"fileName"`
+	Position
+}
+
+// LoadCheckpoint returns the position saved for fileName (zero if there is none)
+func LoadCheckpoint(dir, fileName string) (Position, error) {
+	bytes, err := os.ReadFile(checkpointPath(dir, fileName))
+	if errors.Is(err, os.ErrNotExist) {
+		return Position{}, nil
+	}
+	if err != nil {
+		return Position{}, fmt.Errorf("failed to read checkpoint: %w", err)
+	}
+	var c checkpoint
+	err = json.Unmarshal(bytes, &c)
+	if err != nil {
+		return Position{}, fmt.Errorf("failed to decode checkpoint: %w", err)
+	}
+	return c.Position, nil
+}
+
+// SaveCheckpoint atomically writes the position reached in fileName
+func SaveCheckpoint(dir, fileName string, position Position) error {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return fmt.Errorf("failed to create checkpoint directory: %w", err)
+	}
+	bytes, err := json.Marshal(checkpoint{FileName: fileName, Position: position})
+	if err != nil {
+		return fmt.Errorf("failed to encode checkpoint: %w", err)
+	}
+	path := checkpointPath(dir, fileName)
+	err = os.WriteFile(path+".tmp", bytes, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to write checkpoint: %w", err)
+	}
+	err = os.Rename(path+".tmp", path)
+	if err != nil {
+		return fmt.Errorf("failed to write checkpoint: %w", err)
+	}
+	return nil
+}
+
+// One checkpoint per absolute path (the base name is kept to ease debugging)
+func checkpointPath(dir, fileName string) string {
+	abs, err := filepath.Abs(fileName)
+	if err != nil {
+		abs = fileName
+	}
+	sum := sha256.Sum256([]byte(abs))
+	return filepath.Join(dir, filepath.Base(fileName)+"-"+hex.EncodeToString(sum[:8])+".json")
+}
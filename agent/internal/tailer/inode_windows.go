@@ -0,0 +1,8 @@
+package tailer
+
+import "os"
+
+// Inodes are not available: rotations are only detected through truncation
+func inode(info os.FileInfo) uint64 {
+	return 0
+}
@@ -0,0 +1,194 @@
+package tailer
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// rotatedSince returns the rotated segments holding the lines after position
+// (oldest first): the segment the position was taken from and every newer one.
+func (t *Tailer) rotatedSince(position Position) []segment {
+	// Segments are next to the actual file (e.g. Kubernetes container logs are symlinks)
+	fileName, err := filepath.EvalSymlinks(t.fileName)
+	if err != nil {
+		fileName = t.fileName
+	}
+	names := Segments(fileName)
+	for i := len(names) - 1; i >= 0; i-- {
+		if !segmentMatches(names[i], position) {
+			continue
+		}
+		segments := []segment{{name: names[i], start: position}}
+		for _, name := range names[i+1:] {
+			segments = append(segments, segment{name: name})
+		}
+		return segments
+	}
+	t.logger.Warnf("Rotated segment of log file (%s) not found: lines may have been missed", t.fileName)
+	return nil
+}
+
+// Suffixes of rotated segments: a number (app.log.1) or a date (app.log-20230102,
+// app.log.2023-01-02 or app.log-2023-01-02T10:00:00), optionally compressed (app.log.2.gz),
+// or just a compression extension (app.log.gz)
+var segmentSuffix = regexp.MustCompile(`^([.-](\d+|\d{4}-\d{2}-\d{2}([T_.-]?\d{1,2}([:.-]?\d{2}){0,2})?))?(\.gz|\.zst)?$`)
+
+// Segments returns the rotated segments of a log file (e.g. app.log.1, app.log.2.gz
+// or app.log-20230102.zst) sorted from oldest to newest
+func Segments(fileName string) []string {
+	var names []string
+	var infos []os.FileInfo
+	for _, pattern := range []string{fileName + ".*", fileName + "-*"} {
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			continue
+		}
+		for _, name := range matches {
+			if !IsSegment(fileName, name) {
+				continue
+			}
+			info, err := os.Stat(name)
+			if err != nil || !info.Mode().IsRegular() {
+				continue
+			}
+			names = append(names, name)
+			infos = append(infos, info)
+		}
+	}
+	indexes := make([]int, len(names))
+	for i := range indexes {
+		indexes[i] = i
+	}
+	sort.SliceStable(indexes, func(a, b int) bool {
+		return infos[indexes[a]].ModTime().Before(infos[indexes[b]].ModTime())
+	})
+	sorted := make([]string, len(names))
+	for i, index := range indexes {
+		sorted[i] = names[index]
+	}
+	return sorted
+}
+
+// IsSegment checks whether name is a rotated segment of fileName (other files sharing
+// its prefix, like service-worker.log for service, are not)
+func IsSegment(fileName, name string) bool {
+	if !strings.HasPrefix(name, fileName) || name == fileName {
+		return false
+	}
+	return segmentSuffix.MatchString(name[len(fileName):])
+}
+
+// segmentWithInode returns the rotated segment of the log file with the given inode ("" if none)
+func segmentWithInode(fileName string, ino uint64) string {
+	for _, name := range Segments(fileName) {
+		info, err := os.Stat(name)
+		if err == nil && !IsCompressed(name) && inode(info) == ino {
+			return name
+		}
+	}
+	return ""
+}
+
+func segmentMatches(name string, position Position) bool {
+	r, info, err := openDecompressed(name)
+	if err != nil {
+		return false
+	}
+	defer r.Close()
+	if IsCompressed(name) {
+		// Inodes do not survive compression
+		if position.Fingerprint == "" {
+			return false
+		}
+		return matches(position, 0, r)
+	}
+	return matches(position, inode(info), r)
+}
+
+// openSegment opens a (possibly compressed) rotated segment and skips to its start position
+func openSegment(seg segment) (*source, error) {
+	r, info, err := openDecompressed(seg.name)
+	if err != nil {
+		return nil, err
+	}
+	src := &source{
+		name:   seg.name,
+		closer: r,
+	}
+	if !IsCompressed(seg.name) {
+		src.position.Inode = inode(info)
+	}
+	head := make([]byte, min(seg.start.Offset, fingerprintSize))
+	_, err = io.ReadFull(r, head)
+	if err == nil {
+		_, err = io.CopyN(io.Discard, r, seg.start.Offset-int64(len(head)))
+	}
+	if err != nil {
+		r.Close()
+		return nil, fmt.Errorf("failed to seek rotated log file: %w", err)
+	}
+	src.setHead(head)
+	src.position.Offset = seg.start.Offset
+	src.position.Line = seg.start.Line
+	src.reader = bufio.NewReader(r)
+	return src, nil
+}
+
+// IsCompressed checks whether the file is compressed (based on its extension)
+func IsCompressed(name string) bool {
+	return strings.HasSuffix(name, ".gz") || strings.HasSuffix(name, ".zst")
+}
+
+// openDecompressed opens a file, decompressing it based on its extension (.gz or .zst)
+func openDecompressed(name string) (io.ReadCloser, os.FileInfo, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open log file: %w", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, nil, fmt.Errorf("failed to stat log file: %w", err)
+	}
+	switch {
+	case strings.HasSuffix(name, ".gz"):
+		gz, err := gzip.NewReader(file)
+		if err != nil {
+			file.Close()
+			return nil, nil, fmt.Errorf("failed to decompress log file: %w", err)
+		}
+		return readCloser{gz, func() error {
+			gz.Close()
+			return file.Close()
+		}}, info, nil
+	case strings.HasSuffix(name, ".zst"):
+		zst, err := zstd.NewReader(file)
+		if err != nil {
+			file.Close()
+			return nil, nil, fmt.Errorf("failed to decompress log file: %w", err)
+		}
+		return readCloser{zst, func() error {
+			zst.Close()
+			return file.Close()
+		}}, info, nil
+	}
+	return file, info, nil
+}
+
+type readCloser struct {
+	io.Reader
+	close func() error
+}
+
+func (r readCloser) Close() error {
+	return r.close()
+}
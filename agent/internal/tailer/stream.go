@@ -0,0 +1,40 @@
+package tailer
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Stdin is the file name used to read from the standard input
+const Stdin = "-"
+
+// Name given to the lines read from the standard input
+var StdinName = "stdin"
+
+func (t *Tailer) openStream(name string, r io.ReadCloser) {
+	t.stream = true
+	// There is nothing to follow: streams end once their writers are done
+	t.follow = false
+	t.current = &source{
+		name:   name,
+		reader: bufio.NewReader(r),
+		closer: r,
+	}
+}
+
+// openPipe opens a named pipe. When following, it is opened for writing as well so
+// that it does not end (nor block) while there are no writers.
+func (t *Tailer) openPipe() error {
+	flag := os.O_RDONLY
+	if t.follow {
+		flag = os.O_RDWR
+	}
+	file, err := os.OpenFile(t.fileName, flag, 0)
+	if err != nil {
+		return fmt.Errorf("failed to open named pipe: %w", err)
+	}
+	t.openStream(t.fileName, file)
+	return nil
+}
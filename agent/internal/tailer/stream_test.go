@@ -0,0 +1,73 @@
+//go:build !windows
+
+package tailer
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestStdin(t *testing.T) {
+	r, w, err := os.Pipe()
+	require.NoError(t, err)
+	stdin := os.Stdin
+	os.Stdin = r
+	defer func() {
+		os.Stdin = stdin
+	}()
+	StdinName = "kubectl"
+	defer func() {
+		StdinName = "stdin"
+	}()
+
+	tail, err := TailFile(context.Background(), logger.Sugar(), Stdin, Position{}, true)
+	require.NoError(t, err)
+	require.False(t, tail.Resumable())
+	_, err = w.WriteString("one\ntwo")
+	require.NoError(t, err)
+	line := next(t, tail)
+	require.Equal(t, Line{Text: "one", File: "kubectl", Position: line.Position}, line)
+	require.Equal(t, 1, line.Position.Line)
+
+	// Stdin ends with its writer
+	require.NoError(t, w.Close())
+	line = next(t, tail)
+	require.Equal(t, "two", line.Text)
+	require.Equal(t, 2, line.Position.Line)
+	_, ok := <-tail.Lines
+	require.False(t, ok)
+	require.NoError(t, tail.Err())
+}
+
+func TestNamedPipe(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "app.pipe")
+	require.NoError(t, syscall.Mkfifo(fileName, 0644))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	tail, err := TailFile(ctx, logger.Sugar(), fileName, Position{}, true)
+	require.NoError(t, err)
+	require.False(t, tail.Resumable())
+
+	// Followed pipes outlive their writers
+	for _, text := range []string{"one", "two"} {
+		appendLines(t, fileName, text+"\n")
+		line := next(t, tail)
+		require.Equal(t, text, line.Text)
+		require.Equal(t, fileName, line.File)
+	}
+
+	cancel()
+	select {
+	case _, ok := <-tail.Lines:
+		require.False(t, ok)
+	case <-time.After(time.Second):
+		t.Fatal("tailer did not stop")
+	}
+	require.NoError(t, tail.Err())
+}
@@ -0,0 +1,382 @@
+package tailer
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// How often a followed file is checked for new lines, truncation and rotation
+var PollInterval = 250 * time.Millisecond
+
+// Max number of bytes at the start of a file used to recognize it once rotated
+const fingerprintSize = 1024
+
+// Position identifies where the tailer is within a file
+type Position struct {
+	Inode           uint64 `json:"inode"`
+	Fingerprint     string `json:"fingerprint,omitempty"`
+	FingerprintSize int    `json:"fingerprintSize,omitempty"`
+	Offset          int64  `json:"offset"`
+	Line            int    `json:"line"`
+}
+
+// Line is a log line along with the file it was read from (the log file or
+// one of its rotated segments) and the position right after it.
+// Sources other than files (e.g. syslog) set the variables they know about.
+type Line struct {
+	Text      string
+	File      string
+	Position  Position
+	Variables map[string]string
+	// Line number when it is not the one of Position, e.g. where a multi-line log entry starts (0 otherwise)
+	FirstLine int
+}
+
+// Number returns the line number of the line (the first one of multi-line log entries)
+func (l Line) Number() int {
+	if l.FirstLine > 0 {
+		return l.FirstLine
+	}
+	return l.Position.Line
+}
+
+// Tailer reads a file line by line, optionally following it (like tail -F).
+// Lines written before a rotation are read from the rotated segments.
+type Tailer struct {
+	Lines    chan Line
+	fileName string
+	follow   bool
+	file     *os.File
+	current  *source
+	segments []segment
+	stream   bool
+	err      error
+	logger   *zap.SugaredLogger
+}
+
+// source is a file being read
+type source struct {
+	name     string
+	reader   *bufio.Reader
+	closer   io.Closer
+	partial  string
+	head     []byte
+	position Position
+}
+
+// segment is a rotated segment pending to be read
+type segment struct {
+	name  string
+	start Position
+}
+
+// TailFile starts reading fileName from the given position. If the file was truncated
+// or rotated since, the lines left are read from its rotated segments first.
+// Compressed files (.gz or .zst) are read from the start and never followed.
+// Stdin ("-") and named pipes are streams: they are read until EOF and cannot be resumed.
+// Lines is closed once ctx is done or, when not following, on EOF.
+func TailFile(ctx context.Context, log *zap.SugaredLogger, fileName string, start Position, follow bool) (*Tailer, error) {
+	t := &Tailer{
+		Lines:    make(chan Line),
+		fileName: fileName,
+		follow:   follow,
+		logger:   log,
+	}
+	err := t.open(start)
+	if err != nil {
+		return nil, err
+	}
+	go t.run(ctx)
+	return t, nil
+}
+
+// Err returns the error that stopped the tailer (if any) once Lines is closed
+func (t *Tailer) Err() error {
+	return t.err
+}
+
+// Resumable checks whether positions can be used to resume tailing later on
+func (t *Tailer) Resumable() bool {
+	return !t.stream && !IsCompressed(t.fileName)
+}
+
+func (t *Tailer) open(start Position) error {
+	if t.fileName == Stdin {
+		t.openStream(StdinName, os.Stdin)
+		return nil
+	}
+	if info, err := os.Stat(t.fileName); err == nil && info.Mode()&os.ModeNamedPipe != 0 {
+		return t.openPipe()
+	}
+	if IsCompressed(t.fileName) {
+		// Compressed files are no longer written to: they are read once
+		src, err := openSegment(segment{name: t.fileName})
+		if err != nil {
+			return err
+		}
+		t.follow = false
+		t.current = src
+		return nil
+	}
+
+	file, err := os.Open(t.fileName)
+	if err != nil {
+		return fmt.Errorf("failed to open log file: %w", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("failed to stat log file: %w", err)
+	}
+	// Line numbers are those of the log file: they go on across rotations (so that
+	// log locations stay unique), the offset starts over
+	src := &source{
+		name:     t.fileName,
+		closer:   file,
+		position: Position{Inode: inode(info), Line: start.Line},
+	}
+	if start.Offset > 0 {
+		if start.Offset <= info.Size() && matches(start, src.position.Inode, io.NewSectionReader(file, 0, info.Size())) {
+			src.position.Offset = start.Offset
+		} else {
+			t.logger.Infof("Log file (%s) was rotated or truncated since last checkpoint: catching up", t.fileName)
+			t.segments = t.rotatedSince(start)
+		}
+	}
+
+	// Keep the fingerprint of what was already read
+	head := make([]byte, min(src.position.Offset, fingerprintSize))
+	_, err = file.ReadAt(head, 0)
+	if err == nil {
+		src.setHead(head)
+		_, err = file.Seek(src.position.Offset, io.SeekStart)
+	}
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("failed to seek log file: %w", err)
+	}
+	src.reader = bufio.NewReader(file)
+
+	if t.current != nil {
+		t.current.closer.Close()
+	}
+	t.file = file
+	t.current = src
+	return nil
+}
+
+func (t *Tailer) run(ctx context.Context) {
+	defer close(t.Lines)
+	done := make(chan struct{})
+	defer close(done)
+	defer func() {
+		t.current.closer.Close()
+	}()
+	if t.stream {
+		// Reading a stream blocks until there is data: closing it unblocks it
+		go func() {
+			select {
+			case <-ctx.Done():
+				t.current.closer.Close()
+			case <-done:
+			}
+		}()
+	}
+	for {
+		if !t.catchUp(ctx) {
+			return
+		}
+		err := t.readLines(ctx, t.current)
+		if err != nil {
+			t.fail(ctx, err)
+			return
+		}
+		if !t.follow {
+			// Last line might not be terminated
+			t.flush(ctx, t.current)
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(PollInterval):
+		}
+		err = t.checkFile(ctx)
+		if err != nil {
+			t.fail(ctx, err)
+			return
+		}
+	}
+}
+
+func (t *Tailer) fail(ctx context.Context, err error) {
+	if ctx.Err() == nil {
+		t.err = err
+	}
+}
+
+// catchUp reads the rotated segments still pending. It returns false if ctx is done.
+// Line numbers go on from one segment to the next one (and then to the log file).
+func (t *Tailer) catchUp(ctx context.Context) bool {
+	line := -1
+	for len(t.segments) > 0 {
+		seg := t.segments[0]
+		t.segments = t.segments[1:]
+		t.logger.Infof("Reading rotated log file (%s)", seg.name)
+		src, err := openSegment(seg)
+		if err != nil {
+			t.logger.Errorf("Failed to read rotated log file (%s): %v", seg.name, err)
+			continue
+		}
+		if seg.start.Offset == 0 && line >= 0 {
+			src.position.Line = line
+		}
+		err = t.readLines(ctx, src)
+		if err == nil {
+			t.flush(ctx, src)
+		}
+		src.closer.Close()
+		line = src.position.Line
+		// The log file goes on from the last line of its segments
+		if t.current.position.Offset == 0 && src.position.Line > t.current.position.Line {
+			t.current.position.Line = src.position.Line
+		}
+		if ctx.Err() != nil {
+			return false
+		}
+		if err != nil {
+			t.logger.Errorf("Failed to read rotated log file (%s): %v", seg.name, err)
+		}
+	}
+	return true
+}
+
+// readLines sends every complete line available
+func (t *Tailer) readLines(ctx context.Context, src *source) error {
+	for {
+		text, err := src.reader.ReadString('\n')
+		if errors.Is(err, io.EOF) {
+			src.partial += text
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read log file: %w", err)
+		}
+		text = src.partial + text
+		src.partial = ""
+		err = t.emit(ctx, src, text)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// flush sends the last line of a file that is no longer written to
+func (t *Tailer) flush(ctx context.Context, src *source) {
+	if src.partial != "" {
+		t.emit(ctx, src, src.partial)
+		src.partial = ""
+	}
+}
+
+func (t *Tailer) emit(ctx context.Context, src *source, text string) error {
+	if len(src.head) < fingerprintSize {
+		src.setHead(append(src.head, text[:min(int64(len(text)), int64(fingerprintSize-len(src.head)))]...))
+	}
+	src.position.Offset += int64(len(text))
+	src.position.Line++
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case t.Lines <- Line{Text: strings.TrimSuffix(text, "\n"), File: src.name, Position: src.position}:
+		return nil
+	}
+}
+
+// checkFile reopens the file if it was truncated or rotated
+func (t *Tailer) checkFile(ctx context.Context) error {
+	info, err := os.Stat(t.fileName)
+	if errors.Is(err, os.ErrNotExist) {
+		// Rotated but not recreated yet (lines still written to the old file are from its segment)
+		if name := t.renamedTo(t.current.position.Inode); name != "" {
+			t.current.name = name
+		}
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to stat log file: %w", err)
+	}
+	if inode(info) != t.current.position.Inode {
+		// Finish reading the old file before switching (its lines are from the segment it was renamed to)
+		if name := t.renamedTo(t.current.position.Inode); name != "" {
+			t.current.name = name
+		}
+		err := t.readLines(ctx, t.current)
+		if err != nil {
+			return err
+		}
+		t.flush(ctx, t.current)
+		t.logger.Infof("Log file (%s) was rotated to (%s): reopening it", t.fileName, t.current.name)
+		return t.open(Position{Line: t.current.position.Line})
+	}
+	truncated := info.Size() < t.current.position.Offset+int64(len(t.current.partial)) ||
+		!matches(t.current.position, t.current.position.Inode, io.NewSectionReader(t.file, 0, info.Size()))
+	if truncated {
+		// Lines written right before a copytruncate are only found in the copy
+		t.logger.Infof("Log file (%s) was truncated: reading it from the start", t.fileName)
+		t.segments = t.rotatedSince(t.current.position)
+		return t.open(Position{Line: t.current.position.Line})
+	}
+	return nil
+}
+
+// renamedTo returns the rotated segment the file with the given inode was renamed to ("" if not found)
+func (t *Tailer) renamedTo(ino uint64) string {
+	fileName, err := filepath.EvalSymlinks(t.fileName)
+	if err != nil {
+		fileName = t.fileName
+	}
+	return segmentWithInode(fileName, ino)
+}
+
+func (s *source) setHead(head []byte) {
+	s.head = head
+	s.position.FingerprintSize = len(head)
+	s.position.Fingerprint = fingerprint(head)
+}
+
+func fingerprint(head []byte) string {
+	if len(head) == 0 {
+		return ""
+	}
+	sum := sha256.Sum256(head)
+	return hex.EncodeToString(sum[:8])
+}
+
+// matches checks whether the file is the one the position was taken from
+func matches(position Position, inode uint64, r io.Reader) bool {
+	if position.Fingerprint == "" {
+		return position.Inode == 0 || position.Inode == inode
+	}
+	head := make([]byte, position.FingerprintSize)
+	_, err := io.ReadFull(r, head)
+	return err == nil && fingerprint(head) == position.Fingerprint
+}
+
+func min(a, b int64) int64 {
+	if a < b {
+		return a
+	}
+	return b
+}
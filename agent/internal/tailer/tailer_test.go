@@ -0,0 +1,190 @@
+package tailer
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+var logger, _ = zap.NewDevelopment()
+
+func next(t *testing.T, tail *Tailer) Line {
+	select {
+	case line, ok := <-tail.Lines:
+		require.True(t, ok, "lines channel closed")
+		return line
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for line")
+	}
+	return Line{}
+}
+
+func appendLines(t *testing.T, fileName, text string) {
+	f, err := os.OpenFile(fileName, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	require.NoError(t, err)
+	_, err = f.WriteString(text)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+}
+
+func TestCheckpointResume(t *testing.T) {
+	dir := t.TempDir()
+	fileName := filepath.Join(dir, "app.log")
+	appendLines(t, fileName, "one\ntwo\nthree")
+
+	tail, err := TailFile(context.Background(), logger.Sugar(), fileName, Position{}, false)
+	require.NoError(t, err)
+	require.Equal(t, "one", next(t, tail).Text)
+	second := next(t, tail)
+	require.Equal(t, "two", second.Text)
+	require.Equal(t, 2, second.Position.Line)
+	require.Equal(t, int64(8), second.Position.Offset)
+	// Unterminated last line is read when not following
+	require.Equal(t, "three", next(t, tail).Text)
+
+	checkpoints := filepath.Join(dir, "checkpoints")
+	position, err := LoadCheckpoint(checkpoints, fileName)
+	require.NoError(t, err)
+	require.Equal(t, Position{}, position)
+	require.NoError(t, SaveCheckpoint(checkpoints, fileName, second.Position))
+	position, err = LoadCheckpoint(checkpoints, fileName)
+	require.NoError(t, err)
+	require.Equal(t, second.Position, position)
+
+	// Resumes after the checkpointed line (keeping line numbers)
+	tail, err = TailFile(context.Background(), logger.Sugar(), fileName, position, false)
+	require.NoError(t, err)
+	line := next(t, tail)
+	require.Equal(t, "three", line.Text)
+	require.Equal(t, 3, line.Position.Line)
+
+	// Starts over if the file was truncated (line numbers go on so that log locations stay unique)
+	require.NoError(t, os.WriteFile(fileName, []byte("new\n"), 0644))
+	tail, err = TailFile(context.Background(), logger.Sugar(), fileName, position, false)
+	require.NoError(t, err)
+	line = next(t, tail)
+	require.Equal(t, "new", line.Text)
+	require.Equal(t, int64(4), line.Position.Offset)
+	require.Equal(t, 3, line.Position.Line)
+
+}
+
+func TestCatchUpRotatedSegments(t *testing.T) {
+	dir := t.TempDir()
+	fileName := filepath.Join(dir, "app.log")
+	appendLines(t, fileName, "a1\na2\na3\n")
+	tail, err := TailFile(context.Background(), logger.Sugar(), fileName, Position{}, false)
+	require.NoError(t, err)
+	position := next(t, tail).Position
+
+	// Rotated twice (and compressed) while the agent was down
+	now := time.Now()
+	var gz bytes.Buffer
+	gzWriter := gzip.NewWriter(&gz)
+	_, err = gzWriter.Write([]byte("a1\na2\na3\n"))
+	require.NoError(t, err)
+	require.NoError(t, gzWriter.Close())
+	require.NoError(t, os.WriteFile(fileName+".2.gz", gz.Bytes(), 0644))
+	require.NoError(t, os.Chtimes(fileName+".2.gz", now, now.Add(-2*time.Hour)))
+	zstWriter, err := zstd.NewWriter(nil)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(fileName+".1.zst", zstWriter.EncodeAll([]byte("b1\nb2"), nil), 0644))
+	require.NoError(t, os.Chtimes(fileName+".1.zst", now, now.Add(-time.Hour)))
+	require.NoError(t, os.Remove(fileName))
+	appendLines(t, fileName, "c1\n")
+	require.Equal(t, []string{fileName + ".2.gz", fileName + ".1.zst"}, Segments(fileName))
+
+	tail, err = TailFile(context.Background(), logger.Sugar(), fileName, position, false)
+	require.NoError(t, err)
+	var lines []string
+	for line := range tail.Lines {
+		lines = append(lines, fmt.Sprintf("%s:%d:%s", filepath.Base(line.File), line.Position.Line, line.Text))
+	}
+	require.Equal(t, []string{
+		"app.log.2.gz:2:a2",
+		"app.log.2.gz:3:a3",
+		"app.log.1.zst:4:b1",
+		"app.log.1.zst:5:b2",
+		"app.log:6:c1",
+	}, lines)
+}
+
+func TestFollowTruncationAndRotation(t *testing.T) {
+	PollInterval = 10 * time.Millisecond
+	dir := t.TempDir()
+	fileName := filepath.Join(dir, "app.log")
+	appendLines(t, fileName, "one\n")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tail, err := TailFile(ctx, logger.Sugar(), fileName, Position{}, true)
+	require.NoError(t, err)
+	require.Equal(t, "one", next(t, tail).Text)
+
+	// Partial lines are only sent once terminated
+	appendLines(t, fileName, "tw")
+	appendLines(t, fileName, "o\n")
+	line := next(t, tail)
+	require.Equal(t, "two", line.Text)
+	require.Equal(t, 2, line.Position.Line)
+
+	// copytruncate: lines written right before the copy are read from it
+	appendLines(t, fileName, "copied\n")
+	content, err := os.ReadFile(fileName)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(fileName+".1", content, 0644))
+	require.NoError(t, os.Truncate(fileName, 0))
+	appendLines(t, fileName, "truncated\n")
+	for {
+		// The copied line might have been read before the truncation
+		line = next(t, tail)
+		if line.Text != "copied" {
+			break
+		}
+	}
+	require.Equal(t, "truncated", line.Text)
+	require.Equal(t, 4, line.Position.Line)
+	require.NoError(t, os.Remove(fileName+".1"))
+
+	// create (move and recreate): the old file is read until the end
+	// (once the tailer is idle, lines read right before a rename are from the log file)
+	time.Sleep(5 * PollInterval)
+	require.NoError(t, os.Rename(fileName, fileName+".1"))
+	appendLines(t, fileName+".1", "last\n")
+	appendLines(t, fileName, "rotated\n")
+	// Lines left in the old file are from the segment it was renamed to
+	line = next(t, tail)
+	require.Equal(t, "last", line.Text)
+	require.Equal(t, fileName+".1", line.File)
+	require.Equal(t, 5, line.Position.Line)
+	line = next(t, tail)
+	require.Equal(t, "rotated", line.Text)
+	require.Equal(t, fileName, line.File)
+	require.Equal(t, 6, line.Position.Line)
+
+	cancel()
+	require.Eventually(t, func() bool {
+		_, ok := <-tail.Lines
+		return !ok
+	}, time.Second, 5*time.Millisecond)
+	require.NoError(t, tail.Err())
+}
+
+func TestIsSegment(t *testing.T) {
+	for _, name := range []string{"app.log.1", "app.log.12.gz", "app.log.gz", "app.log-20230102", "app.log-20230102.zst", "app.log.2023-01-02", "app.log-2023-01-02T10:00:00.gz"} {
+		require.True(t, IsSegment("app.log", name), name)
+	}
+	for _, name := range []string{"app.log", "app.log.bak", "app.log-old", "app.log.1.txt", "app.logs", "service-worker.log"} {
+		require.False(t, IsSegment("app.log", name), name)
+	}
+	require.False(t, IsSegment("service", "service-worker.log"))
+}
@@ -0,0 +1,89 @@
+package tokenizer
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/pkoukk/tiktoken-go"
+	tiktoken_loader "github.com/pkoukk/tiktoken-go-loader"
+)
+
+// Encoding used for models unknown to the tokenizer (e.g. local models)
+const fallbackEncoding = "cl100k_base"
+
+// Tokens added by the chat format for every message and for priming the reply
+// https://github.com/openai/openai-cookbook/blob/main/examples/How_to_count_tokens_with_tiktoken.ipynb
+const (
+	tokensPerMessage = 3
+	tokensPerReply   = 3
+)
+
+// Counter returns the number of tokens in a text
+type Counter func(text string) int
+
+var (
+	mu        sync.Mutex
+	encodings = map[string]*tiktoken.Tiktoken{}
+)
+
+func init() {
+	// BPE ranks are embedded in the binary (no network access required)
+	tiktoken.SetBpeLoader(tiktoken_loader.NewOfflineLoader())
+}
+
+// Approximate estimates tokens as 4 characters per token
+// https://help.openai.com/en/articles/4936856-what-are-tokens-and-how-to-count-them
+func Approximate(text string) int {
+	return len(text) / 4
+}
+
+// ForModel returns a BPE token counter for the model encoding (cl100k_base, o200k_base...).
+// Models unknown to the tokenizer use cl100k_base and an empty model uses the approximation.
+func ForModel(model string) (Counter, error) {
+	if model == "" {
+		return Approximate, nil
+	}
+	encodingName, ok := tiktoken.MODEL_TO_ENCODING[model]
+	if !ok {
+		encodingName = fallbackEncoding
+		for prefix, name := range tiktoken.MODEL_PREFIX_TO_ENCODING {
+			if strings.HasPrefix(model, prefix) {
+				encodingName = name
+				break
+			}
+		}
+	}
+	encoding, err := getEncoding(encodingName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load encoding (%s) for model (%s): %w", encodingName, model, err)
+	}
+	return func(text string) int {
+		// Special tokens in logs are regular text
+		return len(encoding.EncodeOrdinary(text))
+	}, nil
+}
+
+// Budget returns the tokens left for the log context once the given chat messages are sent
+func Budget(count Counter, maxTokens int, messages ...string) int {
+	budget := maxTokens - tokensPerReply
+	for _, message := range messages {
+		budget -= count(message) + tokensPerMessage
+	}
+	return budget
+}
+
+// Encodings are expensive to load so they are shared
+func getEncoding(name string) (*tiktoken.Tiktoken, error) {
+	mu.Lock()
+	defer mu.Unlock()
+	if encoding, ok := encodings[name]; ok {
+		return encoding, nil
+	}
+	encoding, err := tiktoken.GetEncoding(name)
+	if err != nil {
+		return nil, err
+	}
+	encodings[name] = encoding
+	return encoding, nil
+}
@@ -0,0 +1,34 @@
+package tokenizer
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestForModel(t *testing.T) {
+	count, err := ForModel("")
+	require.NoError(t, err)
+	require.Equal(t, 2, count("0123456789"))
+
+	count, err = ForModel("gpt-4")
+	require.NoError(t, err)
+	require.Equal(t, 2, count("hello world"))
+	// Non-English text takes more tokens than the 4 characters per token estimate
+	require.Equal(t, 11, count("ディスクがいっぱいです"))
+	require.Greater(t, count("ディスクがいっぱいです"), Approximate("ディスクがいっぱいです"))
+
+	// Versioned and unknown models are supported too
+	_, err = ForModel("gpt-4o-2024-05-13")
+	require.NoError(t, err)
+	count, err = ForModel("llama3")
+	require.NoError(t, err)
+	require.Equal(t, 2, count("hello world"))
+}
+
+func TestBudget(t *testing.T) {
+	count, err := ForModel("gpt-4")
+	require.NoError(t, err)
+	// 3 tokens to prime the reply plus 3 tokens per message
+	require.Equal(t, 100-3-(2+3)-(2+3), Budget(count, 100, "hello world", "hello world"))
+}
@@ -1,12 +1,18 @@
 package main
 
 import (
+	"context"
+	"fmt"
 	"github.com/stretchr/testify/require"
 	"go.uber.org/zap"
+	"gopkg.in/yaml.v3"
+	"os"
+	"strings"
 	"sync"
 	"testing"
 	"time"
 
+	"github.com/ingyamilmolinar/doctorgpt/agent/internal/clock"
 	"github.com/ingyamilmolinar/doctorgpt/agent/internal/common"
 	"github.com/ingyamilmolinar/doctorgpt/agent/internal/config"
 	"github.com/ingyamilmolinar/doctorgpt/agent/internal/parser"
@@ -271,7 +277,7 @@ func TestWindowsParser(t *testing.T) {
 func testParser(t *testing.T, mainParser parser.Parser, expectedLastEntry parser.LogEntry, logLines int, filePath string) {
 	var wg sync.WaitGroup
 	// create validation function
-	handler := func(log *zap.SugaredLogger, fileName, outputDir, apiKey, model string, entryToDiagnose parser.LogEntry, logContext []parser.LogEntry) error {
+	handler := func(log *zap.SugaredLogger, fileName, outputDir, model string, entryToDiagnose parser.LogEntry, logContext []parser.LogEntry) error {
 		defer wg.Done()
 		require.Equal(t, expectedLastEntry, entryToDiagnose)
 		require.Equal(t, logLines, len(logContext))
@@ -284,10 +290,303 @@ func testParser(t *testing.T, mainParser parser.Parser, expectedLastEntry parser
 	// Monitor log (will finish and not tail)
 	wg.Add(1)
 	go func() {
-		MonitorLogLoop(logger.Sugar(), filePath, "", "", "", logLines, 999999, []parser.Parser{
+		MonitorLogLoop(context.Background(), logger.Sugar(), filePath, "", "", "", logLines, 999999, []parser.Parser{
 			mainParser,
 			allLineParser,
-		}, handler, 100*time.Millisecond, false)
+		}, handler, nil, 100*time.Millisecond, false)
 	}()
 	common.WaitWithTimeout(t, &wg, 2*time.Second)
 }
+
+func TestJSONParser(t *testing.T) {
+	jsonParser, err := parser.NewParserFromConfig(logger.Sugar(), config.ParserConfig{
+		Kind: "json",
+		Triggers: []config.VariableMatcher{
+			{
+				Variable: "error.kind",
+				Regex:    "timeout",
+			},
+		},
+	}, nil)
+	require.NoError(t, err)
+
+	expectedEntries := []parser.LogEntry{
+		{
+			Parser:    &jsonParser,
+			Triggered: false,
+			Text:      "{\"level\":\"info\",\"ts\":1681984800.123,\"caller\":\"server/main.go:42\",\"msg\":\"server started\",\"port\":8080}",
+			LineNo:    1,
+			Variables: map[string]string{
+				"LINENO": "1",
+				"level":  "info",
+				"ts":     "1681984800.123",
+				"caller": "server/main.go:42",
+				"msg":    "server started",
+				"port":   "8080",
+			},
+		},
+		{
+			Parser:    &jsonParser,
+			Triggered: true,
+			Text:      "{\"level\":\"error\",\"ts\":1681984801.456,\"caller\":\"billing/charge.go:88\",\"msg\":\"charge failed\",\"error\":{\"kind\":\"timeout\",\"retries\":3},\"tags\":[\"billing\",\"stripe\"],\"sampled\":true,\"trace\":null}",
+			LineNo:    2,
+			Variables: map[string]string{
+				"LINENO":        "2",
+				"level":         "error",
+				"ts":            "1681984801.456",
+				"caller":        "billing/charge.go:88",
+				"msg":           "charge failed",
+				"error.kind":    "timeout",
+				"error.retries": "3",
+				"tags.0":        "billing",
+				"tags.1":        "stripe",
+				"sampled":       "true",
+				"trace":         "",
+			},
+		},
+		{
+			Parser:    &allLineParser,
+			Triggered: false,
+			Text:      "panic: runtime error: invalid memory address or nil pointer dereference",
+			LineNo:    3,
+			Variables: map[string]string{
+				"LINENO":  "3",
+				"MESSAGE": "panic: runtime error: invalid memory address or nil pointer dereference",
+			},
+		},
+	}
+	expectedParsers := []int{0, 0, 1}
+
+	lines, err := os.ReadFile("testlogs/json.log")
+	require.NoError(t, err)
+	for i, line := range strings.Split(strings.TrimSpace(string(lines)), "\n") {
+		entry, matched, err := parser.ParseLogEntry(logger.Sugar(), []parser.Parser{jsonParser, allLineParser}, line, i+1)
+		require.NoError(t, err)
+		require.Equal(t, expectedEntries[i], entry)
+		require.Equal(t, expectedParsers[i], matched)
+	}
+}
+
+func TestLogfmtParser(t *testing.T) {
+	logfmtParser, err := parser.NewParserFromConfig(logger.Sugar(), config.ParserConfig{
+		Kind: "logfmt",
+		Triggers: []config.VariableMatcher{
+			{
+				Variable: "level",
+				Regex:    "error",
+			},
+		},
+	}, nil)
+	require.NoError(t, err)
+
+	expectedEntries := []parser.LogEntry{
+		{
+			Parser:    &logfmtParser,
+			Triggered: false,
+			Text:      "time=2023-04-20T10:00:00Z level=info msg=\"request served\" path=/api/users status=200 dur=12ms",
+			LineNo:    1,
+			Variables: map[string]string{
+				"LINENO": "1",
+				"time":   "2023-04-20T10:00:00Z",
+				"level":  "info",
+				"msg":    "request served",
+				"path":   "/api/users",
+				"status": "200",
+				"dur":    "12ms",
+			},
+		},
+		{
+			Parser:    &logfmtParser,
+			Triggered: true,
+			Text:      "time=2023-04-20T10:00:01Z level=error msg=\"db timeout: \\\"orders\\\" table\\tlocked\" dur=3s retry=",
+			LineNo:    2,
+			Variables: map[string]string{
+				"LINENO": "2",
+				"time":   "2023-04-20T10:00:01Z",
+				"level":  "error",
+				"msg":    "db timeout: \"orders\" table\tlocked",
+				"dur":    "3s",
+				"retry":  "",
+			},
+		},
+		{
+			Parser:    &allLineParser,
+			Triggered: false,
+			Text:      "Apr 20 10:00:02 worker exited unexpectedly",
+			LineNo:    3,
+			Variables: map[string]string{
+				"LINENO":  "3",
+				"MESSAGE": "Apr 20 10:00:02 worker exited unexpectedly",
+			},
+		},
+	}
+	expectedParsers := []int{0, 0, 1}
+
+	lines, err := os.ReadFile("testlogs/logfmt.log")
+	require.NoError(t, err)
+	for i, line := range strings.Split(strings.TrimSpace(string(lines)), "\n") {
+		entry, matched, err := parser.ParseLogEntry(logger.Sugar(), []parser.Parser{logfmtParser, allLineParser}, line, i+1)
+		require.NoError(t, err)
+		require.Equal(t, expectedEntries[i], entry)
+		require.Equal(t, expectedParsers[i], matched)
+	}
+}
+
+func TestTypedVariables(t *testing.T) {
+	accessParser, err := parser.NewParserFromConfig(logger.Sugar(), config.ParserConfig{
+		Regex: `^(?P<TIME>\S+) (?P<STATUS>\d+) (?P<LATENCY>\S+) (?P<RATIO>\S+) (?P<PATH>\S+)$`,
+		Types: map[string]config.TypeConfig{
+			"TIME":    {Type: "timestamp", Layout: "2006-01-02T15:04:05"},
+			"STATUS":  {Type: "int"},
+			"LATENCY": {Type: "duration"},
+			"RATIO":   {Type: "float"},
+		},
+		Triggers: []config.VariableMatcher{
+			{Variable: "STATUS", Compare: ">= 500"},
+			{Variable: "LATENCY", Compare: "> 2s"},
+		},
+		Filters: []config.VariableMatcher{
+			{Variable: "RATIO", Compare: "< 0.1"},
+		},
+		Excludes: []config.VariableMatcher{
+			{Variable: "TIME", Compare: "< 2023-01-01T00:00:00"},
+			{Variable: "PATH", Compare: "== /healthz"},
+		},
+	}, nil)
+	require.NoError(t, err)
+
+	parse := func(line string) parser.LogEntry {
+		entry, err := accessParser.Parse(logger.Sugar(), line, 1)
+		require.NoError(t, err)
+		return entry
+	}
+	entry := parse("2023-07-22T10:00:00 502 15ms 0.5 /checkout")
+	require.True(t, entry.Triggered)
+	require.False(t, entry.Filtered)
+	require.False(t, entry.Excluded)
+	// Timestamps without a time zone are in the local one
+	require.Equal(t, time.Date(2023, 7, 22, 10, 0, 0, 0, time.Local), entry.Time)
+	require.True(t, parse("2023-07-22T10:00:00 200 2.5s 0.5 /checkout").Triggered)
+	require.False(t, parse("2023-07-22T10:00:00 200 2s 0.5 /checkout").Triggered)
+	require.True(t, parse("2023-07-22T10:00:00 503 15ms 0.05 /checkout").Filtered)
+	require.True(t, parse("2022-12-31T23:59:59 503 15ms 0.5 /checkout").Excluded)
+	require.True(t, parse("2023-07-22T10:00:00 503 15ms 0.5 /healthz").Excluded)
+	// Values of another type never match
+	entry = parse("not-a-time 200 slow 0.5 /checkout")
+	require.False(t, entry.Triggered)
+	require.True(t, entry.Time.IsZero())
+
+	// Timestamps can be compared against their age
+	jsonParser, err := parser.NewParserFromConfig(logger.Sugar(), config.ParserConfig{
+		Kind:     "json",
+		Types:    map[string]config.TypeConfig{"ts": {Type: "timestamp", Layout: "unix"}},
+		Triggers: []config.VariableMatcher{{Variable: "ts", Compare: "older than 5m"}},
+	}, nil)
+	require.NoError(t, err)
+	entry, err = jsonParser.Parse(logger.Sugar(), fmt.Sprintf(`{"ts": %d.5}`, time.Now().Add(-time.Hour).Unix()), 1)
+	require.NoError(t, err)
+	require.True(t, entry.Triggered)
+	entry, err = jsonParser.Parse(logger.Sugar(), fmt.Sprintf(`{"ts": %d}`, time.Now().Unix()), 1)
+	require.NoError(t, err)
+	require.False(t, entry.Triggered)
+	// Archived logs tell the age of timestamps from the clock of their source
+	logClock := clock.New()
+	parseArchived := func(ts string) parser.LogEntry {
+		entry, _, err := parser.ParseLogEntryWithVariables(logger.Sugar(), []parser.Parser{jsonParser}, fmt.Sprintf(`{"ts": %s}`, ts), 1, nil, logClock)
+		require.NoError(t, err)
+		return entry
+	}
+	archived := time.Date(2023, 7, 22, 10, 0, 0, 0, time.UTC)
+	require.False(t, parseArchived(fmt.Sprint(archived.Unix())).Triggered)
+	require.False(t, parseArchived(fmt.Sprint(archived.Add(10*time.Minute).Unix())).Triggered)
+	require.True(t, parseArchived(fmt.Sprint(archived.Add(time.Minute).Unix())).Triggered)
+
+	// Timestamps without a year get it from the clock of their source
+	syslogParser, err := parser.NewParserFromConfig(logger.Sugar(), config.ParserConfig{
+		Regex: `^(?P<TIME>\w+ +\d+ \S+) (?P<MESSAGE>.*)$`,
+		Types: map[string]config.TypeConfig{"TIME": {Type: "timestamp", Layout: time.Stamp}},
+	}, nil)
+	require.NoError(t, err)
+	logClock = clock.New()
+	parseYearless := func(line string) time.Time {
+		entry, _, err := parser.ParseLogEntryWithVariables(logger.Sugar(), []parser.Parser{syslogParser}, line, 1, nil, logClock)
+		require.NoError(t, err)
+		return entry.Time
+	}
+	logClock.Observe(time.Date(2020, 12, 31, 23, 0, 0, 0, time.Local))
+	require.Equal(t, time.Date(2020, 12, 31, 23, 59, 0, 0, time.Local), parseYearless("Dec 31 23:59:00 shutting down"))
+	// Archived logs crossing a new year
+	require.Equal(t, time.Date(2021, 1, 1, 0, 1, 0, 0, time.Local), parseYearless("Jan  1 00:01:00 starting"))
+
+	// Invalid configurations
+	for _, cfg := range []config.ParserConfig{
+		{Regex: `^(?P<STATUS>\d+)$`, Types: map[string]config.TypeConfig{"STATUS": {Type: "number"}}},
+		{Regex: `^(?P<STATUS>\d+)$`, Types: map[string]config.TypeConfig{"CODE": {Type: "int"}}},
+		{Regex: `^(?P<STATUS>\d+)$`, Types: map[string]config.TypeConfig{"STATUS": {Type: "int", Layout: "unix"}}},
+		{Regex: `^(?P<STATUS>\d+)$`, Triggers: []config.VariableMatcher{{Variable: "STATUS", Compare: "> 500"}}},
+		{Regex: `^(?P<STATUS>\d+)$`, Types: map[string]config.TypeConfig{"STATUS": {Type: "int"}}, Triggers: []config.VariableMatcher{{Variable: "STATUS", Compare: "> 5xx"}}},
+		{Regex: `^(?P<STATUS>\d+)$`, Types: map[string]config.TypeConfig{"STATUS": {Type: "int"}}, Triggers: []config.VariableMatcher{{Variable: "STATUS", Compare: "older than 5m"}}},
+		{Regex: `^(?P<STATUS>\d+)$`, Types: map[string]config.TypeConfig{"STATUS": {Type: "int"}}, Triggers: []config.VariableMatcher{{Variable: "STATUS", Compare: "500"}}},
+		{Regex: `^(?P<STATUS>\d+)$`, Types: map[string]config.TypeConfig{"STATUS": {Type: "int"}}, Triggers: []config.VariableMatcher{{Variable: "STATUS", Regex: "5", Compare: "> 500"}}},
+	} {
+		_, err := parser.NewParserFromConfig(logger.Sugar(), cfg, nil)
+		require.Error(t, err, "config: %+v", cfg)
+	}
+}
+
+func TestTriggerExpressions(t *testing.T) {
+	var cfg config.ParserConfig
+	err := yaml.Unmarshal([]byte(`
+regex: '^(?P<LEVEL>\S+) (?P<SERVICE>\S+) (?P<STATUS>\d+) (?P<MESSAGE>.*)$'
+types:
+  STATUS:
+    type: int
+triggers:
+  - 'LEVEL =~ "ERROR" && !(MESSAGE =~ "HTTP 401") && SERVICE == "billing"'
+  - expression: 'STATUS >= 500 && (SERVICE == checkout || SERVICE == cart)'
+  - variable: LEVEL
+    regex: FATAL
+excludes:
+  - 'MESSAGE !~ "." || LEVEL == DEBUG'
+`), &cfg)
+	require.NoError(t, err)
+	accessParser, err := parser.NewParserFromConfig(logger.Sugar(), cfg, nil)
+	require.NoError(t, err)
+
+	parse := func(line string) parser.LogEntry {
+		entry, err := accessParser.Parse(logger.Sugar(), line, 1)
+		require.NoError(t, err)
+		return entry
+	}
+	require.True(t, parse("ERROR billing 200 payment declined").Triggered)
+	require.False(t, parse("ERROR billing 200 upstream returned HTTP 401").Triggered)
+	require.False(t, parse("ERROR shipping 200 payment declined").Triggered)
+	require.False(t, parse("INFO billing 200 payment declined").Triggered)
+	require.True(t, parse("INFO cart 503 upstream unavailable").Triggered)
+	require.False(t, parse("INFO cart 404 not found").Triggered)
+	require.False(t, parse("INFO billing 503 upstream unavailable").Triggered)
+	require.True(t, parse("FATAL shipping 200 out of memory").Triggered)
+	require.True(t, parse("DEBUG billing 200 payment declined").Excluded)
+	require.True(t, parse("ERROR billing 200 ").Excluded)
+	require.False(t, parse("ERROR billing 200 payment declined").Excluded)
+
+	// Invalid expressions
+	for _, expression := range []string{
+		`LEVEL =~ "ERROR" &&`,
+		`LEVEL =~ "ERROR" SERVICE == billing`,
+		`(LEVEL =~ "ERROR"`,
+		`LEVEL =~ "ERROR)`,
+		`LEVEL ERROR`,
+		`CODE == 500`,
+		`LEVEL =~ "("`,
+		`STATUS > 5xx`,
+		`SERVICE > billing`,
+		`STATUS older than 5m`,
+		`LEVEL == ERROR # comment`,
+	} {
+		_, err := parser.NewParser(logger.Sugar(), cfg.Regex, nil, []config.VariableMatcher{{Expression: expression}}, nil)
+		require.Error(t, err, "expression: %s", expression)
+	}
+	_, err = parser.NewParser(logger.Sugar(), cfg.Regex, nil, []config.VariableMatcher{{Variable: "LEVEL", Expression: "LEVEL == ERROR"}}, nil)
+	require.Error(t, err)
+}